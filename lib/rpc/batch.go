@@ -0,0 +1,173 @@
+package swissknife
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"net/rpc"
+	"sync"
+)
+
+// batchMethod is the reserved method that carries a batch of calls. The
+// server runs the calls itself instead of consulting registered services.
+const batchMethod = "_Batch.Call"
+
+// DefaultMaxBatchCalls is the number of calls per batch allowed by
+// DefaultServerLimits.
+const DefaultMaxBatchCalls = 1000
+
+var (
+	// ErrBatchTooLarge is returned for batches with more than
+	// ServerLimits.MaxBatchCalls calls.
+	ErrBatchTooLarge = errors.New("rpc: batch has too many calls")
+
+	// ErrBatchSkipped is the error of calls not run because an earlier call
+	// of a sequential batch with StopOnError failed.
+	ErrBatchSkipped = errors.New("rpc: call skipped after earlier failure in batch")
+)
+
+// BatchCall is a single call in a Batch. IdempotencyKey, if set, is the
+// call's idempotency key; see WithIdempotency.
+type BatchCall struct {
+	ServiceMethod  string
+	Args           []byte
+	IdempotencyKey string
+}
+
+// Batch is a list of calls sent to the server in one request.
+type Batch struct {
+	Calls []BatchCall
+
+	// Sequential runs the calls one after the other, in order. By default
+	// they run concurrently.
+	Sequential bool
+
+	// StopOnError, with Sequential, skips the calls following a failed one.
+	StopOnError bool
+}
+
+// BatchResult is the outcome of a BatchCall.
+type BatchResult struct {
+	Reply []byte
+	Err   error
+}
+
+// batchResponse is the reply to batchMethod, with one result per call.
+type batchResponse struct {
+	Results []batchResult
+}
+
+type batchResult struct {
+	Reply []byte
+	Error string
+}
+
+// CallBatch sends every call of batch to the server in a single round trip
+// and returns their results in the same order. Each call is authorized,
+// rate limited and recorded like a separate call. The returned error is
+// only non-nil when the batch as a whole failed.
+func CallBatch(client ITlsRpcClient, batch Batch) ([]BatchResult, error) {
+	var args bytes.Buffer
+	if err := gob.NewEncoder(&args).Encode(&batch); err != nil {
+		return nil, fmt.Errorf("failed to encode batch: %w", err)
+	}
+	replyData, err := client.ConnectToRpcServerTls(batchMethod, args.Bytes())
+	if err != nil {
+		return nil, err
+	}
+
+	var reply batchResponse
+	if err := gob.NewDecoder(bytes.NewReader(replyData)).Decode(&reply); err != nil {
+		return nil, fmt.Errorf("invalid batch response: %w", err)
+	}
+	if len(reply.Results) != len(batch.Calls) {
+		return nil, fmt.Errorf("invalid batch response: %d results for %d calls", len(reply.Results), len(batch.Calls))
+	}
+
+	results := make([]BatchResult, len(reply.Results))
+	for i, r := range reply.Results {
+		results[i].Reply = r.Reply
+		if r.Error != "" {
+			results[i].Err = remoteError(rpc.ServerError(r.Error))
+		}
+	}
+	return results, nil
+}
+
+// runBatch runs the batch carried by req with ctx and encodes the results.
+func (sc *serverConn) runBatch(ctx context.Context, req *serverRequest) ([]byte, error) {
+	var batch Batch
+	if err := gob.NewDecoder(bytes.NewReader(req.args)).Decode(&batch); err != nil {
+		return nil, fmt.Errorf("rpc: cannot decode batch: %w", err)
+	}
+	if limit := sc.server.limits.MaxBatchCalls; limit > 0 && len(batch.Calls) > limit {
+		sc.server.logger.Warnf("Rejecting batch of %d calls from %s: %v (limit %d)", len(batch.Calls), sc.remote, ErrBatchTooLarge, limit)
+		return nil, ErrBatchTooLarge
+	}
+	sc.server.logger.Debugf("Running batch of %d calls from %s", len(batch.Calls), sc.remote)
+
+	results := make([]batchResult, len(batch.Calls))
+	record := func(i int, reply []byte, err error) {
+		results[i].Reply = reply
+		if err != nil {
+			results[i].Error = err.Error()
+		}
+	}
+
+	if batch.Sequential {
+		failed := false
+		for i, call := range batch.Calls {
+			if failed && batch.StopOnError {
+				record(i, nil, ErrBatchSkipped)
+				continue
+			}
+			reply, err := sc.runBatchCall(ctx, req, call)
+			record(i, reply, err)
+			failed = failed || err != nil
+		}
+	} else {
+		// The batch holds a single call slot, so bound its own concurrency
+		// by the same limit.
+		workers := len(batch.Calls)
+		if limit := sc.server.limits.MaxConcurrentCalls; limit > 0 && limit < workers {
+			workers = limit
+		}
+		slots := make(chan struct{}, max(workers, 1))
+		var wg sync.WaitGroup
+		for i, call := range batch.Calls {
+			slots <- struct{}{}
+			wg.Add(1)
+			go func() {
+				defer func() { <-slots; wg.Done() }()
+				reply, err := sc.runBatchCall(ctx, req, call)
+				record(i, reply, err)
+			}()
+		}
+		wg.Wait()
+	}
+
+	var reply bytes.Buffer
+	if err := gob.NewEncoder(&reply).Encode(&batchResponse{Results: results}); err != nil {
+		return nil, err
+	}
+	return reply.Bytes(), nil
+}
+
+// runBatchCall admits and runs a single call of the batch carried by batch,
+// with the bearer token sent with the batch.
+func (sc *serverConn) runBatchCall(ctx context.Context, batch *serverRequest, call BatchCall) ([]byte, error) {
+	req := &serverRequest{
+		header: requestHeader{ServiceMethod: call.ServiceMethod, Token: batch.header.Token, IdempotencyKey: call.IdempotencyKey},
+		args:   call.Args,
+	}
+	if call.ServiceMethod == batchMethod || call.ServiceMethod == heartbeatMethod {
+		return nil, fmt.Errorf("rpc: %s cannot be called in a batch", call.ServiceMethod)
+	}
+	if err := sc.admit(req); err != nil {
+		sc.server.metrics.callRejected(sc.server.methodLabel(call.ServiceMethod), err)
+		return nil, err
+	}
+	return sc.call(ctx, req)
+}
@@ -0,0 +1,138 @@
+package swissknife
+
+import (
+	"encoding/json"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// SlowService sleeps before answering and tracks how many calls overlap.
+type SlowService struct {
+	running, peak atomic.Int32
+}
+
+func (s *SlowService) Wait(args *[]byte, reply *[]byte) error {
+	n := s.running.Add(1)
+	defer s.running.Add(-1)
+	for {
+		peak := s.peak.Load()
+		if n <= peak || s.peak.CompareAndSwap(peak, n) {
+			break
+		}
+	}
+	time.Sleep(50 * time.Millisecond)
+	*reply = *args
+	return nil
+}
+
+func (s *SlowService) Fail(args *[]byte, reply *[]byte) error {
+	return errors.New("boom")
+}
+
+func addCall(t *testing.T, a, b int) BatchCall {
+	t.Helper()
+
+	args, err := json.Marshal(Args{A: a, B: b})
+	require.NoError(t, err)
+	return BatchCall{ServiceMethod: "TestService.Add", Args: args}
+}
+
+func sum(t *testing.T, result BatchResult) int {
+	t.Helper()
+
+	require.NoError(t, result.Err)
+	var reply Reply
+	require.NoError(t, json.Unmarshal(result.Reply, &reply))
+	return reply.Sum
+}
+
+func TestCallBatchReturnsPerCallResults(t *testing.T) {
+	pki := newTestPKI(t)
+	_, addr := startTestServer(t, pki)
+	client := newTestClient(t, pki, addr)
+
+	results, err := CallBatch(client, Batch{Calls: []BatchCall{
+		addCall(t, 1, 2),
+		{ServiceMethod: "TestService.Missing"},
+		addCall(t, 20, 22),
+		{ServiceMethod: batchMethod},
+	}})
+	require.NoError(t, err)
+	require.Len(t, results, 4)
+	require.Equal(t, 3, sum(t, results[0]))
+	require.Error(t, results[1].Err)
+	require.Equal(t, 42, sum(t, results[2]))
+	require.Error(t, results[3].Err)
+
+	results, err = CallBatch(client, Batch{})
+	require.NoError(t, err)
+	require.Empty(t, results)
+}
+
+func TestCallBatchConcurrency(t *testing.T) {
+	pki := newTestPKI(t)
+	limits := DefaultServerLimits()
+	limits.MaxConcurrentCalls = 2
+	s, addr := startTestServer(t, pki, WithLimits(limits))
+	slow := &SlowService{}
+	require.NoError(t, s.RegisterMethod("Slow", slow))
+	client := newTestClient(t, pki, addr)
+
+	calls := make([]BatchCall, 6)
+	for i := range calls {
+		calls[i] = BatchCall{ServiceMethod: "Slow.Wait", Args: []byte{byte(i)}}
+	}
+
+	results, err := CallBatch(client, Batch{Calls: calls})
+	require.NoError(t, err)
+	for i, result := range results {
+		require.NoError(t, result.Err)
+		require.Equal(t, []byte{byte(i)}, result.Reply)
+	}
+	require.Equal(t, int32(2), slow.peak.Load())
+
+	slow.peak.Store(0)
+	_, err = CallBatch(client, Batch{Calls: calls, Sequential: true})
+	require.NoError(t, err)
+	require.Equal(t, int32(1), slow.peak.Load())
+}
+
+func TestCallBatchStopOnError(t *testing.T) {
+	pki := newTestPKI(t)
+	s, addr := startTestServer(t, pki)
+	require.NoError(t, s.RegisterMethod("Slow", new(SlowService)))
+	client := newTestClient(t, pki, addr)
+
+	results, err := CallBatch(client, Batch{
+		Calls:       []BatchCall{addCall(t, 1, 1), {ServiceMethod: "Slow.Fail"}, addCall(t, 2, 2)},
+		Sequential:  true,
+		StopOnError: true,
+	})
+	require.NoError(t, err)
+	require.Equal(t, 2, sum(t, results[0]))
+	require.Error(t, results[1].Err)
+	require.Contains(t, results[1].Err.Error(), "boom")
+	require.ErrorIs(t, results[2].Err, ErrBatchSkipped)
+}
+
+func TestCallBatchAppliesLimitsPerCall(t *testing.T) {
+	pki := newTestPKI(t)
+	limits := DefaultServerLimits()
+	limits.MaxBatchCalls = 3
+	_, addr := startTestServer(t, pki,
+		WithLimits(limits),
+		WithSPIFFEAuthorization(SPIFFERule{Methods: []string{"TestService.*"}, Allow: []string{"spiffe://example.org/**"}}),
+	)
+	client := newTestClient(t, pki, addr)
+
+	results, err := CallBatch(client, Batch{Calls: []BatchCall{addCall(t, 1, 1)}})
+	require.NoError(t, err)
+	require.ErrorIs(t, results[0].Err, ErrPermissionDenied)
+
+	_, err = CallBatch(client, Batch{Calls: make([]BatchCall, 4)})
+	require.ErrorIs(t, err, ErrBatchTooLarge)
+}
@@ -0,0 +1,192 @@
+package swissknife
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/rpc"
+	"sync"
+)
+
+// bidiProtocol is the ALPN protocol that switches a connection to
+// bidirectional mode, where both ends send requests.
+const bidiProtocol = "swissknife-bidi/1"
+
+// frameKind precedes every message on a bidirectional connection to tell
+// requests from responses. Plain connections carry no frame kinds.
+type frameKind uint8
+
+const (
+	frameRequest frameKind = iota + 1
+	frameResponse
+)
+
+// ErrPeerClosed is returned by calls to a Peer whose connection has closed.
+var ErrPeerClosed = errors.New("rpc: peer connection closed")
+
+// WithBidirectional lets clients that registered services with
+// WithClientService connect in bidirectional mode, in which the server can
+// call those services through ConnInfo.Peer. Other clients are unaffected.
+func WithBidirectional() ServerOption {
+	return func(s *tlsRpcServer) {
+		s.bidirectional = true
+	}
+}
+
+// WithClientService registers service under name on the client, for the
+// server to call back over the same connection. Methods have the same
+// signatures as on the server, and Request.Conn describes the server. The
+// server must have been created with WithBidirectional.
+func WithClientService(name string, service any) ClientOption {
+	return func(c *tlsRpcClient) {
+		c.services = append(c.services, clientService{name: name, service: service})
+	}
+}
+
+type clientService struct {
+	name    string
+	service any
+}
+
+// registerServices returns an rpc.Server holding the client's services, or
+// nil when there are none.
+func (c *tlsRpcClient) registerServices() (*rpc.Server, error) {
+	if len(c.services) == 0 {
+		return nil, nil
+	}
+	server := rpc.NewServer()
+	for _, s := range c.services {
+		err := checkServiceTypes(s.service)
+		if err == nil {
+			err = server.RegisterName(s.name, s.service)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to register client service %s: %w", s.name, err)
+		}
+	}
+	return server, nil
+}
+
+// Peer calls the services of a client connected in bidirectional mode. It is
+// safe for concurrent use.
+type Peer struct {
+	codec  *serverCodec
+	remote string
+
+	mu      sync.Mutex
+	seq     uint64
+	pending map[uint64]chan peerReply
+	closed  bool
+	done    chan struct{}
+}
+
+type peerReply struct {
+	data []byte
+	err  error
+}
+
+func newPeer(codec *serverCodec, remote string) *Peer {
+	return &Peer{
+		codec:   codec,
+		remote:  remote,
+		pending: make(map[uint64]chan peerReply),
+		done:    make(chan struct{}),
+	}
+}
+
+// Done returns a channel that is closed when the connection closes.
+func (p *Peer) Done() <-chan struct{} {
+	return p.done
+}
+
+// Call calls serviceMethod on the client and waits for its reply.
+func (p *Peer) Call(serviceMethod string, args []byte) ([]byte, error) {
+	return p.CallContext(context.Background(), serviceMethod, args)
+}
+
+// CallContext is like Call but stops waiting when ctx is done. The time left
+// until ctx's deadline is sent along, so the client's handler is cancelled
+// when it passes; a call cancelled otherwise still runs to completion and
+// its reply is discarded.
+func (p *Peer) CallContext(ctx context.Context, serviceMethod string, args []byte) ([]byte, error) {
+	timeout, err := callTimeout(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	done := make(chan peerReply, 1)
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return nil, ErrPeerClosed
+	}
+	p.seq++
+	seq := p.seq
+	p.pending[seq] = done
+	p.mu.Unlock()
+
+	if err := p.codec.writeRequest(&requestHeader{ServiceMethod: serviceMethod, Seq: seq, Timeout: timeout}, args); err != nil {
+		p.forget(seq)
+		p.codec.conn.Close()
+		return nil, fmt.Errorf("failed to call %s on client %s: %w", serviceMethod, p.remote, err)
+	}
+
+	select {
+	case reply := <-done:
+		return reply.data, reply.err
+	case <-ctx.Done():
+		p.forget(seq)
+		return nil, ctx.Err()
+	}
+}
+
+func (p *Peer) forget(seq uint64) {
+	p.mu.Lock()
+	delete(p.pending, seq)
+	p.mu.Unlock()
+}
+
+// deliver completes the pending call answered by header.
+func (p *Peer) deliver(header *responseHeader, data []byte) {
+	p.mu.Lock()
+	done, ok := p.pending[header.Seq]
+	delete(p.pending, header.Seq)
+	p.mu.Unlock()
+	if !ok {
+		return
+	}
+
+	var err error
+	if header.Error != "" {
+		err = remoteError(rpc.ServerError(header.Error))
+	}
+	done <- peerReply{data: data, err: err}
+}
+
+// busy reports whether calls are waiting for the client.
+func (p *Peer) busy() bool {
+	if p == nil {
+		return false
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.pending) > 0
+}
+
+// close fails pending and future calls with ErrPeerClosed.
+func (p *Peer) close() {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return
+	}
+	p.closed = true
+	close(p.done)
+	for seq, done := range p.pending {
+		done <- peerReply{err: ErrPeerClosed}
+		delete(p.pending, seq)
+	}
+}
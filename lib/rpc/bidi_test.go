@@ -0,0 +1,137 @@
+package swissknife
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// WorkerService runs jobs pushed by the server on the client.
+type WorkerService struct {
+	mu   sync.Mutex
+	jobs []string
+}
+
+func (w *WorkerService) Run(req *Request, reply *[]byte) error {
+	w.mu.Lock()
+	w.jobs = append(w.jobs, string(req.Args))
+	w.mu.Unlock()
+	*reply = []byte("done " + string(req.Args))
+	return nil
+}
+
+func (w *WorkerService) Fail(args *[]byte, reply *[]byte) error {
+	return ErrTooManyCalls
+}
+
+// CallbackService calls back into the client while answering its call.
+type CallbackService struct{}
+
+func (s *CallbackService) Ask(req *Request, reply *[]byte) error {
+	if req.Conn.Peer == nil {
+		return errors.New("not a bidirectional connection")
+	}
+	answer, err := req.Conn.Peer.Call("Worker.Run", req.Args)
+	if err != nil {
+		return err
+	}
+	*reply = answer
+	return nil
+}
+
+// peerHooks publishes the Peer of every connection accepted by the server.
+func peerHooks(peers chan<- *Peer) ServerOption {
+	return WithConnHooks(ConnHooks{
+		OnConnect: func(info ConnInfo) error {
+			peers <- info.Peer
+			return nil
+		},
+	})
+}
+
+func TestServerCallsClientService(t *testing.T) {
+	pki := newTestPKI(t)
+	peers := make(chan *Peer, 1)
+	_, addr := startTestServer(t, pki, WithBidirectional(), peerHooks(peers))
+
+	worker := &WorkerService{}
+	client := newTestClient(t, pki, addr, WithClientService("Worker", worker))
+	peer := <-peers
+	require.NotNil(t, peer)
+
+	replies := make(chan string, 10)
+	for i := 0; i < 10; i++ {
+		go func(i int) {
+			reply, err := peer.Call("Worker.Run", []byte(fmt.Sprintf("job-%d", i)))
+			if err != nil {
+				reply = []byte(err.Error())
+			}
+			replies <- string(reply)
+		}(i)
+		require.Equal(t, 42, callAdd(t, client))
+	}
+	for i := 0; i < 10; i++ {
+		require.Contains(t, <-replies, "done job-")
+	}
+	worker.mu.Lock()
+	require.Len(t, worker.jobs, 10)
+	worker.mu.Unlock()
+
+	_, err := peer.Call("Worker.Fail", nil)
+	require.ErrorIs(t, err, ErrTooManyCalls)
+	_, err = peer.Call("Worker.Missing", nil)
+	require.Error(t, err)
+}
+
+func TestServerCallsBackDuringClientCall(t *testing.T) {
+	pki := newTestPKI(t)
+	s, addr := startTestServer(t, pki, WithBidirectional())
+	require.NoError(t, s.RegisterMethod("Callback", new(CallbackService)))
+
+	client := newTestClient(t, pki, addr, WithClientService("Worker", &WorkerService{}))
+	reply, err := client.ConnectToRpcServerTls("Callback.Ask", []byte("nested"))
+	require.NoError(t, err)
+	require.Equal(t, "done nested", string(reply))
+
+	plain := newTestClient(t, pki, addr)
+	_, err = plain.ConnectToRpcServerTls("Callback.Ask", []byte("nested"))
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "not a bidirectional connection")
+}
+
+func TestPeerCallsFailAfterDisconnect(t *testing.T) {
+	pki := newTestPKI(t)
+	peers := make(chan *Peer, 1)
+	_, addr := startTestServer(t, pki, WithBidirectional(), peerHooks(peers))
+
+	client := newTestClient(t, pki, addr, WithClientService("Worker", &WorkerService{}))
+	peer := <-peers
+	client.CloseClient()
+
+	require.Eventually(t, func() bool {
+		_, err := peer.Call("Worker.Run", nil)
+		return errors.Is(err, ErrPeerClosed)
+	}, 2*time.Second, 10*time.Millisecond)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := peer.CallContext(ctx, "Worker.Run", nil)
+	require.Error(t, err)
+}
+
+func TestClientServicesNeedBidirectionalServer(t *testing.T) {
+	pki := newTestPKI(t)
+	_, addr := startTestServer(t, pki)
+
+	_, err := NewITlsRpcClient(pki.caCert, pki.clientCert, pki.clientKey, addr, "worker", WithClientService("Worker", &WorkerService{}))
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "does not accept bidirectional connections")
+
+	_, err = NewITlsRpcClient(pki.caCert, pki.clientCert, pki.clientKey, addr, "worker", WithClientService("Worker", struct{}{}))
+	require.Error(t, err)
+}
@@ -0,0 +1,353 @@
+package swissknife
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"path"
+	"sync"
+	"time"
+)
+
+// CAServiceName is the name the CertificateAuthority registers under, and
+// CASignMethod the method clients call to have a CSR signed.
+const (
+	CAServiceName = "CertificateAuthority"
+	CASignMethod  = CAServiceName + ".Sign"
+)
+
+// DefaultCertValidity is the lifetime of issued certificates when
+// IssuancePolicy.Validity is zero.
+const DefaultCertValidity = 24 * time.Hour
+
+// ErrIssuanceDenied is returned when a certificate request breaks the
+// IssuancePolicy. The error text gives the reason.
+var ErrIssuanceDenied = errors.New("rpc: certificate issuance denied")
+
+// IssuancePolicy decides which certificates a CertificateAuthority issues.
+//
+// A caller authenticated with a certificate may only request its own common
+// name, DNS names and URIs, those its certificate already carries, which
+// makes renewal safe by default. A caller without a
+// certificate must present one of the BootstrapTokens and may only request
+// names matching the pattern of that token. In both cases every requested
+// name must match AllowedNames. Issued certificates are only valid for
+// client authentication unless ServerAuth is set.
+type IssuancePolicy struct {
+	// Validity is the lifetime of issued certificates, capped by the expiry
+	// of the CA certificate.
+	Validity time.Duration
+
+	// AllowedNames are path.Match patterns, such as "*.payments.internal",
+	// that the common name, DNS names and URIs of a request must match.
+	// Empty allows any name.
+	AllowedNames []string
+
+	// BootstrapTokens maps single-use enrolment tokens to the name pattern
+	// they may request.
+	BootstrapTokens map[string]string
+
+	// Authorize, when set, replaces the rule that authenticated callers may
+	// only renew their own names, and is the only way to let them request
+	// others. It can also veto bootstrap requests.
+	Authorize func(req IssuanceRequest) error
+
+	// ServerAuth makes issued certificates valid for server authentication
+	// as well as client authentication.
+	ServerAuth bool
+}
+
+// IssuanceRequest is a certificate request being considered by a
+// CertificateAuthority.
+type IssuanceRequest struct {
+	// Caller describes the connection the request arrived on. It has no
+	// peer certificates for bootstrap requests.
+	Caller ConnInfo
+
+	// Token is the bootstrap token presented, if any.
+	Token string
+
+	CSR *x509.CertificateRequest
+}
+
+// SignRequest is the JSON encoded argument of CASignMethod.
+type SignRequest struct {
+	// CSR is a PEM encoded certificate signing request.
+	CSR []byte `json:"csr"`
+
+	// Token is a bootstrap token, needed when calling without a
+	// certificate.
+	Token string `json:"token,omitempty"`
+}
+
+// SignResponse is the JSON encoded reply of CASignMethod.
+type SignResponse struct {
+	// Certificate is the PEM encoded certificate issued.
+	Certificate []byte `json:"certificate"`
+
+	// CACertificate is the PEM encoded certificate of the issuing CA.
+	CACertificate []byte `json:"caCertificate"`
+}
+
+// CertificateAuthority issues short-lived certificates to clients over TLS
+// RPC. Register it on a server with Register.
+type CertificateAuthority struct {
+	cert   *x509.Certificate
+	key    crypto.Signer
+	policy IssuancePolicy
+	now    func() time.Time
+
+	mu     sync.Mutex
+	tokens map[string]string
+	logger Logger
+}
+
+// NewCertificateAuthority loads the CA certificate and key that sign issued
+// certificates.
+func NewCertificateAuthority(certPath, keyPath string, policy IssuancePolicy) (*CertificateAuthority, error) {
+	pair, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load CA certificate and key: %w", err)
+	}
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse CA certificate: %w", err)
+	}
+	if !cert.IsCA {
+		return nil, fmt.Errorf("certificate %s is not a CA", cert.Subject)
+	}
+	key, ok := pair.PrivateKey.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported CA key type %T", pair.PrivateKey)
+	}
+	if policy.Validity <= 0 {
+		policy.Validity = DefaultCertValidity
+	}
+
+	tokens := make(map[string]string, len(policy.BootstrapTokens))
+	for token, pattern := range policy.BootstrapTokens {
+		tokens[token] = pattern
+	}
+	return &CertificateAuthority{
+		cert:   cert,
+		key:    key,
+		policy: policy,
+		now:    time.Now,
+		tokens: tokens,
+		logger: NewDefaultLogger(),
+	}, nil
+}
+
+// Register adds the CA to server under CAServiceName. To let new clients
+// bootstrap with a token, create the server with
+// WithUnauthenticatedMethods(CASignMethod).
+func (ca *CertificateAuthority) Register(server ITlsRpcServer) error {
+	return server.RegisterMethod(CAServiceName, &caService{ca: ca})
+}
+
+// SetLogger sets the logger that records issued and denied certificates.
+func (ca *CertificateAuthority) SetLogger(logger Logger) {
+	ca.mu.Lock()
+	ca.logger = logger
+	ca.mu.Unlock()
+}
+
+// Issue checks req against the policy and signs its CSR.
+func (ca *CertificateAuthority) Issue(req IssuanceRequest) (*x509.Certificate, error) {
+	if req.CSR == nil {
+		return nil, fmt.Errorf("%w: no CSR", ErrIssuanceDenied)
+	}
+
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+
+	cert, err := ca.issue(req)
+	if err != nil {
+		ca.logger.Warnf("Denied certificate for %q requested by %s: %v", req.CSR.Subject.CommonName, callerName(req.Caller), err)
+		return nil, err
+	}
+	ca.logger.Infof("Issued certificate %s for %q to %s, valid until %s", cert.SerialNumber, cert.Subject.CommonName, callerName(req.Caller), cert.NotAfter.Format(time.RFC3339))
+	return cert, nil
+}
+
+func (ca *CertificateAuthority) issue(req IssuanceRequest) (*x509.Certificate, error) {
+	csr := req.CSR
+	if err := csr.CheckSignature(); err != nil {
+		return nil, fmt.Errorf("%w: invalid CSR signature: %v", ErrIssuanceDenied, err)
+	}
+	if csr.Subject.CommonName == "" {
+		return nil, fmt.Errorf("%w: CSR has no common name", ErrIssuanceDenied)
+	}
+	if len(csr.IPAddresses) > 0 || len(csr.EmailAddresses) > 0 {
+		return nil, fmt.Errorf("%w: only DNS names and URIs may be requested", ErrIssuanceDenied)
+	}
+	names := requestedNames(csr)
+
+	if len(req.Caller.PeerCertificates) > 0 {
+		if ca.policy.Authorize == nil {
+			if err := ca.checkRenewal(req.Caller.PeerCertificates[0], csr); err != nil {
+				return nil, fmt.Errorf("%w: %s %v", ErrIssuanceDenied, callerName(req.Caller), err)
+			}
+		}
+	} else {
+		pattern, ok := ca.tokens[req.Token]
+		if !ok || req.Token == "" {
+			return nil, fmt.Errorf("%w: invalid or already used bootstrap token", ErrIssuanceDenied)
+		}
+		for _, name := range names {
+			if !matchName(pattern, name) {
+				return nil, fmt.Errorf("%w: name %q is not allowed by the bootstrap token", ErrIssuanceDenied, name)
+			}
+		}
+	}
+
+	if len(ca.policy.AllowedNames) > 0 {
+		for _, name := range names {
+			if !matchAnyName(ca.policy.AllowedNames, name) {
+				return nil, fmt.Errorf("%w: name %q is not allowed", ErrIssuanceDenied, name)
+			}
+		}
+	}
+	if ca.policy.Authorize != nil {
+		if err := ca.policy.Authorize(req); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrIssuanceDenied, err)
+		}
+	}
+
+	cert, err := ca.sign(csr)
+	if err != nil {
+		return nil, err
+	}
+	if len(req.Caller.PeerCertificates) == 0 {
+		delete(ca.tokens, req.Token)
+	}
+	return cert, nil
+}
+
+// checkRenewal checks that csr only asks for the common name, DNS names and
+// URIs that current carries. AllowedNames still applies on top of this.
+func (ca *CertificateAuthority) checkRenewal(current *x509.Certificate, csr *x509.CertificateRequest) error {
+	if csr.Subject.CommonName != current.Subject.CommonName {
+		return errors.New("may only renew its own name")
+	}
+	owned := make(map[string]bool, len(current.DNSNames)+len(current.URIs))
+	for _, name := range current.DNSNames {
+		owned[name] = true
+	}
+	for _, uri := range current.URIs {
+		owned[uri.String()] = true
+	}
+	for _, name := range requestedNames(csr)[1:] {
+		if !owned[name] {
+			return fmt.Errorf("may not request name %q that its certificate does not carry", name)
+		}
+	}
+	return nil
+}
+
+// sign issues a certificate for csr usable for client authentication, and
+// for server authentication when the policy allows it.
+func (ca *CertificateAuthority) sign(csr *x509.CertificateRequest) (*x509.Certificate, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate serial number: %w", err)
+	}
+
+	now := ca.now()
+	notAfter := now.Add(ca.policy.Validity)
+	if notAfter.After(ca.cert.NotAfter) {
+		notAfter = ca.cert.NotAfter
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: csr.Subject.CommonName},
+		DNSNames:     csr.DNSNames,
+		URIs:         csr.URIs,
+		NotBefore:    now.Add(-time.Minute),
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	if ca.policy.ServerAuth {
+		template.ExtKeyUsage = append(template.ExtKeyUsage, x509.ExtKeyUsageServerAuth)
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, csr.PublicKey, ca.key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign certificate: %w", err)
+	}
+	return x509.ParseCertificate(der)
+}
+
+// requestedNames lists the common name, DNS names and URIs of csr.
+func requestedNames(csr *x509.CertificateRequest) []string {
+	names := append([]string{csr.Subject.CommonName}, csr.DNSNames...)
+	for _, uri := range csr.URIs {
+		names = append(names, uri.String())
+	}
+	return names
+}
+
+func matchName(pattern, name string) bool {
+	ok, err := path.Match(pattern, name)
+	return err == nil && ok
+}
+
+func matchAnyName(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if matchName(pattern, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// callerName describes the caller of a request for logs.
+func callerName(info ConnInfo) string {
+	if identity := info.Identity(); identity != "" {
+		return identity
+	}
+	if info.RemoteAddr != nil {
+		return "unauthenticated client " + info.RemoteAddr.String()
+	}
+	return "unauthenticated client"
+}
+
+// caService exposes a CertificateAuthority as an RPC service.
+type caService struct {
+	ca *CertificateAuthority
+}
+
+// Sign issues a certificate for the JSON encoded SignRequest in req.
+func (s *caService) Sign(req *Request, reply *[]byte) error {
+	var signReq SignRequest
+	if err := json.Unmarshal(req.Args, &signReq); err != nil {
+		return fmt.Errorf("invalid sign request: %w", err)
+	}
+	block, _ := pem.Decode(signReq.CSR)
+	if block == nil || block.Type != "CERTIFICATE REQUEST" {
+		return errors.New("invalid sign request: csr must be a PEM encoded CERTIFICATE REQUEST")
+	}
+	csr, err := x509.ParseCertificateRequest(block.Bytes)
+	if err != nil {
+		return fmt.Errorf("invalid sign request: %w", err)
+	}
+
+	cert, err := s.ca.Issue(IssuanceRequest{Caller: req.Conn, Token: signReq.Token, CSR: csr})
+	if err != nil {
+		return err
+	}
+
+	*reply, err = json.Marshal(SignResponse{
+		Certificate:   pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}),
+		CACertificate: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: s.ca.cert.Raw}),
+	})
+	return err
+}
@@ -0,0 +1,298 @@
+package swissknife
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// startCAServer starts a test server running a CertificateAuthority backed by
+// the test CA, letting clients without a certificate bootstrap.
+func startCAServer(t *testing.T, pki *testPKI, policy IssuancePolicy) string {
+	t.Helper()
+
+	s, addr := startTestServer(t, pki, WithUnauthenticatedMethods(CASignMethod))
+	ca, err := NewCertificateAuthority(pki.caCert, pki.caKeyPath, policy)
+	require.NoError(t, err)
+	ca.SetLogger(newTestLogger(&bytes.Buffer{}, &bytes.Buffer{}, LogLevelDebug))
+	require.NoError(t, ca.Register(s))
+	return addr
+}
+
+func newTestRenewer(t *testing.T, pki *testPKI, addr string, cfg RenewerConfig) *CertificateRenewer {
+	t.Helper()
+
+	dir := t.TempDir()
+	cfg.Address = addr
+	cfg.CACertPath = pki.caCert
+	if cfg.CertPath == "" {
+		cfg.CertPath = filepath.Join(dir, "issued.crt")
+		cfg.KeyPath = filepath.Join(dir, "issued.key")
+	}
+	r := NewCertificateRenewer(cfg)
+	r.SetLogger(newTestLogger(&bytes.Buffer{}, &bytes.Buffer{}, LogLevelDebug))
+	return r
+}
+
+func TestCertificateAuthorityBootstrapsWithToken(t *testing.T) {
+	pki := newTestPKI(t)
+	addr := startCAServer(t, pki, IssuancePolicy{
+		Validity:        time.Hour,
+		AllowedNames:    []string{"*.svc"},
+		BootstrapTokens: map[string]string{"enrol-worker": "worker-*.svc"},
+	})
+
+	r := newTestRenewer(t, pki, addr, RenewerConfig{CommonName: "worker-1.svc", BootstrapToken: "enrol-worker"})
+	renewed, err := r.RenewIfNeeded()
+	require.NoError(t, err)
+	require.True(t, renewed)
+
+	issued := leaf(t, r.cfg.CertPath)
+	require.Equal(t, "worker-1.svc", issued.Subject.CommonName)
+	require.WithinDuration(t, time.Now().Add(time.Hour), issued.NotAfter, time.Minute)
+
+	client, err := NewITlsRpcClient(pki.caCert, r.cfg.CertPath, r.cfg.KeyPath, addr, "worker-1")
+	require.NoError(t, err)
+	defer client.CloseClient()
+	require.Equal(t, 42, callAdd(t, client))
+
+	// Tokens are single use.
+	again := newTestRenewer(t, pki, addr, RenewerConfig{CommonName: "worker-2.svc", BootstrapToken: "enrol-worker"})
+	require.ErrorIs(t, again.Renew(), ErrIssuanceDenied)
+}
+
+func TestCertificateAuthorityEnforcesNamingPolicy(t *testing.T) {
+	pki := newTestPKI(t)
+	addr := startCAServer(t, pki, IssuancePolicy{
+		AllowedNames:    []string{"*.svc"},
+		BootstrapTokens: map[string]string{"any": "*"},
+	})
+
+	r := newTestRenewer(t, pki, addr, RenewerConfig{CommonName: "laptop.corp", BootstrapToken: "any"})
+	err := r.Renew()
+	require.ErrorIs(t, err, ErrIssuanceDenied)
+	require.Contains(t, err.Error(), `name "laptop.corp" is not allowed`)
+}
+
+func TestCertificateAuthorityRequiresCSR(t *testing.T) {
+	pki := newTestPKI(t)
+	ca, err := NewCertificateAuthority(pki.caCert, pki.caKeyPath, IssuancePolicy{})
+	require.NoError(t, err)
+	ca.SetLogger(newTestLogger(&bytes.Buffer{}, &bytes.Buffer{}, LogLevelDebug))
+
+	_, err = ca.Issue(IssuanceRequest{Token: "anything"})
+	require.ErrorIs(t, err, ErrIssuanceDenied)
+}
+
+func TestCertificateAuthorityRenewsOwnName(t *testing.T) {
+	pki := newTestPKI(t)
+	addr := startCAServer(t, pki, IssuancePolicy{})
+
+	certPath, keyPath := copyClientCert(t, pki)
+	original := leaf(t, certPath)
+
+	var renewedCert tls.Certificate
+	r := newTestRenewer(t, pki, addr, RenewerConfig{
+		CertPath:    certPath,
+		KeyPath:     keyPath,
+		CommonName:  "test-client",
+		RenewBefore: 48 * time.Hour,
+		OnRenew:     func(cert tls.Certificate) { renewedCert = cert },
+	})
+	renewed, err := r.RenewIfNeeded()
+	require.NoError(t, err)
+	require.True(t, renewed)
+	require.NotEmpty(t, renewedCert.Certificate)
+
+	issued := leaf(t, certPath)
+	require.Equal(t, "test-client", issued.Subject.CommonName)
+	require.NotEqual(t, original.SerialNumber, issued.SerialNumber)
+	require.Equal(t, []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}, issued.ExtKeyUsage)
+
+	r.cfg.CommonName = "someone-else"
+	require.ErrorIs(t, r.Renew(), ErrIssuanceDenied)
+}
+
+func TestCertificateAuthorityRenewalCannotAddNames(t *testing.T) {
+	pki := newTestPKI(t)
+	addr := startCAServer(t, pki, IssuancePolicy{})
+	certPath, keyPath := copyClientCert(t, pki)
+	cfg := RenewerConfig{CertPath: certPath, KeyPath: keyPath, CommonName: "test-client"}
+
+	cfg.DNSNames = []string{"api.example.com"}
+	err := newTestRenewer(t, pki, addr, cfg).Renew()
+	require.ErrorIs(t, err, ErrIssuanceDenied)
+	require.Contains(t, err.Error(), `"api.example.com"`)
+
+	cfg.DNSNames = nil
+	cfg.URIs = []*url.URL{{Scheme: "spiffe", Host: "example.org", Path: "/admin"}}
+	err = newTestRenewer(t, pki, addr, cfg).Renew()
+	require.ErrorIs(t, err, ErrIssuanceDenied)
+	require.Contains(t, err.Error(), `"spiffe://example.org/admin"`)
+
+}
+
+func TestCertificateAuthorityAllowedNamesDoNotGrantNames(t *testing.T) {
+	pki := newTestPKI(t)
+	addr := startCAServer(t, pki, IssuancePolicy{
+		AllowedNames: []string{"api", "*.svc", "spiffe://corp/*"},
+		ServerAuth:   true,
+	})
+	own, err := url.Parse("spiffe://corp/api")
+	require.NoError(t, err)
+	certPath, keyPath := pki.issue(t, "api", &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "api"},
+		DNSNames:    []string{"api.svc"},
+		URIs:        []*url.URL{own},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	cfg := RenewerConfig{CertPath: certPath, KeyPath: keyPath, CommonName: "api", DNSNames: []string{"api.svc"}, URIs: []*url.URL{own}}
+
+	// Names matching AllowedNames but missing from the current certificate
+	// belong to other workloads.
+	foreign := cfg
+	foreign.URIs = []*url.URL{own, {Scheme: "spiffe", Host: "corp", Path: "/admin"}}
+	err = newTestRenewer(t, pki, addr, foreign).Renew()
+	require.ErrorIs(t, err, ErrIssuanceDenied)
+	require.Contains(t, err.Error(), `"spiffe://corp/admin"`)
+	foreign = cfg
+	foreign.DNSNames = []string{"api.svc", "billing.svc"}
+	require.ErrorIs(t, newTestRenewer(t, pki, addr, foreign).Renew(), ErrIssuanceDenied)
+
+	require.NoError(t, newTestRenewer(t, pki, addr, cfg).Renew())
+	issued := leaf(t, certPath)
+	require.Equal(t, []string{"api.svc"}, issued.DNSNames)
+	require.Equal(t, "spiffe://corp/api", issued.URIs[0].String())
+	require.Contains(t, issued.ExtKeyUsage, x509.ExtKeyUsageServerAuth)
+}
+
+// copyClientCert copies the test client certificate and key into a
+// temporary directory, so that renewals can replace them.
+func copyClientCert(t *testing.T, pki *testPKI) (certPath, keyPath string) {
+	t.Helper()
+
+	dir := t.TempDir()
+	certPath, keyPath = filepath.Join(dir, "client.crt"), filepath.Join(dir, "client.key")
+	for src, dst := range map[string]string{pki.clientCert: certPath, pki.clientKey: keyPath} {
+		data, err := os.ReadFile(src)
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(dst, data, 0o600))
+	}
+	return certPath, keyPath
+}
+
+func TestRenewerRunWithRenewBeforeBeyondLifetime(t *testing.T) {
+	pki := newTestPKI(t)
+	addr := startCAServer(t, pki, IssuancePolicy{Validity: time.Hour})
+	certPath, keyPath := copyClientCert(t, pki)
+
+	var renewals atomic.Int32
+	r := newTestRenewer(t, pki, addr, RenewerConfig{
+		CertPath:      certPath,
+		KeyPath:       keyPath,
+		CommonName:    "test-client",
+		RenewBefore:   48 * time.Hour,
+		RetryInterval: 10 * time.Millisecond,
+		OnRenew:       func(tls.Certificate) { renewals.Add(1) },
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	require.ErrorIs(t, r.Run(ctx), context.DeadlineExceeded)
+	require.Equal(t, int32(1), renewals.Load())
+}
+
+func TestRenewerRunStopsWithContext(t *testing.T) {
+	pki := newTestPKI(t)
+	addr := startCAServer(t, pki, IssuancePolicy{BootstrapTokens: map[string]string{"t": "*"}})
+
+	r := newTestRenewer(t, pki, addr, RenewerConfig{CommonName: "svc", BootstrapToken: "t"})
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- r.Run(ctx) }()
+
+	require.Eventually(t, func() bool {
+		_, err := r.current()
+		return err == nil
+	}, 2*time.Second, 10*time.Millisecond)
+	cancel()
+	require.True(t, errors.Is(<-done, context.Canceled))
+}
+
+func TestRenewerFinishesInterruptedStore(t *testing.T) {
+	pki := newTestPKI(t)
+	renewedCert, renewedKey := pki.issue(t, "renewed", &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "test-client"},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	copyFile := func(src, dst string) {
+		data, err := os.ReadFile(src)
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(dst, data, 0o600))
+	}
+	serial := func(r *CertificateRenewer) string {
+		cert, err := r.current()
+		require.NoError(t, err)
+		_, err = os.Stat(r.cfg.CertPath + pendingSuffix)
+		require.ErrorIs(t, err, os.ErrNotExist)
+		_, err = os.Stat(r.cfg.KeyPath + pendingSuffix)
+		require.ErrorIs(t, err, os.ErrNotExist)
+		return cert.SerialNumber.String()
+	}
+	oldSerial, newSerial := leaf(t, pki.clientCert).SerialNumber.String(), leaf(t, renewedCert).SerialNumber.String()
+
+	for _, tc := range []struct {
+		name  string
+		crash func(certPath, keyPath string)
+		want  string
+	}{
+		{"after moving the key", func(certPath, keyPath string) {
+			copyFile(renewedKey, keyPath)
+			copyFile(renewedCert, certPath+pendingSuffix)
+		}, newSerial},
+		{"before moving either file", func(certPath, keyPath string) {
+			copyFile(renewedKey, keyPath+pendingSuffix)
+			copyFile(renewedCert, certPath+pendingSuffix)
+		}, newSerial},
+		{"before writing the certificate", func(certPath, keyPath string) {
+			copyFile(renewedKey, keyPath+pendingSuffix)
+		}, oldSerial},
+		{"with a mismatched certificate", func(certPath, keyPath string) {
+			copyFile(renewedCert, certPath+pendingSuffix)
+		}, oldSerial},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			certPath, keyPath := copyClientCert(t, pki)
+			tc.crash(certPath, keyPath)
+			r := newTestRenewer(t, pki, "", RenewerConfig{CertPath: certPath, KeyPath: keyPath})
+			require.Equal(t, tc.want, serial(r))
+		})
+	}
+}
+
+func TestUnauthenticatedClientsOnlyReachListedMethods(t *testing.T) {
+	pki := newTestPKI(t)
+	addr := startCAServer(t, pki, IssuancePolicy{})
+
+	client, err := NewITlsRpcClient(pki.caCert, "", "", addr, "anonymous")
+	require.NoError(t, err)
+	client.SetLogger(newTestLogger(&bytes.Buffer{}, &bytes.Buffer{}, LogLevelDebug))
+	defer client.CloseClient()
+
+	_, err = client.ConnectToRpcServerTls("TestService.Add", []byte(`{"A":1,"B":2}`))
+	require.ErrorIs(t, err, ErrUnauthenticated)
+
+	_, err = client.ConnectToRpcServerTls(CASignMethod, []byte(`{}`))
+	require.Error(t, err)
+	require.False(t, errors.Is(err, ErrUnauthenticated))
+}
@@ -0,0 +1,486 @@
+package swissknife
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/gob"
+	"errors"
+	"io"
+	"net"
+	"net/rpc"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// requestHeader precedes every request body on the wire. Its field names
+// match rpc.Request so that plain net/rpc gob clients remain compatible.
+type requestHeader struct {
+	ServiceMethod string
+	Seq           uint64
+
+	// Timeout is how much longer the caller waits for the reply, or zero
+	// when it has no deadline. Token is the caller's bearer token, and
+	// IdempotencyKey identifies retries of the same call, if any. net/rpc
+	// ignores these extra fields.
+	Timeout        time.Duration
+	Token          string
+	IdempotencyKey string
+}
+
+// responseHeader precedes every response body on the wire. Its field names
+// match rpc.Response for the same reason as requestHeader.
+type responseHeader struct {
+	ServiceMethod string
+	Seq           uint64
+	Error         string
+}
+
+// serverRequest is a decoded request read from a connection. On a
+// bidirectional connection it may instead be the response to a call made
+// by the server, in which case response is set and args holds the reply.
+type serverRequest struct {
+	header   requestHeader
+	args     []byte
+	response *responseHeader
+
+	// deadline is when the caller stops waiting, derived from
+	// header.Timeout as the request arrived.
+	deadline time.Time
+
+	// principal is set by admit when the call carried a valid token.
+	principal *Principal
+}
+
+// countingReader counts the bytes read through it in n and, when set, in
+// the total metric.
+type countingReader struct {
+	r     io.Reader
+	n     *atomic.Int64
+	total *Counter
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	if c.n != nil {
+		c.n.Add(int64(n))
+	}
+	if c.total != nil && n > 0 {
+		c.total.Add(float64(n))
+	}
+	return n, err
+}
+
+// countingWriter counts the bytes written through it in n and, when set, in
+// the total metric.
+type countingWriter struct {
+	w     io.Writer
+	n     *atomic.Int64
+	total *Counter
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	if c.n != nil {
+		c.n.Add(int64(n))
+	}
+	if c.total != nil && n > 0 {
+		c.total.Add(float64(n))
+	}
+	return n, err
+}
+
+// meteredReader sits between the connection and the gob decoder. It parses
+// the length prefix of every gob message before the decoder sees it, so a
+// frame larger than the limit is refused before any buffer is allocated for
+// it. It implements io.ByteReader to stop gob from adding its own buffering.
+type meteredReader struct {
+	r       *bufio.Reader
+	limit   int64
+	tooBig  error
+	frame   int64
+	msgLeft int64
+	err     error
+}
+
+func newMeteredReader(r io.Reader, limit int64, tooBig error) *meteredReader {
+	return &meteredReader{
+		r:      bufio.NewReader(r),
+		limit:  limit,
+		tooBig: tooBig,
+	}
+}
+
+// startFrame resets the per-frame byte budget.
+func (m *meteredReader) startFrame() {
+	m.frame = 0
+}
+
+// awaitFrame blocks until the first byte of the next frame is available. A
+// read deadline that expires here leaves the stream intact, so callers can
+// use it to wake up periodically while the connection is quiet.
+func (m *meteredReader) awaitFrame() error {
+	if m.err != nil {
+		return m.err
+	}
+	_, err := m.r.Peek(1)
+	return err
+}
+
+func (m *meteredReader) Read(p []byte) (int, error) {
+	if m.err != nil {
+		return 0, m.err
+	}
+	if m.msgLeft == 0 {
+		if err := m.nextMessage(); err != nil {
+			m.err = err
+			return 0, err
+		}
+	}
+	if int64(len(p)) > m.msgLeft {
+		p = p[:m.msgLeft]
+	}
+	n, err := m.r.Read(p)
+	m.msgLeft -= int64(n)
+	m.frame += int64(n)
+	if err != nil {
+		m.err = err
+	}
+	return n, err
+}
+
+func (m *meteredReader) ReadByte() (byte, error) {
+	var b [1]byte
+	if _, err := io.ReadFull(m, b[:]); err != nil {
+		return 0, err
+	}
+	return b[0], nil
+}
+
+// nextMessage peeks at the gob length prefix of the next message and checks
+// it against the remaining frame budget.
+func (m *meteredReader) nextMessage() error {
+	prefix, err := m.r.Peek(1)
+	if err != nil {
+		return err
+	}
+
+	width := int64(1)
+	size := uint64(prefix[0])
+	if prefix[0] >= 0x80 {
+		n := -int64(int8(prefix[0]))
+		if n < 1 || n > 8 {
+			return errors.New("rpc: invalid message length prefix")
+		}
+		width += n
+		if prefix, err = m.r.Peek(int(width)); err != nil {
+			return err
+		}
+		size = 0
+		for _, b := range prefix[1:] {
+			size = size<<8 | uint64(b)
+		}
+	}
+
+	if size > maxMessageLength {
+		return errors.New("rpc: invalid message length prefix")
+	}
+	if m.limit > 0 && (size > uint64(m.limit) || m.frame+width+int64(size) > m.limit) {
+		return m.tooBig
+	}
+	m.msgLeft = width + int64(size)
+	return nil
+}
+
+// maxMessageLength bounds length prefixes so that byte accounting cannot
+// overflow; gob itself refuses messages far smaller than this.
+const maxMessageLength = 1 << 40
+
+// serverCodec reads requests from and writes responses to a single server
+// connection. Writes are serialised so concurrent calls can reply in any
+// order.
+type serverCodec struct {
+	conn     net.Conn
+	reader   *meteredReader
+	dec      *gob.Decoder
+	buf      *bufio.Writer
+	enc      *gob.Encoder
+	wmu      sync.Mutex
+	timeouts Timeouts
+
+	// bidi is set on bidirectional connections, whose messages are preceded
+	// by a frameKind.
+	bidi bool
+
+	bytesRead    atomic.Int64
+	bytesWritten atomic.Int64
+}
+
+// newServerCodec returns a codec for conn. The received and sent counters,
+// which may be nil, are kept in step with the connection's own byte counts.
+func newServerCodec(conn net.Conn, maxRequestSize int64, timeouts Timeouts, received, sent *Counter) *serverCodec {
+	c := &serverCodec{conn: conn, timeouts: timeouts}
+	c.reader = newMeteredReader(&countingReader{r: conn, n: &c.bytesRead, total: received}, maxRequestSize, ErrRequestTooLarge)
+	c.buf = bufio.NewWriter(&countingWriter{w: conn, n: &c.bytesWritten, total: sent})
+	c.dec = gob.NewDecoder(c.reader)
+	c.enc = gob.NewEncoder(c.buf)
+	return c
+}
+
+// readRequest decodes the next request, which must finish arriving within
+// ReadTimeout. When the header was decoded but the body was not, the partial
+// request is returned alongside the error so the caller can answer it before
+// closing the connection.
+func (c *serverCodec) readRequest() (*serverRequest, error) {
+	c.conn.SetReadDeadline(deadline(c.timeouts.ReadTimeout))
+	c.reader.startFrame()
+
+	if c.bidi {
+		var kind frameKind
+		if err := c.dec.Decode(&kind); err != nil {
+			return nil, err
+		}
+		if kind == frameResponse {
+			return c.readResponse()
+		}
+	}
+
+	req := &serverRequest{}
+	if err := c.dec.Decode(&req.header); err != nil {
+		return nil, err
+	}
+	req.deadline = deadline(req.header.Timeout)
+	if err := c.dec.Decode(&req.args); err != nil {
+		return req, err
+	}
+	return req, nil
+}
+
+// readResponse decodes the response to a call made by the server. A body
+// that does not decode leaves nobody to answer, so it is returned as a
+// failure of the stream.
+func (c *serverCodec) readResponse() (*serverRequest, error) {
+	req := &serverRequest{response: &responseHeader{}}
+	if err := c.dec.Decode(req.response); err != nil {
+		return nil, err
+	}
+	if err := c.dec.Decode(&req.args); err != nil {
+		return nil, err
+	}
+	req.header = requestHeader{ServiceMethod: req.response.ServiceMethod, Seq: req.response.Seq}
+	return req, nil
+}
+
+// broken reports whether the underlying stream failed, after which no further
+// requests can be read.
+func (c *serverCodec) broken() bool {
+	return c.reader.err != nil
+}
+
+func (c *serverCodec) writeResponse(header *responseHeader, reply []byte) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	c.conn.SetWriteDeadline(deadline(c.timeouts.WriteTimeout))
+	if c.bidi {
+		if err := c.enc.Encode(frameResponse); err != nil {
+			return err
+		}
+	}
+	if err := c.enc.Encode(header); err != nil {
+		return err
+	}
+	if err := c.enc.Encode(reply); err != nil {
+		return err
+	}
+	return c.buf.Flush()
+}
+
+// writeRequest sends a call to the client of a bidirectional connection.
+func (c *serverCodec) writeRequest(header *requestHeader, args []byte) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	c.conn.SetWriteDeadline(deadline(c.timeouts.WriteTimeout))
+	if err := c.enc.Encode(frameRequest); err != nil {
+		return err
+	}
+	if err := c.enc.Encode(header); err != nil {
+		return err
+	}
+	if err := c.enc.Encode(args); err != nil {
+		return err
+	}
+	return c.buf.Flush()
+}
+
+// refuse answers the next request with err instead of serving it, waiting at
+// most timeout for the request to arrive.
+func (c *serverCodec) refuse(err error, timeout time.Duration) error {
+	c.conn.SetDeadline(time.Now().Add(timeout))
+	c.timeouts = Timeouts{ReadTimeout: timeout, WriteTimeout: timeout}
+	if tlsConn, ok := c.conn.(*tls.Conn); ok {
+		if err := tlsConn.Handshake(); err != nil {
+			return err
+		}
+		c.bidi = tlsConn.ConnectionState().NegotiatedProtocol == bidiProtocol
+	}
+
+	req, readErr := c.readRequest()
+	if req == nil {
+		return readErr
+	}
+	return c.writeResponse(&responseHeader{
+		ServiceMethod: req.header.ServiceMethod,
+		Seq:           req.header.Seq,
+		Error:         err.Error(),
+	}, nil)
+}
+
+// clientCodec is the rpc.ClientCodec used by tlsRpcClient. It speaks the same
+// wire format as serverCodec and applies the client's read and write
+// timeouts. rpc.Client serialises requests and runs a single reader; writes
+// are locked because on a bidirectional connection the codec also answers
+// calls from the server.
+type clientCodec struct {
+	conn     net.Conn
+	reader   *meteredReader
+	dec      *gob.Decoder
+	buf      *bufio.Writer
+	enc      *gob.Encoder
+	wmu      sync.Mutex
+	timeouts Timeouts
+
+	// services answer calls from the server when the connection is
+	// bidirectional, and is nil otherwise.
+	services *rpc.Server
+	info     ConnInfo
+	logger   func() Logger
+}
+
+// newClientCodec returns a codec for conn, counting traffic in the received
+// and sent counters when they are not nil.
+func newClientCodec(conn net.Conn, timeouts Timeouts, received, sent *Counter) *clientCodec {
+	reader := newMeteredReader(&countingReader{r: conn, total: received}, 0, nil)
+	buf := bufio.NewWriter(&countingWriter{w: conn, total: sent})
+	return &clientCodec{
+		conn:     conn,
+		reader:   reader,
+		dec:      gob.NewDecoder(reader),
+		buf:      buf,
+		enc:      gob.NewEncoder(buf),
+		timeouts: timeouts,
+	}
+}
+
+// serveCalls makes the codec answer calls from the server with services, on
+// a connection that negotiated bidirectional mode.
+func (c *clientCodec) serveCalls(services *rpc.Server, info ConnInfo, logger func() Logger) {
+	c.services = services
+	c.info = info
+	c.logger = logger
+}
+
+func (c *clientCodec) WriteRequest(r *rpc.Request, body any) error {
+	header := &requestHeader{ServiceMethod: r.ServiceMethod, Seq: r.Seq}
+	if call, ok := body.(*callArgs); ok {
+		header.Timeout = call.timeout
+		header.Token = call.token
+		header.IdempotencyKey = call.idempotencyKey
+		body = call.args
+	}
+	return c.write(frameRequest, header, body)
+}
+
+// write sends a message, preceded by its kind on bidirectional connections.
+func (c *clientCodec) write(kind frameKind, header, body any) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	c.conn.SetWriteDeadline(deadline(c.timeouts.WriteTimeout))
+	if c.services != nil {
+		if err := c.enc.Encode(kind); err != nil {
+			return err
+		}
+	}
+	if err := c.enc.Encode(header); err != nil {
+		return err
+	}
+	if err := c.enc.Encode(body); err != nil {
+		return err
+	}
+	return c.buf.Flush()
+}
+
+// ReadResponseHeader waits without a deadline for the next response; a dead
+// server is detected by the client's heartbeat instead. Calls from the
+// server arriving in the meantime are started on their own goroutines.
+func (c *clientCodec) ReadResponseHeader(r *rpc.Response) error {
+	for {
+		c.conn.SetReadDeadline(time.Time{})
+		if err := c.reader.awaitFrame(); err != nil {
+			return err
+		}
+		c.conn.SetReadDeadline(deadline(c.timeouts.ReadTimeout))
+		c.reader.startFrame()
+
+		if c.services != nil {
+			var kind frameKind
+			if err := c.dec.Decode(&kind); err != nil {
+				return err
+			}
+			if kind == frameRequest {
+				if err := c.readCall(); err != nil {
+					return err
+				}
+				continue
+			}
+		}
+
+		var header responseHeader
+		if err := c.dec.Decode(&header); err != nil {
+			return err
+		}
+		r.ServiceMethod = header.ServiceMethod
+		r.Seq = header.Seq
+		r.Error = header.Error
+		return nil
+	}
+}
+
+// readCall reads a call from the server and runs it.
+func (c *clientCodec) readCall() error {
+	var header requestHeader
+	if err := c.dec.Decode(&header); err != nil {
+		return err
+	}
+	var args []byte
+	if err := c.dec.Decode(&args); err != nil {
+		return err
+	}
+
+	callDeadline := deadline(header.Timeout)
+	go func() {
+		ctx, cancel := deadlineContext(context.Background(), callDeadline)
+		defer cancel()
+		reply, err := invokeService(c.services, c.logger(), header.ServiceMethod, &Request{Args: args, Conn: c.info, ctx: ctx})
+		response := &responseHeader{ServiceMethod: header.ServiceMethod, Seq: header.Seq}
+		if err != nil {
+			response.Error = err.Error()
+		}
+		if err := c.write(frameResponse, response, reply); err != nil {
+			c.logger().Errorf("Failed to answer call %s from server: %v", header.ServiceMethod, err)
+			c.conn.Close()
+		}
+	}()
+	return nil
+}
+
+func (c *clientCodec) ReadResponseBody(body any) error {
+	return c.dec.Decode(body)
+}
+
+func (c *clientCodec) Close() error {
+	return c.conn.Close()
+}
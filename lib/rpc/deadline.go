@@ -0,0 +1,32 @@
+package swissknife
+
+import (
+	"context"
+	"time"
+)
+
+// callTimeout returns how long a call made with ctx may take, zero when ctx
+// has no deadline, or ctx's error when it is already done.
+func callTimeout(ctx context.Context) (time.Duration, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	d, ok := ctx.Deadline()
+	if !ok {
+		return 0, nil
+	}
+	timeout := time.Until(d)
+	if timeout <= 0 {
+		return 0, context.DeadlineExceeded
+	}
+	return timeout, nil
+}
+
+// deadlineContext derives the context a handler runs with from parent,
+// expiring at deadline unless it is zero.
+func deadlineContext(parent context.Context, deadline time.Time) (context.Context, context.CancelFunc) {
+	if deadline.IsZero() {
+		return context.WithCancel(parent)
+	}
+	return context.WithDeadline(parent, deadline)
+}
@@ -0,0 +1,120 @@
+package swissknife
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// WaitingService holds calls until their context is done and reports why.
+type WaitingService struct {
+	started chan struct{}
+	ended   chan error
+}
+
+func newWaitingService() *WaitingService {
+	return &WaitingService{started: make(chan struct{}, 1), ended: make(chan error, 1)}
+}
+
+func (s *WaitingService) Wait(req *Request, reply *[]byte) error {
+	s.started <- struct{}{}
+	select {
+	case <-req.Context().Done():
+		s.ended <- req.Context().Err()
+		return req.Context().Err()
+	case <-time.After(5 * time.Second):
+		s.ended <- nil
+		return nil
+	}
+}
+
+func (s *WaitingService) Deadline(req *Request, reply *[]byte) error {
+	if _, ok := req.Context().Deadline(); ok {
+		*reply = []byte("deadline")
+	}
+	return nil
+}
+
+// result returns how the handler of the blocked call finished.
+func (s *WaitingService) result(t *testing.T) error {
+	t.Helper()
+
+	select {
+	case err := <-s.ended:
+		return err
+	case <-time.After(2 * time.Second):
+		t.Fatal("handler was not cancelled")
+		return nil
+	}
+}
+
+func TestDeadlineCancelsHandler(t *testing.T) {
+	pki := newTestPKI(t)
+	s, addr := startTestServer(t, pki)
+	waiting := newWaitingService()
+	require.NoError(t, s.RegisterMethod("Waiting", waiting))
+	client := newTestClient(t, pki, addr)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	started := time.Now()
+	_, err := client.ConnectToRpcServerTlsContext(ctx, "Waiting.Wait", nil)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	require.Less(t, time.Since(started), time.Second)
+	require.ErrorIs(t, waiting.result(t), context.DeadlineExceeded)
+
+	// The connection stays usable after an abandoned call.
+	require.Equal(t, 42, callAdd(t, client))
+}
+
+func TestHandlerSeesCallerDeadline(t *testing.T) {
+	pki := newTestPKI(t)
+	s, addr := startTestServer(t, pki)
+	require.NoError(t, s.RegisterMethod("Waiting", newWaitingService()))
+	client := newTestClient(t, pki, addr)
+
+	reply, err := client.ConnectToRpcServerTls("Waiting.Deadline", nil)
+	require.NoError(t, err)
+	require.Empty(t, reply)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	reply, err = client.ConnectToRpcServerTlsContext(ctx, "Waiting.Deadline", nil)
+	require.NoError(t, err)
+	require.Equal(t, "deadline", string(reply))
+
+	cancel()
+	_, err = client.ConnectToRpcServerTlsContext(ctx, "Waiting.Deadline", nil)
+	require.ErrorIs(t, err, context.Canceled)
+}
+
+func TestDisconnectCancelsHandler(t *testing.T) {
+	pki := newTestPKI(t)
+	s, addr := startTestServer(t, pki)
+	waiting := newWaitingService()
+	require.NoError(t, s.RegisterMethod("Waiting", waiting))
+	client := newTestClient(t, pki, addr)
+
+	go client.ConnectToRpcServerTls("Waiting.Wait", nil)
+	<-waiting.started
+	client.CloseClient()
+	require.ErrorIs(t, waiting.result(t), context.Canceled)
+}
+
+func TestPeerCallPropagatesDeadline(t *testing.T) {
+	pki := newTestPKI(t)
+	peers := make(chan *Peer, 1)
+	_, addr := startTestServer(t, pki, WithBidirectional(), peerHooks(peers))
+
+	waiting := newWaitingService()
+	newTestClient(t, pki, addr, WithClientService("Waiting", waiting))
+	peer := <-peers
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_, err := peer.CallContext(ctx, "Waiting.Wait", nil)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	require.ErrorIs(t, waiting.result(t), context.DeadlineExceeded)
+}
@@ -0,0 +1,50 @@
+package swissknife
+
+import (
+	"errors"
+	"fmt"
+	"net/rpc"
+	"strings"
+)
+
+// wireErrors lists the sentinel errors a server may send back to a client.
+// Errors cross the connection as plain strings, so the client matches them
+// here to make them usable with errors.Is.
+var wireErrors = []error{
+	ErrRequestTooLarge,
+	ErrResponseTooLarge,
+	ErrTooManyCalls,
+	ErrTooManyConnections,
+	ErrConnectionRejected,
+	ErrUnauthenticated,
+	ErrIssuanceDenied,
+	ErrPermissionDenied,
+	ErrBatchTooLarge,
+	ErrBatchSkipped,
+	ErrInvalidToken,
+	ErrIdempotencyKeyReused,
+}
+
+// remoteError converts an rpc.ServerError carrying one of the wireErrors back
+// into that sentinel, and a resource exhausted message back into a
+// *ResourceExhaustedError. A sentinel followed by ": " and details is
+// wrapped so that the details are kept. Any other error is returned
+// unchanged.
+func remoteError(err error) error {
+	var serverErr rpc.ServerError
+	if !errors.As(err, &serverErr) {
+		return err
+	}
+	if exhausted, ok := parseResourceExhausted(string(serverErr)); ok {
+		return exhausted
+	}
+	for _, wireErr := range wireErrors {
+		if string(serverErr) == wireErr.Error() {
+			return wireErr
+		}
+		if detail, ok := strings.CutPrefix(string(serverErr), wireErr.Error()+": "); ok {
+			return fmt.Errorf("%w: %s", wireErr, detail)
+		}
+	}
+	return err
+}
@@ -0,0 +1,179 @@
+package swissknife
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ErrCertificateExpired is returned by the constructors when
+// ExpiryMonitorConfig.RefuseExpired is set and a loaded certificate has
+// expired.
+var ErrCertificateExpired = errors.New("rpc: certificate expired")
+
+// DefaultExpiryThresholds are the warning thresholds used when
+// ExpiryMonitorConfig.Thresholds is empty.
+var DefaultExpiryThresholds = []time.Duration{30 * 24 * time.Hour, 7 * 24 * time.Hour, 24 * time.Hour}
+
+// ExpiryMonitorConfig configures the certificate expiry monitor, which
+// inspects the loaded certificate chain and the trusted CA certificates.
+type ExpiryMonitorConfig struct {
+	// Thresholds are the durations before NotAfter at which a warning is
+	// logged. Each threshold is reported once per certificate; expiry itself
+	// is logged as an error.
+	Thresholds []time.Duration
+
+	// CheckInterval is how often certificates are checked after the first
+	// check at construction. Zero only checks at construction.
+	CheckInterval time.Duration
+
+	// RefuseExpired fails construction when a certificate has already
+	// expired, instead of only logging it.
+	RefuseExpired bool
+}
+
+// WithCertExpiryMonitor monitors the expiry of the server certificate and
+// the CA certificates at capath. With WithMetrics the days left are also
+// exported as swissknife_rpc_server_cert_expiry_days.
+func WithCertExpiryMonitor(cfg ExpiryMonitorConfig) ServerOption {
+	return func(s *tlsRpcServer) {
+		s.expiryConfig = &cfg
+	}
+}
+
+// WithClientCertExpiryMonitor monitors the expiry of the client certificate
+// and the CA certificates at caCrtPath. With WithClientMetrics the days left
+// are also exported as swissknife_rpc_client_cert_expiry_days.
+func WithClientCertExpiryMonitor(cfg ExpiryMonitorConfig) ClientOption {
+	return func(c *tlsRpcClient) {
+		c.expiryConfig = &cfg
+	}
+}
+
+// monitoredCert is a certificate watched by an expiryMonitor.
+type monitoredCert struct {
+	kind string
+	cert *x509.Certificate
+
+	// reported is the smallest threshold already logged, or zero.
+	reported time.Duration
+	expired  bool
+}
+
+// expiryMonitor logs and exports how long the certificates of a client or
+// server have left.
+type expiryMonitor struct {
+	thresholds []time.Duration
+	interval   time.Duration
+	logger     func() Logger
+	days       *GaugeVec
+	now        func() time.Time
+
+	mu    sync.Mutex
+	certs []*monitoredCert
+}
+
+// newExpiryMonitor collects the certificates of chain and cas and checks
+// them once. days may be nil when metrics are disabled.
+func newExpiryMonitor(cfg ExpiryMonitorConfig, chain tls.Certificate, cas []*x509.Certificate, logger func() Logger, days *GaugeVec) (*expiryMonitor, error) {
+	thresholds := append([]time.Duration(nil), cfg.Thresholds...)
+	if len(thresholds) == 0 {
+		thresholds = append(thresholds, DefaultExpiryThresholds...)
+	}
+	sort.Slice(thresholds, func(i, j int) bool { return thresholds[i] > thresholds[j] })
+
+	m := &expiryMonitor{
+		thresholds: thresholds,
+		interval:   cfg.CheckInterval,
+		logger:     logger,
+		days:       days,
+		now:        time.Now,
+	}
+	for i, der := range chain.Certificate {
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse certificate: %w", err)
+		}
+		kind := "intermediate"
+		if i == 0 {
+			kind = "leaf"
+		}
+		m.certs = append(m.certs, &monitoredCert{kind: kind, cert: cert})
+	}
+	for _, cert := range cas {
+		m.certs = append(m.certs, &monitoredCert{kind: "ca", cert: cert})
+	}
+
+	if cfg.RefuseExpired {
+		now := m.now()
+		for _, mc := range m.certs {
+			if now.After(mc.cert.NotAfter) {
+				return nil, fmt.Errorf("%w: %s certificate %s expired on %s", ErrCertificateExpired, mc.kind, mc.cert.Subject, mc.cert.NotAfter.Format(time.RFC3339))
+			}
+		}
+	}
+	m.check()
+	return m, nil
+}
+
+// check logs certificates that crossed a threshold since the last check and
+// updates the metric.
+func (m *expiryMonitor) check() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := m.now()
+	for _, mc := range m.certs {
+		left := mc.cert.NotAfter.Sub(now)
+		if m.days != nil {
+			m.days.With(mc.kind, mc.cert.Subject.String(), mc.cert.SerialNumber.String()).Set(left.Hours() / 24)
+		}
+
+		if left <= 0 {
+			if !mc.expired {
+				mc.expired = true
+				m.logger().Errorf("The %s certificate %s expired on %s", mc.kind, mc.cert.Subject, mc.cert.NotAfter.Format(time.RFC3339))
+			}
+			continue
+		}
+
+		threshold := m.crossed(left)
+		if threshold > 0 && (mc.reported == 0 || threshold < mc.reported) {
+			mc.reported = threshold
+			m.logger().Warnf("The %s certificate %s expires in %s, on %s", mc.kind, mc.cert.Subject, left.Round(time.Minute), mc.cert.NotAfter.Format(time.RFC3339))
+		}
+	}
+}
+
+// crossed returns the smallest threshold that left is within, or zero.
+func (m *expiryMonitor) crossed(left time.Duration) time.Duration {
+	var crossed time.Duration
+	for _, threshold := range m.thresholds {
+		if left <= threshold {
+			crossed = threshold
+		}
+	}
+	return crossed
+}
+
+// run checks the certificates every CheckInterval until done is closed.
+func (m *expiryMonitor) run(done <-chan struct{}) {
+	if m.interval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(m.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			m.check()
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package swissknife
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestExpiryMonitorWarnsOncePerThreshold(t *testing.T) {
+	pki := newTestPKI(t)
+	pair, err := tls.LoadX509KeyPair(pki.clientCert, pki.clientKey)
+	require.NoError(t, err)
+	var out, errOut bytes.Buffer
+	logger := newTestLogger(&out, &errOut, LogLevelDebug)
+
+	// The test certificates expire in a day, past the 30 day threshold.
+	m, err := newExpiryMonitor(ExpiryMonitorConfig{Thresholds: []time.Duration{time.Hour, 30 * 24 * time.Hour}}, pair, nil, func() Logger { return logger }, nil)
+	require.NoError(t, err)
+	require.Equal(t, 1, strings.Count(errOut.String(), "leaf certificate CN=test-client expires in"))
+
+	m.check()
+	require.Equal(t, 1, strings.Count(errOut.String(), "expires in"))
+
+	notAfter := leaf(t, pki.clientCert).NotAfter
+	m.now = func() time.Time { return notAfter.Add(-30 * time.Minute) }
+	m.check()
+	require.Equal(t, 2, strings.Count(errOut.String(), "expires in"))
+
+	m.now = func() time.Time { return notAfter.Add(time.Minute) }
+	m.check()
+	m.check()
+	require.Equal(t, 1, strings.Count(errOut.String(), "expired on"))
+}
+
+func TestExpiryMonitorRefusesExpiredCertificate(t *testing.T) {
+	pki := newTestPKI(t)
+	_, addr := startTestServer(t, pki)
+	certPath, keyPath := pki.issue(t, "expired", &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "expired-client"},
+		NotBefore:   time.Now().Add(-48 * time.Hour),
+		NotAfter:    time.Now().Add(-time.Hour),
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+
+	_, err := NewITlsRpcClient(pki.caCert, certPath, keyPath, addr, "expired", WithClientCertExpiryMonitor(ExpiryMonitorConfig{RefuseExpired: true}))
+	require.ErrorIs(t, err, ErrCertificateExpired)
+}
+
+func TestExpiryMonitorExportsDaysLeft(t *testing.T) {
+	pki := newTestPKI(t)
+	reg := NewMetricsRegistry()
+	startTestServer(t, pki, WithMetrics(reg), WithCertExpiryMonitor(ExpiryMonitorConfig{CheckInterval: time.Hour}))
+
+	ca := leaf(t, pki.caCert)
+	days := reg.Gauge("swissknife_rpc_server_cert_expiry_days", "", "kind", "subject", "serial").With("ca", ca.Subject.String(), ca.SerialNumber.String())
+	require.InDelta(t, 1, days.Value(), 0.01)
+
+	var buf bytes.Buffer
+	require.NoError(t, reg.WritePrometheus(&buf))
+	require.Contains(t, buf.String(), `swissknife_rpc_server_cert_expiry_days{kind="leaf",subject="CN=localhost"`)
+}
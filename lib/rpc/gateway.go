@@ -0,0 +1,199 @@
+package swissknife
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// HTTPGateway is an http.Handler that exposes the services registered on a
+// TLS RPC server as POST /Service.Method endpoints taking and returning
+// JSON. Calls go through the same authentication, authorization, rate
+// limits, logging and metrics as calls over the RPC protocol.
+type HTTPGateway struct {
+	server *tlsRpcServer
+}
+
+// NewHTTPGateway returns a gateway to the services of server, which must
+// have been created by one of the NewITlsRpcServer functions.
+func NewHTTPGateway(server ITlsRpcServer) (*HTTPGateway, error) {
+	s, ok := server.(*tlsRpcServer)
+	if !ok {
+		return nil, fmt.Errorf("HTTP gateway needs a server created by NewITlsRpcServer, got %T", server)
+	}
+	return &HTTPGateway{server: s}, nil
+}
+
+// TLSConfig returns a copy of the server's TLS configuration for the
+// http.Server serving the gateway, so that clients present certificates
+// verified against the same CAs.
+func (g *HTTPGateway) TLSConfig() *tls.Config {
+	config := g.server.tlsConfig.Clone()
+	config.NextProtos = []string{"h2", "http/1.1"}
+	return config
+}
+
+// gatewayError is the body of a failed gateway call.
+type gatewayError struct {
+	Error string `json:"error"`
+}
+
+// ServeHTTP calls the method named by the request path with the request
+// body as arguments and writes its reply. A bearer token in the
+// Authorization header is checked as it is for RPC calls, an
+// Idempotency-Key header is used as the call's idempotency key, and the
+// method's context is the request's.
+func (g *HTTPGateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s := g.server
+	method := strings.TrimPrefix(r.URL.Path, "/")
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeGatewayError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return
+	}
+	if method == batchMethod || method == heartbeatMethod {
+		writeGatewayError(w, http.StatusNotFound, fmt.Errorf("rpc: unknown method %s", method))
+		return
+	}
+
+	info := httpConnInfo(r)
+	sc := &serverConn{server: s, remote: r.RemoteAddr, info: info, identity: info.Identity()}
+	s.logger.Debugf("HTTP gateway call %s from %s (%s)", method, sc.remote, sc.identity)
+
+	args, err := readGatewayArgs(w, r, s.limits.MaxRequestSize)
+	if err != nil {
+		s.logger.Warnf("Rejecting HTTP gateway call %s from %s: %v", method, sc.remote, err)
+		s.metrics.callRejected(s.methodLabel(method), err)
+		writeGatewayError(w, gatewayStatus(err), err)
+		return
+	}
+
+	req := &serverRequest{
+		header: requestHeader{ServiceMethod: method, Token: bearerToken(r), IdempotencyKey: r.Header.Get("Idempotency-Key")},
+		args:   args,
+	}
+	if err := sc.admit(req); err != nil {
+		s.metrics.callRejected(s.methodLabel(method), err)
+		writeGatewayError(w, gatewayStatus(err), err)
+		return
+	}
+	if !s.registered(method) {
+		err := fmt.Errorf("rpc: unknown method %s", method)
+		s.metrics.callRejected(unknownMethod, err)
+		writeGatewayError(w, http.StatusNotFound, err)
+		return
+	}
+
+	reply, err := sc.call(r.Context(), req)
+	if err == nil && len(reply) > 0 && !json.Valid(reply) {
+		s.logger.Errorf("HTTP gateway call %s returned a reply that is not JSON", method)
+		err = fmt.Errorf("rpc: %s returned a reply that is not JSON", method)
+	}
+	if err != nil {
+		writeGatewayError(w, gatewayStatus(err), err)
+		return
+	}
+
+	if len(reply) == 0 {
+		reply = []byte("null")
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(reply)
+}
+
+// readGatewayArgs reads the JSON arguments in the request body, which may
+// be empty.
+func readGatewayArgs(w http.ResponseWriter, r *http.Request, limit int64) ([]byte, error) {
+	if limit <= 0 {
+		limit = math.MaxInt64
+	}
+	args, err := io.ReadAll(http.MaxBytesReader(w, r.Body, limit))
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			return nil, ErrRequestTooLarge
+		}
+		return nil, fmt.Errorf("rpc: cannot read request body: %w", err)
+	}
+	if len(args) > 0 && !json.Valid(args) {
+		return nil, errInvalidJSON
+	}
+	return args, nil
+}
+
+var errInvalidJSON = errors.New("rpc: request body is not valid JSON")
+
+// bearerToken returns the token in the Authorization header, if any.
+func bearerToken(r *http.Request) string {
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return ""
+	}
+	return strings.TrimSpace(token)
+}
+
+// httpConnInfo describes the connection r arrived on. Client certificates
+// count only when they were verified.
+func httpConnInfo(r *http.Request) ConnInfo {
+	info := ConnInfo{
+		RemoteAddr:  httpAddr(r.RemoteAddr),
+		ConnectedAt: time.Now(),
+	}
+	if local, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		info.LocalAddr = local
+	}
+	if r.TLS != nil {
+		info.setTLSState(*r.TLS)
+		if len(info.VerifiedChains) == 0 {
+			info.PeerCertificates = nil
+		}
+	}
+	return info
+}
+
+// httpAddr is the remote address of an HTTP request, which net/http only
+// keeps as a string.
+type httpAddr string
+
+func (a httpAddr) Network() string { return "tcp" }
+func (a httpAddr) String() string  { return string(a) }
+
+// gatewayStatus maps the error of a call to an HTTP status code.
+func gatewayStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrUnauthenticated), errors.Is(err, ErrInvalidToken):
+		return http.StatusUnauthorized
+	case errors.Is(err, ErrPermissionDenied):
+		return http.StatusForbidden
+	case errors.Is(err, ErrResourceExhausted), errors.Is(err, ErrTooManyCalls):
+		return http.StatusTooManyRequests
+	case errors.Is(err, ErrRequestTooLarge):
+		return http.StatusRequestEntityTooLarge
+	case errors.Is(err, errInvalidJSON):
+		return http.StatusBadRequest
+	case errors.Is(err, ErrIdempotencyKeyReused):
+		return http.StatusUnprocessableEntity
+	case errors.Is(err, context.DeadlineExceeded):
+		return http.StatusGatewayTimeout
+	}
+	return http.StatusInternalServerError
+}
+
+func writeGatewayError(w http.ResponseWriter, status int, err error) {
+	var exhausted *ResourceExhaustedError
+	if errors.As(err, &exhausted) && exhausted.RetryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(exhausted.RetryAfter.Seconds()))))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(gatewayError{Error: err.Error()})
+}
@@ -0,0 +1,142 @@
+package swissknife
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// startGateway serves an HTTP gateway to a test server created with opts.
+func startGateway(t *testing.T, pki *testPKI, opts ...ServerOption) (*tlsRpcServer, string) {
+	t.Helper()
+
+	s, _ := startTestServer(t, pki, opts...)
+	gateway, err := NewHTTPGateway(s)
+	require.NoError(t, err)
+
+	ts := httptest.NewUnstartedServer(gateway)
+	ts.TLS = gateway.TLSConfig()
+	ts.StartTLS()
+	t.Cleanup(ts.Close)
+	return s, ts.URL
+}
+
+// gatewayClient returns an HTTPS client trusting the test CA, presenting the
+// test client certificate when withCert is set.
+func gatewayClient(t *testing.T, pki *testPKI, withCert bool) *http.Client {
+	t.Helper()
+
+	caPEM, err := os.ReadFile(pki.caCert)
+	require.NoError(t, err)
+	roots := x509.NewCertPool()
+	require.True(t, roots.AppendCertsFromPEM(caPEM))
+
+	config := &tls.Config{RootCAs: roots}
+	if withCert {
+		cert, err := tls.LoadX509KeyPair(pki.clientCert, pki.clientKey)
+		require.NoError(t, err)
+		config.Certificates = []tls.Certificate{cert}
+	}
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: config}}
+	t.Cleanup(client.CloseIdleConnections)
+	return client
+}
+
+// post calls method through the gateway and returns the status and body.
+func post(t *testing.T, client *http.Client, url, method, body, token string) (int, string) {
+	t.Helper()
+
+	req, err := http.NewRequest(http.MethodPost, url+"/"+method, strings.NewReader(body))
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := client.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	return resp.StatusCode, string(data)
+}
+
+func TestHTTPGatewayCallsMethods(t *testing.T) {
+	pki := newTestPKI(t)
+	s, url := startGateway(t, pki)
+	require.NoError(t, s.RegisterMethod("Slow", new(SlowService)))
+	client := gatewayClient(t, pki, true)
+
+	status, body := post(t, client, url, "TestService.Add", `{"A": 2, "B": 3}`, "")
+	require.Equal(t, http.StatusOK, status)
+	var reply Reply
+	require.NoError(t, json.Unmarshal([]byte(body), &reply))
+	require.Equal(t, 5, reply.Sum)
+
+	status, body = post(t, client, url, "Slow.Fail", "", "")
+	require.Equal(t, http.StatusInternalServerError, status)
+	require.JSONEq(t, `{"error": "boom"}`, body)
+
+	status, _ = post(t, client, url, "TestService.Missing", "{}", "")
+	require.Equal(t, http.StatusNotFound, status)
+	status, _ = post(t, client, url, batchMethod, "{}", "")
+	require.Equal(t, http.StatusNotFound, status)
+	status, _ = post(t, client, url, "TestService.Add", "{not json", "")
+	require.Equal(t, http.StatusBadRequest, status)
+
+	resp, err := client.Get(url + "/TestService.Add")
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+}
+
+func TestHTTPGatewayAuthorization(t *testing.T) {
+	pki := newTestPKI(t)
+	_, url := startGateway(t, pki,
+		WithUnauthenticatedMethods("TestService.Add"),
+		WithTokenAuthentication(TokenValidatorFunc(func(token string, conn ConnInfo) (*Principal, error) {
+			if token != "secret" {
+				return nil, ErrInvalidToken
+			}
+			return &Principal{Subject: "alice"}, nil
+		})),
+		WithSPIFFEAuthorization(SPIFFERule{Methods: []string{"Admin.*"}, Allow: []string{"spiffe://example.org/admin"}}),
+	)
+	client := gatewayClient(t, pki, true)
+	anonymous := gatewayClient(t, pki, false)
+
+	status, _ := post(t, anonymous, url, "TestService.Add", "{}", "")
+	require.Equal(t, http.StatusOK, status)
+	status, _ = post(t, anonymous, url, "TestService.Missing", "{}", "secret")
+	require.Equal(t, http.StatusUnauthorized, status)
+
+	status, body := post(t, client, url, "TestService.Missing", "{}", "")
+	require.Equal(t, http.StatusUnauthorized, status)
+	require.Contains(t, body, ErrInvalidToken.Error())
+	status, _ = post(t, client, url, "Admin.Reset", "{}", "secret")
+	require.Equal(t, http.StatusForbidden, status)
+}
+
+func TestHTTPGatewayRateLimit(t *testing.T) {
+	pki := newTestPKI(t)
+	_, url := startGateway(t, pki, WithRateLimit(RateLimitPolicy{Rate: 0.01, Burst: 1}))
+	client := gatewayClient(t, pki, true)
+
+	status, _ := post(t, client, url, "TestService.Add", "{}", "")
+	require.Equal(t, http.StatusOK, status)
+
+	req, err := http.NewRequest(http.MethodPost, url+"/TestService.Add", strings.NewReader("{}"))
+	require.NoError(t, err)
+	resp, err := client.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	require.NotEmpty(t, resp.Header.Get("Retry-After"))
+}
@@ -0,0 +1,93 @@
+package swissknife
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"time"
+)
+
+// ErrConnectionRejected is returned to clients whose connection was refused
+// by ConnHooks.OnConnect. The reason given by the hook is only logged.
+var ErrConnectionRejected = errors.New("rpc: connection rejected")
+
+// ConnInfo describes an established client connection.
+type ConnInfo struct {
+	RemoteAddr  net.Addr
+	LocalAddr   net.Addr
+	ConnectedAt time.Time
+
+	// TLSVersion and CipherSuite are the negotiated parameters, usable with
+	// tls.VersionName and tls.CipherSuiteName.
+	TLSVersion         uint16
+	CipherSuite        uint16
+	ServerName         string
+	NegotiatedProtocol string
+
+	// PeerCertificates is the chain presented by the client, leaf first, and
+	// VerifiedChains the chains it was verified against.
+	PeerCertificates []*x509.Certificate
+	VerifiedChains   [][]*x509.Certificate
+
+	// Peer calls the services of a client connected in bidirectional mode
+	// (see WithBidirectional). It is nil for other connections.
+	Peer *Peer
+}
+
+// Identity returns the subject of the client certificate, or an empty string
+// if the client presented none.
+func (c ConnInfo) Identity() string {
+	if len(c.PeerCertificates) == 0 {
+		return ""
+	}
+	return c.PeerCertificates[0].Subject.String()
+}
+
+// newConnInfo collects the details of conn after its handshake.
+func newConnInfo(conn net.Conn) ConnInfo {
+	info := ConnInfo{
+		RemoteAddr:  conn.RemoteAddr(),
+		LocalAddr:   conn.LocalAddr(),
+		ConnectedAt: time.Now(),
+	}
+	if tlsConn, ok := conn.(interface{ ConnectionState() tls.ConnectionState }); ok {
+		info.setTLSState(tlsConn.ConnectionState())
+	}
+	return info
+}
+
+// setTLSState records the negotiated parameters and peer certificates of a
+// completed handshake.
+func (c *ConnInfo) setTLSState(state tls.ConnectionState) {
+	c.TLSVersion = state.Version
+	c.CipherSuite = state.CipherSuite
+	c.ServerName = state.ServerName
+	c.NegotiatedProtocol = state.NegotiatedProtocol
+	c.PeerCertificates = state.PeerCertificates
+	c.VerifiedChains = state.VerifiedChains
+}
+
+// ConnHooks are callbacks run on the goroutine serving a connection. Any of
+// them may be nil.
+type ConnHooks struct {
+	// OnConnect is called once the TLS handshake has succeeded. Returning an
+	// error rejects the connection: the client receives
+	// ErrConnectionRejected and the connection is closed.
+	OnConnect func(info ConnInfo) error
+
+	// OnDisconnect is called when a connection accepted by OnConnect closes,
+	// with the error that ended it (io.EOF when the client hung up).
+	OnDisconnect func(info ConnInfo, err error)
+
+	// OnHandshakeFailure is called when a client fails the TLS handshake, for
+	// example by presenting a certificate that does not verify.
+	OnHandshakeFailure func(remoteAddr net.Addr, err error)
+}
+
+// WithConnHooks installs connection lifecycle callbacks on the server.
+func WithConnHooks(hooks ConnHooks) ServerOption {
+	return func(s *tlsRpcServer) {
+		s.hooks = hooks
+	}
+}
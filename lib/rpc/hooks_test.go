@@ -0,0 +1,83 @@
+package swissknife
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestConnHooksReportConnectionDetails(t *testing.T) {
+	pki := newTestPKI(t)
+	connected := make(chan ConnInfo, 1)
+	disconnected := make(chan error, 1)
+	_, addr := startTestServer(t, pki, WithConnHooks(ConnHooks{
+		OnConnect: func(info ConnInfo) error {
+			connected <- info
+			return nil
+		},
+		OnDisconnect: func(info ConnInfo, err error) {
+			disconnected <- err
+		},
+	}))
+
+	client := newTestClient(t, pki, addr)
+	require.Equal(t, 42, callAdd(t, client))
+
+	info := <-connected
+	require.Equal(t, "CN=test-client", info.Identity())
+	require.Equal(t, uint16(tls.VersionTLS13), info.TLSVersion)
+	require.NotZero(t, info.CipherSuite)
+	require.NotEmpty(t, info.VerifiedChains)
+	require.Equal(t, "localhost", info.ServerName)
+
+	client.CloseClient()
+	select {
+	case <-disconnected:
+	case <-time.After(2 * time.Second):
+		t.Fatal("OnDisconnect was not called")
+	}
+}
+
+func TestConnHooksRejectConnection(t *testing.T) {
+	pki := newTestPKI(t)
+	_, addr := startTestServer(t, pki, WithConnHooks(ConnHooks{
+		OnConnect: func(info ConnInfo) error {
+			return errors.New("not on the allow list")
+		},
+	}))
+
+	client := newTestClient(t, pki, addr)
+	_, err := client.ConnectToRpcServerTls("TestService.Add", nil)
+	require.ErrorIs(t, err, ErrConnectionRejected)
+}
+
+func TestConnHooksReportHandshakeFailure(t *testing.T) {
+	pki := newTestPKI(t)
+	failures := make(chan net.Addr, 1)
+	_, addr := startTestServer(t, pki, WithConnHooks(ConnHooks{
+		OnHandshakeFailure: func(remoteAddr net.Addr, err error) {
+			failures <- remoteAddr
+		},
+	}))
+
+	// Trust the server but present no client certificate.
+	roots, err := loadCertPool(pki.caCert, nil)
+	require.NoError(t, err)
+	conn, err := tls.Dial("tcp", addr, &tls.Config{RootCAs: roots})
+	if err == nil {
+		// TLS 1.3 reports the missing certificate on the first read.
+		conn.Read(make([]byte, 1))
+		conn.Close()
+	}
+
+	select {
+	case remote := <-failures:
+		require.NotNil(t, remote)
+	case <-time.After(2 * time.Second):
+		t.Fatal("OnHandshakeFailure was not called")
+	}
+}
@@ -0,0 +1,165 @@
+package swissknife
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrIdempotencyKeyReused is returned for a call that reuses the idempotency
+// key of an earlier call to the same method with different arguments.
+var ErrIdempotencyKeyReused = errors.New("rpc: idempotency key reused with different arguments")
+
+// WithIdempotency makes the server remember the outcome of calls sent with
+// an idempotency key for ttl, and replay it to repeats of the call instead
+// of running the method again. A repeat arriving while the first call is
+// still running waits for its outcome. Keys are scoped to the caller's
+// certificate identity, token subject and method; calls from callers with
+// neither are never deduplicated. Outcomes that a retry may change, such as
+// cancelled calls and exhausted resources, are not remembered.
+func WithIdempotency(ttl time.Duration) ServerOption {
+	return func(s *tlsRpcServer) {
+		s.idempotency = newIdempotencyCache(ttl)
+	}
+}
+
+type idempotencyKeyKey struct{}
+
+// ContextWithIdempotencyKey returns a copy of ctx that makes
+// ConnectToRpcServerTlsContext send key with the call. Retries of a call
+// should reuse its key so that a server set up with WithIdempotency runs it
+// only once.
+func ContextWithIdempotencyKey(ctx context.Context, key string) context.Context {
+	return context.WithValue(ctx, idempotencyKeyKey{}, key)
+}
+
+// callIdempotencyKey returns the idempotency key to send with a call made
+// with ctx.
+func callIdempotencyKey(ctx context.Context) string {
+	key, _ := ctx.Value(idempotencyKeyKey{}).(string)
+	return key
+}
+
+// idempotencyScope returns the key req's outcome is remembered under, or
+// an empty string when it must not be deduplicated.
+func (sc *serverConn) idempotencyScope(req *serverRequest) string {
+	if sc.server.idempotency == nil || req.header.IdempotencyKey == "" {
+		return ""
+	}
+	var subject string
+	if req.principal != nil {
+		subject = req.principal.Subject
+	}
+	if sc.identity == "" && subject == "" {
+		return ""
+	}
+	return sc.identity + "\x00" + subject + "\x00" + req.header.ServiceMethod + "\x00" + req.header.IdempotencyKey
+}
+
+// idempotencyCache remembers the outcome of calls by idempotency key.
+type idempotencyCache struct {
+	ttl time.Duration
+	now func() time.Time
+
+	mu        sync.Mutex
+	entries   map[string]*idempotencyEntry
+	lastSweep time.Time
+}
+
+// idempotencyEntry is a call that is running, while expires is zero, or
+// whose outcome is kept until expires. done is closed once the call
+// finished; kept is then set when reply and err were remembered.
+type idempotencyEntry struct {
+	args    [sha256.Size]byte
+	done    chan struct{}
+	kept    bool
+	reply   []byte
+	err     error
+	expires time.Time
+}
+
+func newIdempotencyCache(ttl time.Duration) *idempotencyCache {
+	return &idempotencyCache{
+		ttl:     ttl,
+		now:     time.Now,
+		entries: make(map[string]*idempotencyEntry),
+	}
+}
+
+// do returns the remembered outcome of the call stored under key, waiting
+// for it while the call is running, or runs the call with run and remembers
+// its outcome. replayed reports whether the outcome came from an earlier
+// call.
+func (c *idempotencyCache) do(ctx context.Context, key string, args []byte, run func() ([]byte, error)) (reply []byte, replayed bool, err error) {
+	sum := sha256.Sum256(args)
+	for {
+		c.mu.Lock()
+		now := c.now()
+		c.sweep(now)
+
+		entry, ok := c.entries[key]
+		if !ok || entry.expired(now) {
+			break
+		}
+		c.mu.Unlock()
+
+		if entry.args != sum {
+			return nil, false, ErrIdempotencyKeyReused
+		}
+		select {
+		case <-entry.done:
+		case <-ctx.Done():
+			return nil, false, ctx.Err()
+		}
+		if entry.kept {
+			return entry.reply, true, entry.err
+		}
+		// The first call's outcome was not kept, so run the call again.
+	}
+
+	entry := &idempotencyEntry{args: sum, done: make(chan struct{})}
+	c.entries[key] = entry
+	c.mu.Unlock()
+
+	reply, err = run()
+
+	c.mu.Lock()
+	if keepOutcome(err) {
+		entry.kept, entry.reply, entry.err = true, reply, err
+		entry.expires = c.now().Add(c.ttl)
+	} else {
+		delete(c.entries, key)
+	}
+	c.mu.Unlock()
+	close(entry.done)
+	return reply, false, err
+}
+
+// expired reports whether the entry's outcome is no longer kept at now.
+func (e *idempotencyEntry) expired(now time.Time) bool {
+	return !e.expires.IsZero() && !now.Before(e.expires)
+}
+
+// keepOutcome reports whether a call that failed with err would fail the
+// same way when retried, so that its outcome can be replayed.
+func keepOutcome(err error) bool {
+	return !errors.Is(err, context.Canceled) &&
+		!errors.Is(err, context.DeadlineExceeded) &&
+		!errors.Is(err, ErrResourceExhausted)
+}
+
+// sweep discards expired outcomes, at most once per ttl.
+func (c *idempotencyCache) sweep(now time.Time) {
+	if now.Sub(c.lastSweep) < c.ttl {
+		return
+	}
+	c.lastSweep = now
+
+	for key, entry := range c.entries {
+		if entry.expired(now) {
+			delete(c.entries, key)
+		}
+	}
+}
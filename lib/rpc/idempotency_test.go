@@ -0,0 +1,190 @@
+package swissknife
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// CounterService counts how many times its methods ran.
+type CounterService struct {
+	runs atomic.Int32
+}
+
+func (s *CounterService) Next(args *[]byte, reply *[]byte) error {
+	n := s.runs.Add(1)
+	time.Sleep(50 * time.Millisecond)
+	*reply = []byte(fmt.Sprintf("%s %d", *args, n))
+	return nil
+}
+
+func (s *CounterService) Fail(args *[]byte, reply *[]byte) error {
+	return fmt.Errorf("failed run %d", s.runs.Add(1))
+}
+
+func TestIdempotentCallsAreReplayed(t *testing.T) {
+	pki := newTestPKI(t)
+	s, addr := startTestServer(t, pki, WithIdempotency(time.Minute))
+	counter := new(CounterService)
+	require.NoError(t, s.RegisterMethod("Counter", counter))
+	client := newTestClient(t, pki, addr)
+
+	ctx := ContextWithIdempotencyKey(context.Background(), "order-1")
+	for i := 0; i < 3; i++ {
+		reply, err := client.ConnectToRpcServerTlsContext(ctx, "Counter.Next", []byte("call"))
+		require.NoError(t, err)
+		require.Equal(t, "call 1", string(reply))
+	}
+
+	_, err := client.ConnectToRpcServerTlsContext(ctx, "Counter.Next", []byte("other"))
+	require.ErrorIs(t, err, ErrIdempotencyKeyReused)
+
+	reply, err := client.ConnectToRpcServerTlsContext(ContextWithIdempotencyKey(context.Background(), "order-2"), "Counter.Next", []byte("call"))
+	require.NoError(t, err)
+	require.Equal(t, "call 2", string(reply))
+	reply, err = client.ConnectToRpcServerTls("Counter.Next", []byte("call"))
+	require.NoError(t, err)
+	require.Equal(t, "call 3", string(reply))
+
+	// Failures are replayed too, since the method ran.
+	for i := 0; i < 2; i++ {
+		_, err = client.ConnectToRpcServerTlsContext(ctx, "Counter.Fail", nil)
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "failed run 4")
+	}
+}
+
+func TestIdempotentDuplicatesWaitForFirstCall(t *testing.T) {
+	pki := newTestPKI(t)
+	s, addr := startTestServer(t, pki, WithIdempotency(time.Minute))
+	counter := new(CounterService)
+	require.NoError(t, s.RegisterMethod("Counter", counter))
+	client := newTestClient(t, pki, addr)
+
+	ctx := ContextWithIdempotencyKey(context.Background(), "order-1")
+	replies := make([]string, 5)
+	var wg sync.WaitGroup
+	for i := range replies {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			reply, err := client.ConnectToRpcServerTlsContext(ctx, "Counter.Next", []byte("call"))
+			if err == nil {
+				replies[i] = string(reply)
+			}
+		}()
+	}
+	wg.Wait()
+
+	require.Equal(t, int32(1), counter.runs.Load())
+	for _, reply := range replies {
+		require.Equal(t, "call 1", reply)
+	}
+}
+
+func TestIdempotentBatchAndGatewayCalls(t *testing.T) {
+	pki := newTestPKI(t)
+	s, url := startGateway(t, pki, WithIdempotency(time.Minute))
+	counter := new(CounterService)
+	require.NoError(t, s.RegisterMethod("Counter", counter))
+
+	client := gatewayClient(t, pki, true)
+	for i := 0; i < 2; i++ {
+		req, err := http.NewRequest(http.MethodPost, url+"/Counter.Fail", strings.NewReader("{}"))
+		require.NoError(t, err)
+		req.Header.Set("Idempotency-Key", "order-1")
+		resp, err := client.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		require.Equal(t, http.StatusInternalServerError, resp.StatusCode)
+	}
+	require.Equal(t, int32(1), counter.runs.Load())
+
+	_, addr := startTestServer(t, pki, WithIdempotency(time.Minute))
+	results, err := CallBatch(newTestClient(t, pki, addr), Batch{Calls: []BatchCall{
+		addCall(t, 1, 2),
+		{ServiceMethod: "TestService.Add", Args: addCall(t, 1, 2).Args, IdempotencyKey: "sum"},
+		{ServiceMethod: "TestService.Add", Args: addCall(t, 3, 4).Args, IdempotencyKey: "sum"},
+	}, Sequential: true})
+	require.NoError(t, err)
+	require.Equal(t, 3, sum(t, results[0]))
+	require.Equal(t, 3, sum(t, results[1]))
+	require.ErrorIs(t, results[2].Err, ErrIdempotencyKeyReused)
+}
+
+func TestIdempotencyCache(t *testing.T) {
+	cache := newIdempotencyCache(time.Minute)
+	now := time.Now()
+	cache.now = func() time.Time { return now }
+
+	runs := 0
+	run := func(err error) func() ([]byte, error) {
+		return func() ([]byte, error) {
+			runs++
+			return []byte(fmt.Sprint(runs)), err
+		}
+	}
+	ctx := context.Background()
+
+	// Cancelled calls and exhausted resources may succeed when retried.
+	_, replayed, err := cache.do(ctx, "k", nil, run(context.Canceled))
+	require.ErrorIs(t, err, context.Canceled)
+	require.False(t, replayed)
+	_, _, err = cache.do(ctx, "k", nil, run(&ResourceExhaustedError{Reason: "quota"}))
+	require.ErrorIs(t, err, ErrResourceExhausted)
+
+	reply, replayed, err := cache.do(ctx, "k", nil, run(nil))
+	require.NoError(t, err)
+	require.False(t, replayed)
+	require.Equal(t, "3", string(reply))
+
+	now = now.Add(59 * time.Second)
+	reply, replayed, err = cache.do(ctx, "k", nil, run(nil))
+	require.NoError(t, err)
+	require.True(t, replayed)
+	require.Equal(t, "3", string(reply))
+
+	now = now.Add(time.Second)
+	reply, replayed, _ = cache.do(ctx, "k", nil, run(nil))
+	require.False(t, replayed)
+	require.Equal(t, "4", string(reply))
+
+	now = now.Add(2 * time.Minute)
+	cache.do(ctx, "other", nil, run(nil))
+	require.Len(t, cache.entries, 1)
+}
+
+func TestIdempotencyWaitHonoursContext(t *testing.T) {
+	cache := newIdempotencyCache(time.Minute)
+	release := make(chan struct{})
+	started := make(chan struct{})
+	go cache.do(context.Background(), "k", nil, func() ([]byte, error) {
+		close(started)
+		<-release
+		return nil, nil
+	})
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, _, err := cache.do(ctx, "k", nil, func() ([]byte, error) {
+		return nil, errors.New("ran twice")
+	})
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	close(release)
+}
+
+func TestIdempotencyRequiresPositiveTTL(t *testing.T) {
+	pki := newTestPKI(t)
+	_, err := NewITlsRpcServer(pki.serverCert, pki.serverKey, pki.caCert, "0", WithIdempotency(0))
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "idempotency TTL")
+}
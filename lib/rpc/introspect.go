@@ -0,0 +1,113 @@
+package swissknife
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"net"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// ConnectionStats is a snapshot of a live server connection.
+type ConnectionStats struct {
+	ID           uint64       `json:"id"`
+	RemoteAddr   string       `json:"remote_addr"`
+	Identity     string       `json:"identity"`
+	TLSVersion   string       `json:"tls_version,omitempty"`
+	ConnectedAt  time.Time    `json:"connected_at"`
+	BytesRead    int64        `json:"bytes_read"`
+	BytesWritten int64        `json:"bytes_written"`
+	CallsServed  int64        `json:"calls_served"`
+	ActiveCalls  []ActiveCall `json:"active_calls"`
+}
+
+// ActiveCall is a call still executing when a snapshot was taken.
+type ActiveCall struct {
+	ServiceMethod string        `json:"service_method"`
+	Seq           uint64        `json:"seq"`
+	StartedAt     time.Time     `json:"started_at"`
+	Duration      time.Duration `json:"duration_ns"`
+}
+
+// Connections returns a snapshot of every open connection, oldest first,
+// with the calls each is currently executing, longest running first.
+func (s *tlsRpcServer) Connections() []ConnectionStats {
+	s.mu.Lock()
+	conns := make([]*serverConn, 0, len(s.conns))
+	for sc := range s.conns {
+		conns = append(conns, sc)
+	}
+	s.mu.Unlock()
+
+	now := time.Now()
+	stats := make([]ConnectionStats, 0, len(conns))
+	for _, sc := range conns {
+		stats = append(stats, sc.stats(now))
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		return stats[i].ID < stats[j].ID
+	})
+	return stats
+}
+
+func (sc *serverConn) stats(now time.Time) ConnectionStats {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	stats := ConnectionStats{
+		ID:           sc.id,
+		RemoteAddr:   sc.remote,
+		Identity:     sc.identity,
+		ConnectedAt:  sc.accepted,
+		BytesRead:    sc.codec.bytesRead.Load(),
+		BytesWritten: sc.codec.bytesWritten.Load(),
+		CallsServed:  sc.callsServed,
+		ActiveCalls:  make([]ActiveCall, 0, len(sc.active)),
+	}
+	if sc.info.TLSVersion != 0 {
+		stats.TLSVersion = tls.VersionName(sc.info.TLSVersion)
+	}
+	for req, started := range sc.active {
+		stats.ActiveCalls = append(stats.ActiveCalls, ActiveCall{
+			ServiceMethod: req.header.ServiceMethod,
+			Seq:           req.header.Seq,
+			StartedAt:     started,
+			Duration:      now.Sub(started),
+		})
+	}
+	sort.Slice(stats.ActiveCalls, func(i, j int) bool {
+		return stats.ActiveCalls[i].StartedAt.Before(stats.ActiveCalls[j].StartedAt)
+	})
+	return stats
+}
+
+// NewDebugHandler returns an http.Handler that renders server.Connections()
+// as JSON. It only answers requests from loopback addresses, so it can be
+// mounted on an internal admin server without exposing peer identities.
+func NewDebugHandler(server ITlsRpcServer) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !isLoopback(r.RemoteAddr) {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.Encode(server.Connections())
+	})
+}
+
+func isLoopback(remoteAddr string) bool {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
@@ -0,0 +1,74 @@
+package swissknife
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestConnectionsListsActiveCalls(t *testing.T) {
+	pki := newTestPKI(t)
+	s, addr := startTestServer(t, pki)
+	blocking := &BlockingService{started: make(chan struct{}, 1), release: make(chan struct{})}
+	require.NoError(t, s.RegisterMethod("Blocking", blocking))
+
+	client := newTestClient(t, pki, addr)
+	require.Equal(t, 42, callAdd(t, client))
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := client.ConnectToRpcServerTls("Blocking.Wait", []byte("x"))
+		done <- err
+	}()
+	<-blocking.started
+	time.Sleep(10 * time.Millisecond)
+
+	conns := s.Connections()
+	require.Len(t, conns, 1)
+	conn := conns[0]
+	require.Equal(t, "CN=test-client", conn.Identity)
+	require.Equal(t, "TLS 1.3", conn.TLSVersion)
+	require.EqualValues(t, 1, conn.CallsServed)
+	require.Greater(t, conn.BytesRead, int64(0))
+	require.Greater(t, conn.BytesWritten, int64(0))
+	require.Len(t, conn.ActiveCalls, 1)
+	require.Equal(t, "Blocking.Wait", conn.ActiveCalls[0].ServiceMethod)
+	require.GreaterOrEqual(t, conn.ActiveCalls[0].Duration, 10*time.Millisecond)
+
+	close(blocking.release)
+	require.NoError(t, <-done)
+	require.Eventually(t, func() bool {
+		conns := s.Connections()
+		return len(conns) == 1 && len(conns[0].ActiveCalls) == 0 && conns[0].CallsServed == 2
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestDebugHandlerOnlyServesLoopback(t *testing.T) {
+	pki := newTestPKI(t)
+	s, addr := startTestServer(t, pki)
+	client := newTestClient(t, pki, addr)
+	require.Equal(t, 42, callAdd(t, client))
+
+	handler := NewDebugHandler(s)
+
+	remote := httptest.NewRequest(http.MethodGet, "/debug/rpc", nil)
+	remote.RemoteAddr = "192.0.2.10:4000"
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, remote)
+	require.Equal(t, http.StatusForbidden, rec.Code)
+
+	local := httptest.NewRequest(http.MethodGet, "/debug/rpc", nil)
+	local.RemoteAddr = "127.0.0.1:4000"
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, local)
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	var conns []ConnectionStats
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &conns))
+	require.Len(t, conns, 1)
+	require.Equal(t, "CN=test-client", conns[0].Identity)
+}
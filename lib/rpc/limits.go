@@ -0,0 +1,68 @@
+package swissknife
+
+import "errors"
+
+// DefaultMaxMessageSize is the request and response size limit applied by
+// DefaultServerLimits.
+const DefaultMaxMessageSize = 4 << 20
+
+var (
+	// ErrRequestTooLarge is returned when an encoded request exceeds
+	// ServerLimits.MaxRequestSize. The offending connection is closed.
+	ErrRequestTooLarge = errors.New("rpc: request exceeds maximum size")
+
+	// ErrResponseTooLarge is returned in place of a reply larger than
+	// ServerLimits.MaxResponseSize.
+	ErrResponseTooLarge = errors.New("rpc: response exceeds maximum size")
+
+	// ErrTooManyCalls is returned when a connection already has
+	// ServerLimits.MaxConcurrentCalls calls in flight.
+	ErrTooManyCalls = errors.New("rpc: too many concurrent calls on connection")
+
+	// ErrTooManyConnections is returned to clients connecting while the server
+	// already holds ServerLimits.MaxConnections open connections.
+	ErrTooManyConnections = errors.New("rpc: too many open connections")
+)
+
+// ServerLimits bounds the resources clients can consume on a TLS RPC server.
+// A zero value for any field disables that limit.
+type ServerLimits struct {
+	// MaxRequestSize is the maximum encoded size in bytes of a single request,
+	// header and arguments included.
+	MaxRequestSize int64
+
+	// MaxResponseSize is the maximum size in bytes of a reply returned by a
+	// registered method.
+	MaxResponseSize int64
+
+	// MaxConcurrentCalls is the maximum number of calls executing at once on
+	// a single connection.
+	MaxConcurrentCalls int
+
+	// MaxConnections is the maximum number of connections the server keeps
+	// open at once.
+	MaxConnections int
+
+	// MaxBatchCalls is the maximum number of calls in a single batch sent
+	// with CallBatch.
+	MaxBatchCalls int
+}
+
+// DefaultServerLimits returns the limits used by servers that are not given
+// WithLimits: requests and responses are capped at DefaultMaxMessageSize,
+// batches at DefaultMaxBatchCalls calls and concurrency is unbounded.
+func DefaultServerLimits() ServerLimits {
+	return ServerLimits{
+		MaxRequestSize:  DefaultMaxMessageSize,
+		MaxResponseSize: DefaultMaxMessageSize,
+		MaxBatchCalls:   DefaultMaxBatchCalls,
+	}
+}
+
+// WithLimits replaces the server's resource limits. Fields left at zero are
+// unlimited, so start from DefaultServerLimits to keep the size caps.
+func WithLimits(limits ServerLimits) ServerOption {
+	return func(s *tlsRpcServer) {
+		s.limits = limits
+	}
+}
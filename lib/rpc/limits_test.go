@@ -0,0 +1,141 @@
+package swissknife
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"net/rpc"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// BlockingService holds every call until release is closed.
+type BlockingService struct {
+	started chan struct{}
+	release chan struct{}
+}
+
+func (s *BlockingService) Wait(args *[]byte, reply *[]byte) error {
+	s.started <- struct{}{}
+	<-s.release
+	*reply = *args
+	return nil
+}
+
+type EchoService struct{}
+
+func (s *EchoService) Echo(args *[]byte, reply *[]byte) error {
+	*reply = *args
+	return nil
+}
+
+func (s *EchoService) Grow(args *[]byte, reply *[]byte) error {
+	*reply = bytes.Repeat([]byte("x"), len(*args)*1024)
+	return nil
+}
+
+// dialRawClient connects a plain net/rpc client, which unlike ITlsRpcClient
+// can issue concurrent calls on one connection.
+func dialRawClient(t *testing.T, pki *testPKI, addr string) *rpc.Client {
+	t.Helper()
+
+	cert, err := tls.LoadX509KeyPair(pki.clientCert, pki.clientKey)
+	require.NoError(t, err)
+	roots, err := loadCertPool(pki.caCert, nil)
+	require.NoError(t, err)
+
+	conn, err := tls.Dial("tcp", addr, &tls.Config{RootCAs: roots, Certificates: []tls.Certificate{cert}})
+	require.NoError(t, err)
+	client := rpc.NewClient(conn)
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+func TestTlsRpcRoundTripWithLimits(t *testing.T) {
+	pki := newTestPKI(t)
+	_, addr := startTestServer(t, pki)
+	client := newTestClient(t, pki, addr)
+
+	argsData, err := json.Marshal(Args{A: 2, B: 40})
+	require.NoError(t, err)
+	replyData, err := client.ConnectToRpcServerTls("TestService.Add", argsData)
+	require.NoError(t, err)
+
+	var reply Reply
+	require.NoError(t, json.Unmarshal(replyData, &reply))
+	require.Equal(t, 42, reply.Sum)
+}
+
+func TestServerRejectsOversizedRequest(t *testing.T) {
+	pki := newTestPKI(t)
+	_, addr := startTestServer(t, pki, WithLimits(ServerLimits{MaxRequestSize: 1024}))
+	client := newTestClient(t, pki, addr)
+
+	_, err := client.ConnectToRpcServerTls("TestService.Add", bytes.Repeat([]byte("a"), 4096))
+	require.Error(t, err)
+	require.True(t, errors.Is(err, ErrRequestTooLarge), "got %v", err)
+}
+
+func TestServerRejectsOversizedResponse(t *testing.T) {
+	pki := newTestPKI(t)
+	s, addr := startTestServer(t, pki, WithLimits(ServerLimits{MaxResponseSize: 2048}))
+	require.NoError(t, s.RegisterMethod("Echo", new(EchoService)))
+
+	raw := dialRawClient(t, pki, addr)
+	var reply []byte
+	require.NoError(t, raw.Call("Echo.Grow", []byte("a"), &reply))
+	require.Len(t, reply, 1024)
+
+	err := raw.Call("Echo.Grow", []byte("abc"), &reply)
+	require.EqualError(t, err, ErrResponseTooLarge.Error())
+}
+
+func TestServerLimitsConcurrentCalls(t *testing.T) {
+	pki := newTestPKI(t)
+	s, addr := startTestServer(t, pki, WithLimits(ServerLimits{MaxConcurrentCalls: 1}))
+	blocking := &BlockingService{started: make(chan struct{}, 1), release: make(chan struct{})}
+	require.NoError(t, s.RegisterMethod("Blocking", blocking))
+
+	raw := dialRawClient(t, pki, addr)
+	var first []byte
+	call := raw.Go("Blocking.Wait", []byte("first"), &first, nil)
+	<-blocking.started
+
+	var second []byte
+	err := raw.Call("Blocking.Wait", []byte("second"), &second)
+	require.EqualError(t, err, ErrTooManyCalls.Error())
+
+	close(blocking.release)
+	<-call.Done
+	require.NoError(t, call.Error)
+	require.Equal(t, []byte("first"), first)
+}
+
+func TestServerLimitsConnections(t *testing.T) {
+	pki := newTestPKI(t)
+	_, addr := startTestServer(t, pki, WithLimits(ServerLimits{MaxConnections: 1}))
+
+	first := dialRawClient(t, pki, addr)
+	var reply []byte
+	argsData, err := json.Marshal(Args{A: 1, B: 1})
+	require.NoError(t, err)
+	require.NoError(t, first.Call("TestService.Add", argsData, &reply))
+
+	client := newTestClient(t, pki, addr)
+	_, err = client.ConnectToRpcServerTls("TestService.Add", argsData)
+	require.True(t, errors.Is(err, ErrTooManyConnections), "got %v", err)
+
+	first.Close()
+	require.Eventually(t, func() bool {
+		retry, err := NewITlsRpcClient(pki.caCert, pki.clientCert, pki.clientKey, addr, "retry")
+		if err != nil {
+			return false
+		}
+		defer retry.CloseClient()
+		_, err = retry.ConnectToRpcServerTls("TestService.Add", argsData)
+		return err == nil
+	}, 2*time.Second, 20*time.Millisecond)
+}
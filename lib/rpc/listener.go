@@ -0,0 +1,80 @@
+package swissknife
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// systemdFirstFD is the first file descriptor passed by systemd socket
+// activation (SD_LISTEN_FDS_START).
+const systemdFirstFD = 3
+
+// WithDialNetwork sets the network the client dials, as accepted by
+// net.Dial. The default is "tcp"; use "unix" to reach a server listening on
+// a Unix domain socket, together with WithServerName.
+func WithDialNetwork(network string) ClientOption {
+	return func(c *tlsRpcClient) {
+		c.network = network
+	}
+}
+
+// WithDialContext makes the client open its connection with dial instead of
+// net.Dial, for example to reach a server listening on an in-memory
+// listener. The TLS handshake then runs over the returned connection, and
+// the context passed to dial expires after Timeouts.HandshakeTimeout.
+func WithDialContext(dial func(ctx context.Context, network, address string) (net.Conn, error)) ClientOption {
+	return func(c *tlsRpcClient) {
+		c.dial = dial
+	}
+}
+
+// WithServerName sets the name the server certificate is verified against.
+// By default it is taken from the host part of the dialed address, which
+// does not work for Unix domain sockets or addresses that are not named in
+// the certificate.
+func WithServerName(serverName string) ClientOption {
+	return func(c *tlsRpcClient) {
+		c.serverName = serverName
+	}
+}
+
+// SystemdListeners returns the listeners passed to this process through
+// systemd socket activation, in the order they were configured. It returns
+// no listeners and no error when the process was not socket activated. The
+// result can be passed to NewITlsRpcServerListener.
+func SystemdListeners() ([]net.Listener, error) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+
+	count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid LISTEN_FDS: %w", err)
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+
+	listeners := make([]net.Listener, 0, count)
+	for i := 0; i < count; i++ {
+		name := fmt.Sprintf("LISTEN_FD_%d", systemdFirstFD+i)
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+
+		file := os.NewFile(uintptr(systemdFirstFD+i), name)
+		listener, err := net.FileListener(file)
+		file.Close()
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, fmt.Errorf("failed to use inherited socket %s: %w", name, err)
+		}
+		listeners = append(listeners, listener)
+	}
+	return listeners, nil
+}
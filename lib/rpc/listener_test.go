@@ -0,0 +1,97 @@
+package swissknife
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func callAdd(t *testing.T, client ITlsRpcClient) int {
+	t.Helper()
+
+	argsData, err := json.Marshal(Args{A: 20, B: 22})
+	require.NoError(t, err)
+	replyData, err := client.ConnectToRpcServerTls("TestService.Add", argsData)
+	require.NoError(t, err)
+
+	var reply Reply
+	require.NoError(t, json.Unmarshal(replyData, &reply))
+	return reply.Sum
+}
+
+func serve(t *testing.T, server ITlsRpcServer) {
+	t.Helper()
+
+	server.SetLogger(newTestLogger(&bytes.Buffer{}, &bytes.Buffer{}, LogLevelDebug))
+	require.NoError(t, server.RegisterMethod("TestService", new(TestService)))
+	go server.Serve()
+	t.Cleanup(server.CloseServer)
+}
+
+func TestServerListensOnUnixSocket(t *testing.T) {
+	pki := newTestPKI(t)
+	socket := filepath.Join(t.TempDir(), "rpc.sock")
+
+	server, err := NewITlsRpcServerAddr(pki.serverCert, pki.serverKey, pki.caCert, "unix", socket)
+	require.NoError(t, err)
+	serve(t, server)
+	require.Equal(t, socket, server.Addr().String())
+
+	client := newTestClient(t, pki, socket, WithDialNetwork("unix"), WithServerName("localhost"))
+	require.Equal(t, 42, callAdd(t, client))
+}
+
+func TestServerListensOnSpecificInterface(t *testing.T) {
+	pki := newTestPKI(t)
+
+	server, err := NewITlsRpcServerAddr(pki.serverCert, pki.serverKey, pki.caCert, "tcp4", "127.0.0.1:0")
+	require.NoError(t, err)
+	serve(t, server)
+
+	host, _, err := net.SplitHostPort(server.Addr().String())
+	require.NoError(t, err)
+	require.Equal(t, "127.0.0.1", host)
+
+	client := newTestClient(t, pki, server.Addr().String())
+	require.Equal(t, 42, callAdd(t, client))
+}
+
+func TestServerListensOnIPv6Literal(t *testing.T) {
+	pki := newTestPKI(t)
+
+	server, err := NewITlsRpcServerAddr(pki.serverCert, pki.serverKey, pki.caCert, "tcp6", "[::1]:0")
+	if err != nil {
+		t.Skipf("IPv6 loopback unavailable: %v", err)
+	}
+	serve(t, server)
+
+	client := newTestClient(t, pki, server.Addr().String())
+	require.Equal(t, 42, callAdd(t, client))
+}
+
+func TestServerWrapsCallerListener(t *testing.T) {
+	pki := newTestPKI(t)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	server, err := NewITlsRpcServerListener(pki.serverCert, pki.serverKey, pki.caCert, listener)
+	require.NoError(t, err)
+	serve(t, server)
+	require.Equal(t, listener.Addr(), server.Addr())
+
+	client := newTestClient(t, pki, listener.Addr().String())
+	require.Equal(t, 42, callAdd(t, client))
+}
+
+func TestSystemdListenersWithoutActivation(t *testing.T) {
+	t.Setenv("LISTEN_PID", "")
+	t.Setenv("LISTEN_FDS", "")
+
+	listeners, err := SystemdListeners()
+	require.NoError(t, err)
+	require.Empty(t, listeners)
+}
@@ -0,0 +1,353 @@
+package swissknife
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// DefaultLatencyBuckets are histogram bucket upper bounds, in seconds, suited
+// to RPC call latencies.
+var DefaultLatencyBuckets = []float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+type metricKind string
+
+const (
+	kindCounter   metricKind = "counter"
+	kindGauge     metricKind = "gauge"
+	kindHistogram metricKind = "histogram"
+)
+
+// MetricsRegistry holds counters, gauges and histograms and renders them in
+// the Prometheus text exposition format. It is safe for concurrent use.
+type MetricsRegistry struct {
+	mu       sync.Mutex
+	families map[string]*metricFamily
+}
+
+// NewMetricsRegistry returns an empty registry.
+func NewMetricsRegistry() *MetricsRegistry {
+	return &MetricsRegistry{families: make(map[string]*metricFamily)}
+}
+
+// metricFamily is every series of one metric name.
+type metricFamily struct {
+	name       string
+	help       string
+	kind       metricKind
+	labelNames []string
+	buckets    []float64
+
+	mu     sync.Mutex
+	series map[string]*metricSeries
+}
+
+// metricSeries is one combination of label values. Counters and gauges keep
+// their value as float64 bits in value; histograms use the remaining fields.
+type metricSeries struct {
+	labelValues []string
+	value       atomic.Uint64
+
+	mu     sync.Mutex
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+// family returns the named family, creating it on first use. Registering a
+// name again returns the existing family so that a registry can be shared,
+// but doing so with a different type or labels is a programming error.
+func (r *MetricsRegistry) family(name, help string, kind metricKind, buckets []float64, labelNames []string) *metricFamily {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if f, ok := r.families[name]; ok {
+		if f.kind != kind || strings.Join(f.labelNames, ",") != strings.Join(labelNames, ",") {
+			panic(fmt.Sprintf("metric %s already registered as %s with labels %v", name, f.kind, f.labelNames))
+		}
+		return f
+	}
+
+	f := &metricFamily{
+		name:       name,
+		help:       help,
+		kind:       kind,
+		labelNames: labelNames,
+		buckets:    buckets,
+		series:     make(map[string]*metricSeries),
+	}
+	r.families[name] = f
+	return f
+}
+
+func (f *metricFamily) with(labelValues []string) *metricSeries {
+	if len(labelValues) != len(f.labelNames) {
+		panic(fmt.Sprintf("metric %s expects %d label values, got %d", f.name, len(f.labelNames), len(labelValues)))
+	}
+	key := strings.Join(labelValues, "\xff")
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	s, ok := f.series[key]
+	if !ok {
+		s = &metricSeries{labelValues: append([]string(nil), labelValues...)}
+		if f.kind == kindHistogram {
+			s.counts = make([]uint64, len(f.buckets))
+		}
+		f.series[key] = s
+	}
+	return s
+}
+
+// CounterVec is a counter partitioned by label values.
+type CounterVec struct{ f *metricFamily }
+
+// GaugeVec is a gauge partitioned by label values.
+type GaugeVec struct{ f *metricFamily }
+
+// HistogramVec is a histogram partitioned by label values.
+type HistogramVec struct{ f *metricFamily }
+
+// Counter registers a monotonically increasing counter.
+func (r *MetricsRegistry) Counter(name, help string, labelNames ...string) *CounterVec {
+	return &CounterVec{r.family(name, help, kindCounter, nil, labelNames)}
+}
+
+// Gauge registers a value that can go up and down.
+func (r *MetricsRegistry) Gauge(name, help string, labelNames ...string) *GaugeVec {
+	return &GaugeVec{r.family(name, help, kindGauge, nil, labelNames)}
+}
+
+// Histogram registers a histogram with the given bucket upper bounds, which
+// must be sorted in increasing order. A nil buckets uses
+// DefaultLatencyBuckets.
+func (r *MetricsRegistry) Histogram(name, help string, buckets []float64, labelNames ...string) *HistogramVec {
+	if buckets == nil {
+		buckets = DefaultLatencyBuckets
+	}
+	return &HistogramVec{r.family(name, help, kindHistogram, buckets, labelNames)}
+}
+
+// Counter is a single counter series.
+type Counter struct{ s *metricSeries }
+
+// Gauge is a single gauge series.
+type Gauge struct{ s *metricSeries }
+
+// Histogram is a single histogram series.
+type Histogram struct {
+	s       *metricSeries
+	buckets []float64
+}
+
+// With returns the series for the given label values, in the order the label
+// names were registered.
+func (v *CounterVec) With(labelValues ...string) *Counter {
+	return &Counter{v.f.with(labelValues)}
+}
+
+// With returns the series for the given label values.
+func (v *GaugeVec) With(labelValues ...string) *Gauge {
+	return &Gauge{v.f.with(labelValues)}
+}
+
+// With returns the series for the given label values.
+func (v *HistogramVec) With(labelValues ...string) *Histogram {
+	return &Histogram{s: v.f.with(labelValues), buckets: v.f.buckets}
+}
+
+// Inc adds one to the counter.
+func (c *Counter) Inc() {
+	c.Add(1)
+}
+
+// Add adds v, which must not be negative, to the counter.
+func (c *Counter) Add(v float64) {
+	if v < 0 {
+		panic("counter cannot decrease")
+	}
+	c.s.add(v)
+}
+
+// Value returns the current count.
+func (c *Counter) Value() float64 {
+	return c.s.load()
+}
+
+// Set replaces the gauge value.
+func (g *Gauge) Set(v float64) {
+	g.s.value.Store(math.Float64bits(v))
+}
+
+// Inc adds one to the gauge.
+func (g *Gauge) Inc() {
+	g.s.add(1)
+}
+
+// Dec subtracts one from the gauge.
+func (g *Gauge) Dec() {
+	g.s.add(-1)
+}
+
+// Add adds v to the gauge.
+func (g *Gauge) Add(v float64) {
+	g.s.add(v)
+}
+
+// Value returns the current gauge value.
+func (g *Gauge) Value() float64 {
+	return g.s.load()
+}
+
+// Observe records one sample.
+func (h *Histogram) Observe(v float64) {
+	i := sort.SearchFloat64s(h.buckets, v)
+
+	h.s.mu.Lock()
+	defer h.s.mu.Unlock()
+	if i < len(h.s.counts) {
+		h.s.counts[i]++
+	}
+	h.s.sum += v
+	h.s.count++
+}
+
+// Count returns the number of samples observed.
+func (h *Histogram) Count() uint64 {
+	h.s.mu.Lock()
+	defer h.s.mu.Unlock()
+	return h.s.count
+}
+
+func (s *metricSeries) add(v float64) {
+	for {
+		old := s.value.Load()
+		updated := math.Float64bits(math.Float64frombits(old) + v)
+		if s.value.CompareAndSwap(old, updated) {
+			return
+		}
+	}
+}
+
+func (s *metricSeries) load() float64 {
+	return math.Float64frombits(s.value.Load())
+}
+
+// WritePrometheus writes every metric in the Prometheus text exposition
+// format, families sorted by name.
+func (r *MetricsRegistry) WritePrometheus(w io.Writer) error {
+	r.mu.Lock()
+	families := make([]*metricFamily, 0, len(r.families))
+	for _, f := range r.families {
+		families = append(families, f)
+	}
+	r.mu.Unlock()
+	sort.Slice(families, func(i, j int) bool {
+		return families[i].name < families[j].name
+	})
+
+	bw := bufio.NewWriter(w)
+	for _, f := range families {
+		f.write(bw)
+	}
+	return bw.Flush()
+}
+
+// Handler returns an http.Handler serving WritePrometheus, suitable for a
+// Prometheus scrape target.
+func (r *MetricsRegistry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		r.WritePrometheus(w)
+	})
+}
+
+func (f *metricFamily) write(w *bufio.Writer) {
+	f.mu.Lock()
+	series := make([]*metricSeries, 0, len(f.series))
+	for _, s := range f.series {
+		series = append(series, s)
+	}
+	f.mu.Unlock()
+	sort.Slice(series, func(i, j int) bool {
+		return strings.Join(series[i].labelValues, "\xff") < strings.Join(series[j].labelValues, "\xff")
+	})
+
+	fmt.Fprintf(w, "# HELP %s %s\n", f.name, escapeHelp(f.help))
+	fmt.Fprintf(w, "# TYPE %s %s\n", f.name, f.kind)
+	for _, s := range series {
+		if f.kind != kindHistogram {
+			fmt.Fprintf(w, "%s%s %s\n", f.name, formatLabels(f.labelNames, s.labelValues, ""), formatFloat(s.load()))
+			continue
+		}
+
+		s.mu.Lock()
+		var cumulative uint64
+		for i, upper := range f.buckets {
+			cumulative += s.counts[i]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", f.name, formatLabels(f.labelNames, s.labelValues, formatFloat(upper)), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", f.name, formatLabels(f.labelNames, s.labelValues, "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", f.name, formatLabels(f.labelNames, s.labelValues, ""), formatFloat(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", f.name, formatLabels(f.labelNames, s.labelValues, ""), s.count)
+		s.mu.Unlock()
+	}
+}
+
+// formatLabels renders {name="value",...}, adding an le label for histogram
+// buckets when le is not empty.
+func formatLabels(names, values []string, le string) string {
+	if len(names) == 0 && le == "" {
+		return ""
+	}
+
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, name := range names {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		fmt.Fprintf(&b, "%s=\"%s\"", name, escapeLabelValue(values[i]))
+	}
+	if le != "" {
+		if len(names) > 0 {
+			b.WriteByte(',')
+		}
+		fmt.Fprintf(&b, "le=\"%s\"", le)
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var (
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+func escapeHelp(s string) string {
+	return helpEscaper.Replace(s)
+}
+
+func escapeLabelValue(s string) string {
+	return labelEscaper.Replace(s)
+}
@@ -0,0 +1,88 @@
+package swissknife
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMetricsRegistryWritesPrometheusText(t *testing.T) {
+	reg := NewMetricsRegistry()
+	calls := reg.Counter("test_calls_total", "Calls made.", "method")
+	calls.With("A.B").Add(2)
+	calls.With(`quote"d`).Inc()
+	reg.Gauge("test_open", "Open things.").With().Set(3)
+	latency := reg.Histogram("test_seconds", "Latency.", []float64{0.1, 1}, "method")
+	latency.With("A.B").Observe(0.05)
+	latency.With("A.B").Observe(0.5)
+	latency.With("A.B").Observe(5)
+
+	var buf bytes.Buffer
+	require.NoError(t, reg.WritePrometheus(&buf))
+	require.Equal(t, `# HELP test_calls_total Calls made.
+# TYPE test_calls_total counter
+test_calls_total{method="A.B"} 2
+test_calls_total{method="quote\"d"} 1
+# HELP test_open Open things.
+# TYPE test_open gauge
+test_open 3
+# HELP test_seconds Latency.
+# TYPE test_seconds histogram
+test_seconds_bucket{method="A.B",le="0.1"} 1
+test_seconds_bucket{method="A.B",le="1"} 2
+test_seconds_bucket{method="A.B",le="+Inf"} 3
+test_seconds_sum{method="A.B"} 5.55
+test_seconds_count{method="A.B"} 3
+`, buf.String())
+}
+
+func TestMetricsRegistryReusesFamilies(t *testing.T) {
+	reg := NewMetricsRegistry()
+	reg.Counter("shared_total", "Shared.").With().Inc()
+	reg.Counter("shared_total", "Shared.").With().Inc()
+	require.Equal(t, float64(2), reg.Counter("shared_total", "Shared.").With().Value())
+
+	require.Panics(t, func() { reg.Gauge("shared_total", "Shared.") })
+}
+
+func TestServerAndClientMetrics(t *testing.T) {
+	pki := newTestPKI(t)
+	reg := NewMetricsRegistry()
+	s, addr := startTestServer(t, pki, WithMetrics(reg))
+	client := newTestClient(t, pki, addr, WithClientMetrics(reg))
+
+	require.Equal(t, 42, callAdd(t, client))
+	_, err := client.ConnectToRpcServerTls("TestService.Missing", nil)
+	require.Error(t, err)
+
+	serverCalls := reg.Counter("swissknife_rpc_server_calls_total", "", "method", "status")
+	require.Eventually(t, func() bool {
+		return serverCalls.With(unknownMethod, "error").Value() == 1
+	}, time.Second, 10*time.Millisecond)
+	require.Equal(t, float64(1), serverCalls.With("TestService.Add", "ok").Value())
+	require.Equal(t, float64(1), reg.Gauge("swissknife_rpc_server_open_connections", "").With().Value())
+	require.Greater(t, reg.Counter("swissknife_rpc_server_received_bytes_total", "").With().Value(), float64(0))
+
+	clientCalls := reg.Counter("swissknife_rpc_client_calls_total", "", "method", "status")
+	require.Equal(t, float64(1), clientCalls.With("TestService.Add", "ok").Value())
+	require.Equal(t, float64(1), clientCalls.With("TestService.Missing", "error").Value())
+	require.EqualValues(t, 1, reg.Histogram("swissknife_rpc_client_call_duration_seconds", "", nil, "method").With("TestService.Add").Count())
+
+	_, err = NewITlsRpcClient(pki.caCert, pki.clientCert, pki.clientKey, s.Addr().String(), "wrong-name", WithClientMetrics(reg), WithServerName("elsewhere"))
+	require.Error(t, err)
+	require.Equal(t, float64(1), reg.Counter("swissknife_rpc_client_handshake_failures_total", "").With().Value())
+	require.Eventually(t, func() bool {
+		return reg.Counter("swissknife_rpc_server_handshake_failures_total", "").With().Value() == 1
+	}, time.Second, 10*time.Millisecond)
+
+	rec := httptest.NewRecorder()
+	reg.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.True(t, strings.HasPrefix(rec.Header().Get("Content-Type"), "text/plain; version=0.0.4"))
+	require.Contains(t, rec.Body.String(), `swissknife_rpc_server_calls_total{method="TestService.Add",status="ok"} 1`)
+}
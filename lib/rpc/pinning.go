@@ -0,0 +1,68 @@
+package swissknife
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrPinMismatch is returned when the server certificate chains to a trusted
+// CA but its public key matches none of the pins given to WithServerPins.
+var ErrPinMismatch = errors.New("rpc: server public key does not match any pin")
+
+// spkiPinPrefix is the optional prefix of pins in the form used by HPKP and
+// curl's --pinnedpubkey.
+const spkiPinPrefix = "sha256//"
+
+// SPKIPin returns the pin of cert: the base64 encoded SHA-256 hash of its
+// DER encoded SubjectPublicKeyInfo. The same value is printed by
+//
+//	openssl x509 -in cert.pem -pubkey -noout | openssl pkey -pubin -outform der | openssl dgst -sha256 -binary | base64
+func SPKIPin(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// WithServerPins requires the server's leaf certificate to carry one of the
+// given public keys, in addition to chaining to the CA. Pins are formatted
+// as returned by SPKIPin, optionally prefixed with "sha256//". Passing the
+// current and the next key allows a server key to be rotated without
+// breaking clients.
+func WithServerPins(pins ...string) ClientOption {
+	return func(c *tlsRpcClient) {
+		c.pins = append(c.pins, pins...)
+	}
+}
+
+// parsePins decodes pins into SHA-256 hashes.
+func parsePins(pins []string) ([][sha256.Size]byte, error) {
+	hashes := make([][sha256.Size]byte, 0, len(pins))
+	for _, pin := range pins {
+		raw, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(pin, spkiPinPrefix))
+		if err != nil || len(raw) != sha256.Size {
+			return nil, fmt.Errorf("invalid SPKI pin %q: want a base64 encoded SHA-256 hash", pin)
+		}
+		hashes = append(hashes, [sha256.Size]byte(raw))
+	}
+	return hashes, nil
+}
+
+// verifyPins returns a tls.Config.VerifyPeerCertificate callback that checks
+// the verified leaf certificate against the pinned hashes.
+func verifyPins(pins [][sha256.Size]byte) func([][]byte, [][]*x509.Certificate) error {
+	return func(_ [][]byte, verifiedChains [][]*x509.Certificate) error {
+		if len(verifiedChains) == 0 || len(verifiedChains[0]) == 0 {
+			return ErrPinMismatch
+		}
+		sum := sha256.Sum256(verifiedChains[0][0].RawSubjectPublicKeyInfo)
+		for _, pin := range pins {
+			if sum == pin {
+				return nil
+			}
+		}
+		return fmt.Errorf("%w (got %s)", ErrPinMismatch, base64.StdEncoding.EncodeToString(sum[:]))
+	}
+}
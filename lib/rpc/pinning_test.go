@@ -0,0 +1,38 @@
+package swissknife
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestClientAcceptsPinnedServer(t *testing.T) {
+	pki := newTestPKI(t)
+	_, addr := startTestServer(t, pki)
+	next := base64.StdEncoding.EncodeToString(make([]byte, sha256.Size))
+
+	client := newTestClient(t, pki, addr, WithServerPins(next, "sha256//"+SPKIPin(leaf(t, pki.serverCert))))
+	require.Equal(t, 42, callAdd(t, client))
+}
+
+func TestClientRejectsUnpinnedServer(t *testing.T) {
+	pki := newTestPKI(t)
+	_, addr := startTestServer(t, pki)
+	other := base64.StdEncoding.EncodeToString(make([]byte, sha256.Size))
+
+	_, err := NewITlsRpcClient(pki.caCert, pki.clientCert, pki.clientKey, addr, "test-client", WithServerPins(other))
+	require.Error(t, err)
+	require.True(t, errors.Is(err, ErrPinMismatch), "got %v", err)
+}
+
+func TestClientRejectsMalformedPin(t *testing.T) {
+	pki := newTestPKI(t)
+	_, addr := startTestServer(t, pki)
+
+	_, err := NewITlsRpcClient(pki.caCert, pki.clientCert, pki.clientKey, addr, "test-client", WithServerPins("not-a-pin"))
+	require.Error(t, err)
+	require.False(t, errors.Is(err, ErrPinMismatch))
+}
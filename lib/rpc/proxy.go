@@ -0,0 +1,237 @@
+package swissknife
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// WithProxy makes the client reach the server through the HTTP proxy
+// returned by proxy for the server's address, by sending it a CONNECT
+// request before the TLS handshake. A nil URL connects directly. Proxy URLs
+// may carry basic auth credentials, and use the http or https scheme. Use
+// ProxyFromEnvironment to honour HTTPS_PROXY and NO_PROXY.
+func WithProxy(proxy func(address string) (*url.URL, error)) ClientOption {
+	return func(c *tlsRpcClient) {
+		c.proxy = proxy
+	}
+}
+
+// ProxyURL returns a proxy function for WithProxy that always returns u.
+func ProxyURL(u *url.URL) func(string) (*url.URL, error) {
+	return func(string) (*url.URL, error) {
+		return u, nil
+	}
+}
+
+// ProxyFromEnvironment is a proxy function for WithProxy that returns the
+// proxy named by HTTPS_PROXY (or https_proxy), unless address matches
+// NO_PROXY (or no_proxy). NO_PROXY is a comma separated list of host names,
+// which also match their subdomains, ".domain" entries matching subdomains
+// only, IP addresses, CIDR ranges and "*" for every address; entries may
+// carry a port. Unlike net/http, loopback addresses are proxied unless
+// listed. The environment is read on every call.
+func ProxyFromEnvironment(address string) (*url.URL, error) {
+	raw := getenvAny("HTTPS_PROXY", "https_proxy")
+	if raw == "" || noProxy(address, getenvAny("NO_PROXY", "no_proxy")) {
+		return nil, nil
+	}
+	if !strings.Contains(raw, "://") {
+		raw = "http://" + raw
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy address %q: %w", raw, err)
+	}
+	return u, nil
+}
+
+func getenvAny(names ...string) string {
+	for _, name := range names {
+		if value := os.Getenv(name); value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+// noProxy reports whether address is excluded from proxying by list, in the
+// NO_PROXY format.
+func noProxy(address, list string) bool {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		host = address
+	}
+	host = strings.ToLower(host)
+	ip := net.ParseIP(host)
+
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		switch {
+		case entry == "":
+			continue
+		case entry == "*":
+			return true
+		}
+		if _, cidr, err := net.ParseCIDR(entry); err == nil {
+			if ip != nil && cidr.Contains(ip) {
+				return true
+			}
+			continue
+		}
+
+		entryHost, entryPort, err := net.SplitHostPort(entry)
+		if err != nil {
+			entryHost, entryPort = entry, ""
+		}
+		if entryPort != "" && entryPort != port {
+			continue
+		}
+		entryHost = strings.Trim(entryHost, "[]")
+		if entryIP := net.ParseIP(entryHost); entryIP != nil {
+			if ip != nil && entryIP.Equal(ip) {
+				return true
+			}
+			continue
+		}
+		entryHost = strings.TrimPrefix(entryHost, "*")
+		if strings.HasPrefix(entryHost, ".") {
+			if strings.HasSuffix(host, entryHost) {
+				return true
+			}
+			continue
+		}
+		if host == entryHost || strings.HasSuffix(host, "."+entryHost) {
+			return true
+		}
+	}
+	return false
+}
+
+// dialConn opens the connection the TLS handshake runs over: through the
+// proxy chosen for address, if any, and with the dialer set by
+// WithDialContext or the client's default dialer.
+func (c *tlsRpcClient) dialConn(ctx context.Context, address string) (net.Conn, error) {
+	dial := c.dial
+	if dial == nil {
+		dial = c.timeouts.dialer().DialContext
+	}
+
+	proxy, err := c.proxyFor(address)
+	if err != nil {
+		return nil, err
+	}
+	if proxy == nil {
+		return dial(ctx, c.network, address)
+	}
+	c.log().Debugf("Connecting to %s for client %s through proxy %s", address, c.name, proxy.Redacted())
+	return dialProxy(ctx, dial, proxy, address)
+}
+
+// proxyFor returns the proxy to reach address through, or nil. Only TCP
+// connections are proxied.
+func (c *tlsRpcClient) proxyFor(address string) (*url.URL, error) {
+	if c.proxy == nil || !strings.HasPrefix(c.network, "tcp") {
+		return nil, nil
+	}
+	proxy, err := c.proxy(address)
+	if err != nil {
+		return nil, fmt.Errorf("failed to choose proxy: %w", err)
+	}
+	return proxy, nil
+}
+
+// dialProxy connects to proxy with dial and asks it to CONNECT to address,
+// returning the tunnelled connection.
+func dialProxy(ctx context.Context, dial func(ctx context.Context, network, address string) (net.Conn, error), proxy *url.URL, address string) (net.Conn, error) {
+	if proxy.Scheme != "http" && proxy.Scheme != "https" {
+		return nil, fmt.Errorf("unsupported proxy scheme %q", proxy.Scheme)
+	}
+	if proxy.Hostname() == "" {
+		return nil, errors.New("proxy address has no host")
+	}
+	proxyAddr := proxy.Host
+	if proxy.Port() == "" {
+		port := "80"
+		if proxy.Scheme == "https" {
+			port = "443"
+		}
+		proxyAddr = net.JoinHostPort(proxy.Hostname(), port)
+	}
+
+	conn, err := dial(ctx, "tcp", proxyAddr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to proxy %s: %w", proxy.Redacted(), err)
+	}
+	if d, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(d)
+	}
+	if proxy.Scheme == "https" {
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: proxy.Hostname()})
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("TLS handshake with proxy %s failed: %w", proxy.Redacted(), err)
+		}
+		conn = tlsConn
+	}
+
+	tunnel, err := connect(conn, proxy, address)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("proxy %s: %w", proxy.Redacted(), err)
+	}
+	conn.SetDeadline(time.Time{})
+	return tunnel, nil
+}
+
+// connect sends the CONNECT request for address over conn and reads the
+// proxy's answer.
+func connect(conn net.Conn, proxy *url.URL, address string) (net.Conn, error) {
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: address},
+		Host:   address,
+		Header: make(http.Header),
+	}
+	if user := proxy.User; user != nil {
+		password, _ := user.Password()
+		credentials := base64.StdEncoding.EncodeToString([]byte(user.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+	if err := req.Write(conn); err != nil {
+		return nil, fmt.Errorf("failed to send CONNECT: %w", err)
+	}
+
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CONNECT response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("CONNECT to %s refused with %s", address, resp.Status)
+	}
+	if reader.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, r: reader}, nil
+	}
+	return conn, nil
+}
+
+// bufferedConn is a connection whose first bytes were already read into r.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
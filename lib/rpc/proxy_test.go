@@ -0,0 +1,167 @@
+package swissknife
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// testProxy is a minimal HTTP CONNECT proxy that records the addresses it
+// was asked to reach.
+type testProxy struct {
+	listener net.Listener
+
+	// auth is the Proxy-Authorization header required, if set.
+	auth string
+
+	mu      sync.Mutex
+	targets []string
+}
+
+func startTestProxy(t *testing.T, auth string) *testProxy {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+
+	p := &testProxy{listener: listener, auth: auth}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go p.serve(conn)
+		}
+	}()
+	return p
+}
+
+func (p *testProxy) URL() *url.URL {
+	return &url.URL{Scheme: "http", Host: p.listener.Addr().String()}
+}
+
+func (p *testProxy) Targets() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]string(nil), p.targets...)
+}
+
+func (p *testProxy) serve(conn net.Conn) {
+	defer conn.Close()
+
+	reader := bufio.NewReader(conn)
+	req, err := http.ReadRequest(reader)
+	if err != nil {
+		return
+	}
+	if req.Method != http.MethodConnect {
+		io.WriteString(conn, "HTTP/1.1 405 Method Not Allowed\r\nContent-Length: 0\r\n\r\n")
+		return
+	}
+	if p.auth != "" && req.Header.Get("Proxy-Authorization") != p.auth {
+		io.WriteString(conn, "HTTP/1.1 407 Proxy Authentication Required\r\nProxy-Authenticate: Basic\r\nContent-Length: 0\r\n\r\n")
+		return
+	}
+
+	p.mu.Lock()
+	p.targets = append(p.targets, req.Host)
+	p.mu.Unlock()
+
+	target, err := net.Dial("tcp", req.Host)
+	if err != nil {
+		io.WriteString(conn, "HTTP/1.1 502 Bad Gateway\r\nContent-Length: 0\r\n\r\n")
+		return
+	}
+	defer target.Close()
+	io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+
+	go func() {
+		io.Copy(target, reader)
+		target.Close()
+	}()
+	io.Copy(conn, target)
+}
+
+func TestClientConnectsThroughProxy(t *testing.T) {
+	pki := newTestPKI(t)
+	_, addr := startTestServer(t, pki)
+	proxy := startTestProxy(t, "")
+
+	client := newTestClient(t, pki, addr, WithProxy(ProxyURL(proxy.URL())))
+	require.Equal(t, 42, callAdd(t, client))
+	require.Equal(t, []string{addr}, proxy.Targets())
+
+	direct := newTestClient(t, pki, addr, WithProxy(ProxyURL(nil)))
+	require.Equal(t, 42, callAdd(t, direct))
+	require.Len(t, proxy.Targets(), 1)
+}
+
+func TestProxyBasicAuth(t *testing.T) {
+	pki := newTestPKI(t)
+	_, addr := startTestServer(t, pki)
+	// "agent:s3cret"
+	proxy := startTestProxy(t, "Basic YWdlbnQ6czNjcmV0")
+
+	_, err := NewITlsRpcClient(pki.caCert, pki.clientCert, pki.clientKey, addr, "anonymous", WithProxy(ProxyURL(proxy.URL())))
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "407")
+	require.NotContains(t, err.Error(), "s3cret")
+
+	proxyURL := proxy.URL()
+	proxyURL.User = url.UserPassword("agent", "s3cret")
+	client := newTestClient(t, pki, addr, WithProxy(ProxyURL(proxyURL)))
+	require.Equal(t, 42, callAdd(t, client))
+	require.Len(t, proxy.Targets(), 1)
+}
+
+func TestProxyFromEnvironment(t *testing.T) {
+	pki := newTestPKI(t)
+	_, addr := startTestServer(t, pki)
+	proxy := startTestProxy(t, "")
+
+	t.Setenv("HTTPS_PROXY", proxy.listener.Addr().String())
+	t.Setenv("https_proxy", "")
+	t.Setenv("NO_PROXY", "")
+	t.Setenv("no_proxy", "")
+	client := newTestClient(t, pki, addr, WithProxy(ProxyFromEnvironment))
+	require.Equal(t, 42, callAdd(t, client))
+	require.Len(t, proxy.Targets(), 1)
+
+	t.Setenv("NO_PROXY", "example.com, localhost")
+	client = newTestClient(t, pki, addr, WithProxy(ProxyFromEnvironment))
+	require.Equal(t, 42, callAdd(t, client))
+	require.Len(t, proxy.Targets(), 1)
+}
+
+func TestNoProxy(t *testing.T) {
+	for _, tc := range []struct {
+		address, list string
+		want          bool
+	}{
+		{"rpc.example.com:443", "", false},
+		{"rpc.example.com:443", "*", true},
+		{"rpc.example.com:443", "example.com", true},
+		{"example.com:443", "example.com", true},
+		{"example.com:443", ".example.com", false},
+		{"rpc.example.com:443", ".example.com", true},
+		{"rpc.example.com:443", "*.example.com", true},
+		{"badexample.com:443", "example.com", false},
+		{"rpc.example.com:443", "example.com:8443", false},
+		{"rpc.example.com:8443", "example.com:8443", true},
+		{"10.1.2.3:443", "10.0.0.0/8", true},
+		{"192.168.1.1:443", "10.0.0.0/8", false},
+		{"[::1]:443", "::1", true},
+		{"[::1]:443", "[::1]:443", true},
+		{"RPC.Example.COM:443", "example.com", true},
+	} {
+		require.Equal(t, tc.want, noProxy(tc.address, tc.list), "%s with NO_PROXY=%q", tc.address, tc.list)
+	}
+}
@@ -0,0 +1,419 @@
+package swissknife
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
+
+// PubSubServiceName is the name a PubSub registers under. Clients call its
+// Subscribe, Unsubscribe and Publish methods through the Subscribe,
+// Unsubscribe and Publish functions.
+const PubSubServiceName = "PubSub"
+
+// pubSubReceiver is the client service messages are delivered to.
+const pubSubReceiver = "PubSubReceiver"
+
+// DefaultPubSubQueueSize is the number of messages queued per subscriber
+// when PubSubConfig.QueueSize is zero.
+const DefaultPubSubQueueSize = 64
+
+// DropPolicy decides what happens to a message published to a subscriber
+// whose queue is full.
+type DropPolicy int
+
+const (
+	// DropOldest discards the oldest queued message to make room.
+	DropOldest DropPolicy = iota
+
+	// DropNewest discards the message being published.
+	DropNewest
+
+	// Block makes the publisher wait until the subscriber has room, which
+	// slows publishers down to the pace of the slowest subscriber.
+	Block
+)
+
+// Message is a message published on a topic.
+type Message struct {
+	Topic string `json:"topic"`
+	Data  []byte `json:"data"`
+
+	// Publisher is the certificate subject of the client that published
+	// the message, or empty when the server did.
+	Publisher string `json:"publisher,omitempty"`
+}
+
+// PubSubConfig configures a PubSub.
+type PubSubConfig struct {
+	// QueueSize is the number of messages buffered for each subscriber.
+	QueueSize int
+
+	// DropPolicy applies when a subscriber's queue is full.
+	DropPolicy DropPolicy
+
+	// AuthorizePublish decides whether a client may publish to topic. When
+	// nil only the server publishes, and clients get ErrPermissionDenied.
+	AuthorizePublish func(caller ConnInfo, topic string) error
+
+	// AuthorizeSubscribe decides whether a client may subscribe to topic.
+	// When nil any client may.
+	AuthorizeSubscribe func(caller ConnInfo, topic string) error
+}
+
+// PubSub delivers messages published on named topics to the clients
+// subscribed to them. Subscribers must connect in bidirectional mode, see
+// WithTopicHandler, and each has its own queue, drained in order.
+type PubSub struct {
+	cfg     PubSubConfig
+	dropped atomic.Uint64
+
+	mu     sync.Mutex
+	subs   map[*Peer]*subscriber
+	topics map[string]map[*subscriber]struct{}
+	logger Logger
+}
+
+// subscriber is a connection subscribed to one or more topics.
+type subscriber struct {
+	peer  *Peer
+	name  string
+	queue chan Message
+
+	// mu serialises enqueueing under DropOldest.
+	mu sync.Mutex
+
+	// dropped counts the messages discarded for this subscriber.
+	dropped atomic.Uint64
+
+	// topics is guarded by PubSub.mu.
+	topics map[string]bool
+}
+
+// NewPubSub returns a PubSub. Register it on a server created with
+// WithBidirectional.
+func NewPubSub(cfg PubSubConfig) *PubSub {
+	if cfg.QueueSize <= 0 {
+		cfg.QueueSize = DefaultPubSubQueueSize
+	}
+	return &PubSub{
+		cfg:    cfg,
+		subs:   make(map[*Peer]*subscriber),
+		topics: make(map[string]map[*subscriber]struct{}),
+		logger: NewDefaultLogger(),
+	}
+}
+
+// Register adds the PubSub to server under PubSubServiceName.
+func (ps *PubSub) Register(server ITlsRpcServer) error {
+	return server.RegisterMethod(PubSubServiceName, &pubSubService{ps: ps})
+}
+
+// SetLogger sets the logger that records subscriptions and dropped
+// messages.
+func (ps *PubSub) SetLogger(logger Logger) {
+	ps.mu.Lock()
+	ps.logger = logger
+	ps.mu.Unlock()
+}
+
+func (ps *PubSub) log() Logger {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	return ps.logger
+}
+
+// Subscribers returns the number of connections subscribed to topic.
+func (ps *PubSub) Subscribers(topic string) int {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	return len(ps.topics[topic])
+}
+
+// Dropped returns the number of messages discarded because a subscriber's
+// queue was full.
+func (ps *PubSub) Dropped() uint64 {
+	return ps.dropped.Load()
+}
+
+// Publish publishes data on topic from the server.
+func (ps *PubSub) Publish(topic string, data []byte) error {
+	return ps.PublishContext(context.Background(), topic, data)
+}
+
+// PublishContext is like Publish but, under the Block policy, stops waiting
+// for full queues when ctx is done.
+func (ps *PubSub) PublishContext(ctx context.Context, topic string, data []byte) error {
+	return ps.publish(ctx, Message{Topic: topic, Data: data})
+}
+
+func (ps *PubSub) publish(ctx context.Context, msg Message) error {
+	if msg.Topic == "" {
+		return errors.New("pubsub: topic must not be empty")
+	}
+
+	ps.mu.Lock()
+	subs := make([]*subscriber, 0, len(ps.topics[msg.Topic]))
+	for sub := range ps.topics[msg.Topic] {
+		subs = append(subs, sub)
+	}
+	ps.mu.Unlock()
+
+	for _, sub := range subs {
+		if err := ps.enqueue(ctx, sub, msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// enqueue queues msg for sub according to the drop policy.
+func (ps *PubSub) enqueue(ctx context.Context, sub *subscriber, msg Message) error {
+	switch ps.cfg.DropPolicy {
+	case Block:
+		select {
+		case sub.queue <- msg:
+		case <-sub.peer.Done():
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		return nil
+
+	case DropNewest:
+		select {
+		case sub.queue <- msg:
+		default:
+			ps.drop(sub, msg)
+		}
+		return nil
+	}
+
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
+	for {
+		select {
+		case sub.queue <- msg:
+			return nil
+		default:
+		}
+		select {
+		case old := <-sub.queue:
+			ps.drop(sub, old)
+		default:
+		}
+	}
+}
+
+// drop records that msg was discarded for sub, warning on the first message
+// each subscriber loses.
+func (ps *PubSub) drop(sub *subscriber, msg Message) {
+	ps.dropped.Add(1)
+	if sub.dropped.Add(1) == 1 {
+		ps.log().Warnf("Subscriber %s is falling behind; dropping messages on %s", sub.name, msg.Topic)
+	}
+	ps.log().Debugf("Dropped message on %s for subscriber %s", msg.Topic, sub.name)
+}
+
+// subscribe adds the connection of caller to topics, starting its delivery
+// loop on its first subscription.
+func (ps *PubSub) subscribe(caller ConnInfo, topics []string) error {
+	if caller.Peer == nil {
+		return errors.New("pubsub: subscribing requires a bidirectional connection, see WithTopicHandler")
+	}
+	for _, topic := range topics {
+		if topic == "" {
+			return errors.New("pubsub: topic must not be empty")
+		}
+		if ps.cfg.AuthorizeSubscribe != nil {
+			if err := ps.cfg.AuthorizeSubscribe(caller, topic); err != nil {
+				return fmt.Errorf("%w: %v", ErrPermissionDenied, err)
+			}
+		}
+	}
+
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	sub, ok := ps.subs[caller.Peer]
+	if !ok {
+		sub = &subscriber{
+			peer:   caller.Peer,
+			name:   callerName(caller),
+			queue:  make(chan Message, ps.cfg.QueueSize),
+			topics: make(map[string]bool),
+		}
+		ps.subs[caller.Peer] = sub
+		go ps.deliver(sub)
+	}
+	for _, topic := range topics {
+		sub.topics[topic] = true
+		if ps.topics[topic] == nil {
+			ps.topics[topic] = make(map[*subscriber]struct{})
+		}
+		ps.topics[topic][sub] = struct{}{}
+	}
+	ps.logger.Infof("%s subscribed to %v", sub.name, topics)
+	return nil
+}
+
+// unsubscribe removes the connection of caller from topics.
+func (ps *PubSub) unsubscribe(caller ConnInfo, topics []string) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	sub, ok := ps.subs[caller.Peer]
+	if !ok {
+		return
+	}
+	for _, topic := range topics {
+		ps.removeTopic(sub, topic)
+	}
+}
+
+// removeTopic must be called with mu held.
+func (ps *PubSub) removeTopic(sub *subscriber, topic string) {
+	delete(sub.topics, topic)
+	delete(ps.topics[topic], sub)
+	if len(ps.topics[topic]) == 0 {
+		delete(ps.topics, topic)
+	}
+}
+
+// deliver sends the messages queued for sub, one at a time and in order,
+// until its connection closes.
+func (ps *PubSub) deliver(sub *subscriber) {
+	defer ps.remove(sub)
+	for {
+		select {
+		case msg := <-sub.queue:
+			data, err := json.Marshal(msg)
+			if err != nil {
+				ps.log().Errorf("Failed to encode message on %s: %v", msg.Topic, err)
+				continue
+			}
+			if _, err := sub.peer.Call(pubSubReceiver+".Deliver", data); err != nil {
+				if errors.Is(err, ErrPeerClosed) {
+					return
+				}
+				ps.log().Warnf("Failed to deliver message on %s to %s: %v", msg.Topic, sub.name, err)
+			}
+		case <-sub.peer.Done():
+			return
+		}
+	}
+}
+
+// remove forgets every subscription of sub.
+func (ps *PubSub) remove(sub *subscriber) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	for topic := range sub.topics {
+		ps.removeTopic(sub, topic)
+	}
+	delete(ps.subs, sub.peer)
+	ps.logger.Debugf("Removed subscriber %s", sub.name)
+}
+
+// topicsRequest is the JSON encoded argument of PubSub.Subscribe and
+// PubSub.Unsubscribe.
+type topicsRequest struct {
+	Topics []string `json:"topics"`
+}
+
+// pubSubService exposes a PubSub as an RPC service.
+type pubSubService struct {
+	ps *PubSub
+}
+
+// Subscribe subscribes the calling connection to the JSON encoded
+// topicsRequest in req.
+func (s *pubSubService) Subscribe(req *Request, reply *[]byte) error {
+	var args topicsRequest
+	if err := json.Unmarshal(req.Args, &args); err != nil {
+		return fmt.Errorf("invalid subscribe request: %w", err)
+	}
+	return s.ps.subscribe(req.Conn, args.Topics)
+}
+
+// Unsubscribe is the reverse of Subscribe.
+func (s *pubSubService) Unsubscribe(req *Request, reply *[]byte) error {
+	var args topicsRequest
+	if err := json.Unmarshal(req.Args, &args); err != nil {
+		return fmt.Errorf("invalid unsubscribe request: %w", err)
+	}
+	s.ps.unsubscribe(req.Conn, args.Topics)
+	return nil
+}
+
+// Publish publishes the JSON encoded Message in req for the caller. Under
+// the Block policy it stops waiting for full queues once the caller's
+// deadline passes or it disconnects.
+func (s *pubSubService) Publish(req *Request, reply *[]byte) error {
+	var msg Message
+	if err := json.Unmarshal(req.Args, &msg); err != nil {
+		return fmt.Errorf("invalid publish request: %w", err)
+	}
+	if s.ps.cfg.AuthorizePublish == nil {
+		return fmt.Errorf("%w: clients may not publish", ErrPermissionDenied)
+	}
+	if err := s.ps.cfg.AuthorizePublish(req.Conn, msg.Topic); err != nil {
+		return fmt.Errorf("%w: %v", ErrPermissionDenied, err)
+	}
+	msg.Publisher = req.Identity()
+	return s.ps.publish(req.Context(), msg)
+}
+
+// WithTopicHandler makes the client receive the messages of the topics it
+// subscribes to with Subscribe. Messages are handed to handler one at a
+// time, in the order they were queued. The client connects in bidirectional
+// mode, so the server must be created with WithBidirectional.
+func WithTopicHandler(handler func(msg Message)) ClientOption {
+	return WithClientService(pubSubReceiver, &topicReceiver{handler: handler})
+}
+
+// topicReceiver is the client service messages are delivered to.
+type topicReceiver struct {
+	handler func(msg Message)
+}
+
+// Deliver hands the JSON encoded Message in req to the handler.
+func (r *topicReceiver) Deliver(req *Request, reply *[]byte) error {
+	var msg Message
+	if err := json.Unmarshal(req.Args, &msg); err != nil {
+		return fmt.Errorf("invalid message: %w", err)
+	}
+	r.handler(msg)
+	return nil
+}
+
+// Subscribe subscribes client, which must have been created with
+// WithTopicHandler, to topics.
+func Subscribe(client ITlsRpcClient, topics ...string) error {
+	return callTopics(client, "Subscribe", topics)
+}
+
+// Unsubscribe stops the delivery of topics to client.
+func Unsubscribe(client ITlsRpcClient, topics ...string) error {
+	return callTopics(client, "Unsubscribe", topics)
+}
+
+func callTopics(client ITlsRpcClient, method string, topics []string) error {
+	args, err := json.Marshal(topicsRequest{Topics: topics})
+	if err != nil {
+		return err
+	}
+	_, err = client.ConnectToRpcServerTls(PubSubServiceName+"."+method, args)
+	return err
+}
+
+// Publish publishes data on topic through client. The server must allow it
+// with PubSubConfig.AuthorizePublish.
+func Publish(client ITlsRpcClient, topic string, data []byte) error {
+	args, err := json.Marshal(Message{Topic: topic, Data: data})
+	if err != nil {
+		return err
+	}
+	_, err = client.ConnectToRpcServerTls(PubSubServiceName+".Publish", args)
+	return err
+}
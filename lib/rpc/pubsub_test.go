@@ -0,0 +1,221 @@
+package swissknife
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// startPubSubServer starts a bidirectional test server running ps.
+func startPubSubServer(t *testing.T, pki *testPKI, ps *PubSub) string {
+	t.Helper()
+
+	s, addr := startTestServer(t, pki, WithBidirectional())
+	ps.SetLogger(newTestLogger(&bytes.Buffer{}, &bytes.Buffer{}, LogLevelDebug))
+	require.NoError(t, ps.Register(s))
+	return addr
+}
+
+// receive returns the next message delivered to messages.
+func receive(t *testing.T, messages <-chan Message) Message {
+	t.Helper()
+
+	select {
+	case msg := <-messages:
+		return msg
+	case <-time.After(2 * time.Second):
+		t.Fatal("no message delivered")
+		return Message{}
+	}
+}
+
+func TestPubSubDeliversToSubscribers(t *testing.T) {
+	pki := newTestPKI(t)
+	ps := NewPubSub(PubSubConfig{})
+	addr := startPubSubServer(t, pki, ps)
+
+	messages := make(chan Message, 10)
+	client := newTestClient(t, pki, addr, WithTopicHandler(func(msg Message) { messages <- msg }))
+	require.NoError(t, Subscribe(client, "config", "alerts"))
+	require.Equal(t, 1, ps.Subscribers("config"))
+
+	for i := 0; i < 3; i++ {
+		require.NoError(t, ps.Publish("config", []byte(fmt.Sprint(i))))
+	}
+	require.NoError(t, ps.Publish("other", []byte("ignored")))
+	for i := 0; i < 3; i++ {
+		msg := receive(t, messages)
+		require.Equal(t, "config", msg.Topic)
+		require.Equal(t, fmt.Sprint(i), string(msg.Data))
+		require.Empty(t, msg.Publisher)
+	}
+
+	require.NoError(t, Unsubscribe(client, "config"))
+	require.Equal(t, 0, ps.Subscribers("config"))
+	require.NoError(t, ps.Publish("config", []byte("late")))
+	require.NoError(t, ps.Publish("alerts", []byte("fire")))
+	require.Equal(t, "fire", string(receive(t, messages).Data))
+
+	client.CloseClient()
+	require.Eventually(t, func() bool { return ps.Subscribers("alerts") == 0 }, 2*time.Second, 10*time.Millisecond)
+}
+
+func TestPubSubClientPublishing(t *testing.T) {
+	pki := newTestPKI(t)
+	ps := NewPubSub(PubSubConfig{
+		AuthorizePublish: func(caller ConnInfo, topic string) error {
+			if topic != "chat" {
+				return errors.New("read only topic")
+			}
+			return nil
+		},
+	})
+	addr := startPubSubServer(t, pki, ps)
+
+	messages := make(chan Message, 10)
+	subscriber := newTestClient(t, pki, addr, WithTopicHandler(func(msg Message) { messages <- msg }))
+	require.NoError(t, Subscribe(subscriber, "chat"))
+
+	publisher := newTestClient(t, pki, addr)
+	require.NoError(t, Publish(publisher, "chat", []byte("hello")))
+	msg := receive(t, messages)
+	require.Equal(t, "hello", string(msg.Data))
+	require.Equal(t, "CN=test-client", msg.Publisher)
+
+	require.ErrorIs(t, Publish(publisher, "config", []byte("x")), ErrPermissionDenied)
+
+	// Subscribing needs a connection the server can deliver to.
+	require.Error(t, Subscribe(publisher, "chat"))
+}
+
+func TestPubSubClientsMayNotPublishByDefault(t *testing.T) {
+	pki := newTestPKI(t)
+	addr := startPubSubServer(t, pki, NewPubSub(PubSubConfig{}))
+
+	client := newTestClient(t, pki, addr)
+	require.ErrorIs(t, Publish(client, "config", []byte("x")), ErrPermissionDenied)
+}
+
+// slowSubscriber subscribes to "jobs" with a handler that holds the first
+// message until release is closed, and waits for that message to arrive so
+// that later ones queue up.
+func slowSubscriber(t *testing.T, pki *testPKI, addr string, ps *PubSub) (received chan string, release chan struct{}) {
+	t.Helper()
+
+	received = make(chan string, 10)
+	release = make(chan struct{})
+	client := newTestClient(t, pki, addr, WithTopicHandler(func(msg Message) {
+		received <- string(msg.Data)
+		<-release
+	}))
+	require.NoError(t, Subscribe(client, "jobs"))
+	require.NoError(t, ps.Publish("jobs", []byte("1")))
+	require.Equal(t, "1", <-received)
+	return received, release
+}
+
+func TestPubSubDropPolicies(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		policy DropPolicy
+		want   []string
+	}{
+		{"oldest", DropOldest, []string{"4", "5"}},
+		{"newest", DropNewest, []string{"2", "3"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			pki := newTestPKI(t)
+			ps := NewPubSub(PubSubConfig{QueueSize: 2, DropPolicy: tc.policy})
+			addr := startPubSubServer(t, pki, ps)
+			received, release := slowSubscriber(t, pki, addr, ps)
+			var warnings bytes.Buffer
+			ps.SetLogger(newTestLogger(&bytes.Buffer{}, &warnings, LogLevelWarn))
+
+			for _, data := range []string{"2", "3", "4", "5"} {
+				require.NoError(t, ps.Publish("jobs", []byte(data)))
+			}
+			require.Equal(t, uint64(2), ps.Dropped())
+			require.Equal(t, 1, strings.Count(warnings.String(), "is falling behind"))
+
+			close(release)
+			for _, want := range tc.want {
+				select {
+				case got := <-received:
+					require.Equal(t, want, got)
+				case <-time.After(2 * time.Second):
+					t.Fatalf("message %s not delivered", want)
+				}
+			}
+		})
+	}
+}
+
+func TestPubSubBlockAppliesBackpressure(t *testing.T) {
+	pki := newTestPKI(t)
+	ps := NewPubSub(PubSubConfig{QueueSize: 1, DropPolicy: Block})
+	addr := startPubSubServer(t, pki, ps)
+	received, release := slowSubscriber(t, pki, addr, ps)
+
+	require.NoError(t, ps.Publish("jobs", []byte("2")))
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	require.ErrorIs(t, ps.PublishContext(ctx, "jobs", []byte("3")), context.DeadlineExceeded)
+
+	close(release)
+	require.Equal(t, "2", <-received)
+	require.NoError(t, ps.Publish("jobs", []byte("4")))
+	require.Equal(t, "4", <-received)
+	require.Zero(t, ps.Dropped())
+}
+
+func TestPubSubBlockedClientPublishHonoursDeadline(t *testing.T) {
+	pki := newTestPKI(t)
+	ps := NewPubSub(PubSubConfig{
+		QueueSize:        1,
+		DropPolicy:       Block,
+		AuthorizePublish: func(ConnInfo, string) error { return nil },
+	})
+	addr := startPubSubServer(t, pki, ps)
+	received, release := slowSubscriber(t, pki, addr, ps)
+	require.NoError(t, ps.Publish("jobs", []byte("2")))
+
+	args, err := json.Marshal(Message{Topic: "jobs", Data: []byte("3")})
+	require.NoError(t, err)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	publisher := newTestClient(t, pki, addr)
+	_, err = publisher.ConnectToRpcServerTlsContext(ctx, PubSubServiceName+".Publish", args)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+
+	// Wait for the server to give up too: the abandoned message must not be
+	// delivered once the subscriber catches up.
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	require.Equal(t, "2", <-received)
+	require.NoError(t, ps.Publish("jobs", []byte("4")))
+	require.Equal(t, "4", <-received)
+}
+
+func TestPubSubWarnsOncePerSubscriber(t *testing.T) {
+	pki := newTestPKI(t)
+	ps := NewPubSub(PubSubConfig{QueueSize: 1, DropPolicy: DropNewest})
+	addr := startPubSubServer(t, pki, ps)
+	_, releaseFirst := slowSubscriber(t, pki, addr, ps)
+	defer close(releaseFirst)
+	_, releaseSecond := slowSubscriber(t, pki, addr, ps)
+	defer close(releaseSecond)
+
+	var warnings bytes.Buffer
+	ps.SetLogger(newTestLogger(&bytes.Buffer{}, &warnings, LogLevelWarn))
+	for _, data := range []string{"2", "3", "4"} {
+		require.NoError(t, ps.Publish("jobs", []byte(data)))
+	}
+	require.Equal(t, 2, strings.Count(warnings.String(), "is falling behind"))
+}
@@ -0,0 +1,277 @@
+package swissknife
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrResourceExhausted matches every *ResourceExhaustedError with errors.Is.
+var ErrResourceExhausted = errors.New("rpc: resource exhausted")
+
+// limiterSweepInterval is how often idle rate limit entries are discarded.
+const limiterSweepInterval = time.Minute
+
+// ResourceExhaustedError is returned when a client exceeds a rate limit or
+// quota. RetryAfter is the earliest time at which a retry can succeed.
+type ResourceExhaustedError struct {
+	Reason     string
+	RetryAfter time.Duration
+}
+
+func (e *ResourceExhaustedError) Error() string {
+	return fmt.Sprintf("%s: %s, retry after %s", ErrResourceExhausted, e.Reason, e.RetryAfter)
+}
+
+func (e *ResourceExhaustedError) Is(target error) bool {
+	return target == ErrResourceExhausted
+}
+
+// parseResourceExhausted rebuilds a ResourceExhaustedError from the message a
+// server sent over the wire.
+func parseResourceExhausted(msg string) (*ResourceExhaustedError, bool) {
+	rest, ok := strings.CutPrefix(msg, ErrResourceExhausted.Error()+": ")
+	if !ok {
+		return nil, false
+	}
+	i := strings.LastIndex(rest, ", retry after ")
+	if i < 0 {
+		return nil, false
+	}
+	retryAfter, err := time.ParseDuration(rest[i+len(", retry after "):])
+	if err != nil {
+		return nil, false
+	}
+	return &ResourceExhaustedError{Reason: rest[:i], RetryAfter: retryAfter}, true
+}
+
+// RateLimitPolicy limits how many calls a client may make. Clients are
+// identified by the subject of their verified certificate, so the limit is
+// shared by every connection presenting the same certificate identity.
+type RateLimitPolicy struct {
+	// Rate is the sustained number of calls per second refilled into each
+	// client's token bucket. Zero disables the token bucket.
+	Rate float64
+
+	// Burst is the capacity of the token bucket. Values below one are
+	// treated as one.
+	Burst int
+
+	// Quota is the number of calls a client may make per QuotaWindow. Zero
+	// disables the quota.
+	Quota int64
+
+	// QuotaWindow is the quota period. Fixed windows are aligned to multiples
+	// of the window, so 24 hours resets at midnight UTC.
+	QuotaWindow time.Duration
+
+	// RollingQuota counts calls over a window sliding with the current time
+	// instead of fixed windows.
+	RollingQuota bool
+
+	// PerMethod keeps separate buckets and quotas for each method a client
+	// calls instead of one shared across all methods.
+	PerMethod bool
+}
+
+// WithRateLimit applies policy to every call handled by the server.
+func WithRateLimit(policy RateLimitPolicy) ServerOption {
+	return func(s *tlsRpcServer) {
+		s.rateLimit = newRateLimiter(policy)
+	}
+}
+
+// WithMethodRateLimit applies policy to calls of a single "Service.Method",
+// in addition to any server-wide policy set by WithRateLimit.
+func WithMethodRateLimit(serviceMethod string, policy RateLimitPolicy) ServerOption {
+	return func(s *tlsRpcServer) {
+		if s.methodRateLimits == nil {
+			s.methodRateLimits = make(map[string]*rateLimiter)
+		}
+		s.methodRateLimits[serviceMethod] = newRateLimiter(policy)
+	}
+}
+
+// checkRateLimit consumes one call from the limits that apply to identity
+// calling serviceMethod. A call refused by the method's limit gives back
+// what it took from the server-wide limit, so that a throttled method does
+// not use up the capacity of the others.
+func (s *tlsRpcServer) checkRateLimit(identity, serviceMethod string) error {
+	if s.rateLimit != nil {
+		if err := s.rateLimit.allow(identity, serviceMethod); err != nil {
+			return err
+		}
+	}
+	if limiter, ok := s.methodRateLimits[serviceMethod]; ok {
+		if err := limiter.allow(identity, serviceMethod); err != nil {
+			if s.rateLimit != nil {
+				s.rateLimit.refund(identity, serviceMethod)
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// rateLimiter enforces a RateLimitPolicy for many clients.
+type rateLimiter struct {
+	policy RateLimitPolicy
+	now    func() time.Time
+
+	mu        sync.Mutex
+	entries   map[string]*limiterEntry
+	lastSweep time.Time
+}
+
+// limiterEntry is the state kept for one client, or one client and method.
+type limiterEntry struct {
+	tokens     float64
+	refilled   time.Time
+	window     time.Time
+	count      int64
+	prevCount  int64
+	lastAccess time.Time
+}
+
+func newRateLimiter(policy RateLimitPolicy) *rateLimiter {
+	if policy.Burst < 1 {
+		policy.Burst = 1
+	}
+	return &rateLimiter{
+		policy:  policy,
+		now:     time.Now,
+		entries: make(map[string]*limiterEntry),
+	}
+}
+
+// allow records a call by identity to serviceMethod, or returns a
+// *ResourceExhaustedError if the call is over the limit.
+func (l *rateLimiter) allow(identity, serviceMethod string) error {
+	key := identity
+	if l.policy.PerMethod {
+		key += "|" + serviceMethod
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	l.sweep(now)
+
+	entry, ok := l.entries[key]
+	if !ok {
+		entry = &limiterEntry{tokens: float64(l.policy.Burst), refilled: now}
+		l.entries[key] = entry
+	}
+	entry.lastAccess = now
+
+	if l.policy.Rate > 0 {
+		elapsed := now.Sub(entry.refilled).Seconds()
+		entry.tokens = math.Min(float64(l.policy.Burst), entry.tokens+elapsed*l.policy.Rate)
+		entry.refilled = now
+		if entry.tokens < 1 {
+			wait := time.Duration((1 - entry.tokens) / l.policy.Rate * float64(time.Second))
+			return &ResourceExhaustedError{Reason: "rate limit exceeded", RetryAfter: wait.Round(time.Millisecond)}
+		}
+	}
+
+	if l.policy.Quota > 0 && l.policy.QuotaWindow > 0 {
+		if wait, ok := l.quotaAllows(entry, now); !ok {
+			return &ResourceExhaustedError{Reason: "quota exceeded", RetryAfter: wait.Round(time.Millisecond)}
+		}
+		entry.count++
+	}
+
+	if l.policy.Rate > 0 {
+		entry.tokens--
+	}
+	return nil
+}
+
+// refund gives back a call allowed by allow that was refused elsewhere.
+func (l *rateLimiter) refund(identity, serviceMethod string) {
+	key := identity
+	if l.policy.PerMethod {
+		key += "|" + serviceMethod
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	entry, ok := l.entries[key]
+	if !ok {
+		return
+	}
+	if l.policy.Rate > 0 {
+		entry.tokens = math.Min(float64(l.policy.Burst), entry.tokens+1)
+	}
+	if l.policy.Quota > 0 && l.policy.QuotaWindow > 0 && entry.count > 0 {
+		entry.count--
+	}
+}
+
+// quotaAllows advances the entry's quota window and reports whether another
+// call fits, or how long until one does.
+func (l *rateLimiter) quotaAllows(entry *limiterEntry, now time.Time) (time.Duration, bool) {
+	window := l.policy.QuotaWindow
+	start := now.Truncate(window)
+	switch {
+	case entry.window.Equal(start):
+	case entry.window.Add(window).Equal(start):
+		entry.prevCount, entry.count = entry.count, 0
+	default:
+		entry.prevCount, entry.count = 0, 0
+	}
+	entry.window = start
+
+	elapsed := now.Sub(start)
+	if !l.policy.RollingQuota {
+		if entry.count >= l.policy.Quota {
+			return window - elapsed, false
+		}
+		return 0, true
+	}
+
+	// Sliding window: the previous window contributes in proportion to how
+	// much of it still overlaps the last QuotaWindow.
+	overlap := 1 - float64(elapsed)/float64(window)
+	used := float64(entry.prevCount)*overlap + float64(entry.count)
+	if used+1 <= float64(l.policy.Quota) {
+		return 0, true
+	}
+
+	room := float64(l.policy.Quota - 1 - entry.count)
+	if room < 0 || entry.prevCount == 0 {
+		return window - elapsed, false
+	}
+	wait := time.Duration(float64(window)*(1-room/float64(entry.prevCount))) - elapsed
+	if wait < time.Millisecond {
+		wait = time.Millisecond
+	}
+	return wait, false
+}
+
+// sweep discards entries that have been idle long enough to be back at their
+// initial state.
+func (l *rateLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < limiterSweepInterval {
+		return
+	}
+	l.lastSweep = now
+
+	idle := 2 * l.policy.QuotaWindow
+	if l.policy.Rate > 0 {
+		refill := time.Duration(float64(l.policy.Burst) / l.policy.Rate * float64(time.Second))
+		if refill > idle {
+			idle = refill
+		}
+	}
+	for key, entry := range l.entries {
+		if now.Sub(entry.lastAccess) > idle {
+			delete(l.entries, key)
+		}
+	}
+}
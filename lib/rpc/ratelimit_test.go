@@ -0,0 +1,123 @@
+package swissknife
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// fakeClock is a manually advanced time source for rate limiter tests.
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func newTestLimiter(policy RateLimitPolicy) (*rateLimiter, *fakeClock) {
+	clock := &fakeClock{now: time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)}
+	limiter := newRateLimiter(policy)
+	limiter.now = clock.Now
+	return limiter, clock
+}
+
+func TestRateLimiterTokenBucket(t *testing.T) {
+	limiter, clock := newTestLimiter(RateLimitPolicy{Rate: 2, Burst: 2})
+
+	require.NoError(t, limiter.allow("CN=a", "S.M"))
+	require.NoError(t, limiter.allow("CN=a", "S.M"))
+
+	err := limiter.allow("CN=a", "S.M")
+	var exhausted *ResourceExhaustedError
+	require.True(t, errors.As(err, &exhausted))
+	require.Equal(t, 500*time.Millisecond, exhausted.RetryAfter)
+
+	// Other identities have their own bucket.
+	require.NoError(t, limiter.allow("CN=b", "S.M"))
+
+	clock.now = clock.now.Add(500 * time.Millisecond)
+	require.NoError(t, limiter.allow("CN=a", "S.M"))
+}
+
+func TestRateLimiterPerMethod(t *testing.T) {
+	limiter, _ := newTestLimiter(RateLimitPolicy{Rate: 1, Burst: 1, PerMethod: true})
+
+	require.NoError(t, limiter.allow("CN=a", "S.One"))
+	require.NoError(t, limiter.allow("CN=a", "S.Two"))
+	require.ErrorIs(t, limiter.allow("CN=a", "S.One"), ErrResourceExhausted)
+}
+
+func TestRateLimiterFixedQuota(t *testing.T) {
+	limiter, clock := newTestLimiter(RateLimitPolicy{Quota: 2, QuotaWindow: 24 * time.Hour})
+
+	require.NoError(t, limiter.allow("CN=a", "S.M"))
+	require.NoError(t, limiter.allow("CN=a", "S.M"))
+
+	err := limiter.allow("CN=a", "S.M")
+	var exhausted *ResourceExhaustedError
+	require.True(t, errors.As(err, &exhausted))
+	require.Equal(t, "quota exceeded", exhausted.Reason)
+	require.Equal(t, 12*time.Hour, exhausted.RetryAfter)
+
+	clock.now = clock.now.Add(12 * time.Hour)
+	require.NoError(t, limiter.allow("CN=a", "S.M"))
+}
+
+func TestRateLimiterRollingQuota(t *testing.T) {
+	limiter, clock := newTestLimiter(RateLimitPolicy{Quota: 4, QuotaWindow: time.Hour, RollingQuota: true})
+
+	for i := 0; i < 4; i++ {
+		require.NoError(t, limiter.allow("CN=a", "S.M"))
+	}
+	require.ErrorIs(t, limiter.allow("CN=a", "S.M"), ErrResourceExhausted)
+
+	// Half way into the next window half of the previous calls still count.
+	clock.now = clock.now.Add(time.Hour + 30*time.Minute)
+	require.NoError(t, limiter.allow("CN=a", "S.M"))
+	require.NoError(t, limiter.allow("CN=a", "S.M"))
+
+	err := limiter.allow("CN=a", "S.M")
+	var exhausted *ResourceExhaustedError
+	require.True(t, errors.As(err, &exhausted))
+	require.Greater(t, exhausted.RetryAfter, time.Duration(0))
+}
+
+func TestMethodRateLimitRefundsServerLimit(t *testing.T) {
+	s := &tlsRpcServer{}
+	WithRateLimit(RateLimitPolicy{Rate: 0.001, Burst: 3, Quota: 3, QuotaWindow: time.Hour})(s)
+	WithMethodRateLimit("S.Slow", RateLimitPolicy{Rate: 0.001, Burst: 1})(s)
+
+	require.NoError(t, s.checkRateLimit("CN=a", "S.Slow"))
+	for i := 0; i < 5; i++ {
+		require.ErrorIs(t, s.checkRateLimit("CN=a", "S.Slow"), ErrResourceExhausted)
+	}
+
+	// Calls refused by the method limit left the server-wide token bucket
+	// and quota untouched.
+	require.NoError(t, s.checkRateLimit("CN=a", "S.Fast"))
+	require.NoError(t, s.checkRateLimit("CN=a", "S.Fast"))
+	require.ErrorIs(t, s.checkRateLimit("CN=a", "S.Fast"), ErrResourceExhausted)
+}
+
+func TestServerRateLimitsClientIdentity(t *testing.T) {
+	pki := newTestPKI(t)
+	_, addr := startTestServer(t, pki, WithRateLimit(RateLimitPolicy{Rate: 0.01, Burst: 2}))
+	argsData, err := json.Marshal(Args{A: 1, B: 2})
+	require.NoError(t, err)
+
+	// Every client presents the same certificate, so they share one bucket.
+	for i := 0; i < 2; i++ {
+		_, err := newTestClient(t, pki, addr).ConnectToRpcServerTls("TestService.Add", argsData)
+		require.NoError(t, err)
+	}
+
+	_, err = newTestClient(t, pki, addr).ConnectToRpcServerTls("TestService.Add", argsData)
+	var exhausted *ResourceExhaustedError
+	require.True(t, errors.As(err, &exhausted), "got %v", err)
+	require.Equal(t, "rate limit exceeded", exhausted.Reason)
+	require.Greater(t, exhausted.RetryAfter, 90*time.Second)
+}
@@ -0,0 +1,321 @@
+package swissknife
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// defaultRenewRetry is how long CertificateRenewer.Run waits after a failed
+// renewal when RenewerConfig.RetryInterval is zero.
+const defaultRenewRetry = 30 * time.Second
+
+// RenewerConfig configures a CertificateRenewer.
+type RenewerConfig struct {
+	// Address is the server running the CertificateAuthority, and
+	// CACertPath the CA trusted to verify it.
+	Address    string
+	CACertPath string
+
+	// CertPath and KeyPath are where the issued certificate and its key are
+	// stored. A valid certificate found there authenticates renewals.
+	CertPath string
+	KeyPath  string
+
+	// CommonName, DNSNames and URIs are the names requested.
+	CommonName string
+	DNSNames   []string
+	URIs       []*url.URL
+
+	// BootstrapToken is presented when there is no valid certificate at
+	// CertPath yet.
+	BootstrapToken string
+
+	// RenewBefore is how long before expiry the certificate is renewed. Zero
+	// renews once two thirds of its lifetime have passed.
+	RenewBefore time.Duration
+
+	// RetryInterval is how long Run waits after a failed renewal.
+	RetryInterval time.Duration
+
+	// ClientOptions are passed to NewITlsRpcClient when contacting the CA.
+	ClientOptions []ClientOption
+
+	// OnRenew is called with each newly issued certificate, for example to
+	// reconnect clients with it.
+	OnRenew func(cert tls.Certificate)
+}
+
+// CertificateRenewer obtains a certificate from a CertificateAuthority and
+// renews it before it expires.
+type CertificateRenewer struct {
+	cfg RenewerConfig
+	now func() time.Time
+
+	loggerMu sync.RWMutex
+	logger   Logger
+}
+
+// NewCertificateRenewer returns a renewer for cfg. It does not contact the CA
+// until RenewIfNeeded, Renew or Run is called.
+func NewCertificateRenewer(cfg RenewerConfig) *CertificateRenewer {
+	if cfg.RetryInterval <= 0 {
+		cfg.RetryInterval = defaultRenewRetry
+	}
+	return &CertificateRenewer{cfg: cfg, now: time.Now, logger: NewDefaultLogger()}
+}
+
+// SetLogger sets the logger used by the renewer.
+func (r *CertificateRenewer) SetLogger(logger Logger) {
+	r.loggerMu.Lock()
+	r.logger = logger
+	r.loggerMu.Unlock()
+}
+
+func (r *CertificateRenewer) log() Logger {
+	r.loggerMu.RLock()
+	defer r.loggerMu.RUnlock()
+	return r.logger
+}
+
+// Run renews the certificate whenever it is due until ctx is done, retrying
+// failed renewals every RetryInterval. It never waits less than
+// RetryInterval between renewals. It returns ctx.Err().
+func (r *CertificateRenewer) Run(ctx context.Context) error {
+	for {
+		wait := r.cfg.RetryInterval
+		if _, err := r.RenewIfNeeded(); err != nil {
+			r.log().Errorf("Certificate renewal for %s failed: %v", r.cfg.CommonName, err)
+		} else if current, err := r.current(); err == nil {
+			wait = r.nextRenewal(current)
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// RenewIfNeeded renews the certificate when there is none yet, it does not
+// load, or it is due for renewal, and reports whether it did.
+func (r *CertificateRenewer) RenewIfNeeded() (bool, error) {
+	current, err := r.current()
+	if err == nil && r.now().Before(r.renewAt(current)) {
+		return false, nil
+	}
+	if err := r.Renew(); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Renew requests a new certificate for a freshly generated key and stores
+// both. It authenticates with the current certificate while it is valid and
+// with the bootstrap token otherwise.
+func (r *CertificateRenewer) Renew() error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return fmt.Errorf("failed to generate key: %w", err)
+	}
+	csrDER, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: r.cfg.CommonName},
+		DNSNames: r.cfg.DNSNames,
+		URIs:     r.cfg.URIs,
+	}, key)
+	if err != nil {
+		return fmt.Errorf("failed to create certificate request: %w", err)
+	}
+
+	signReq := SignRequest{CSR: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: csrDER})}
+	certPath, keyPath := "", ""
+	if _, err := r.current(); err == nil {
+		certPath, keyPath = r.cfg.CertPath, r.cfg.KeyPath
+	} else {
+		if r.cfg.BootstrapToken == "" {
+			return fmt.Errorf("no valid certificate at %s and no bootstrap token: %w", r.cfg.CertPath, err)
+		}
+		signReq.Token = r.cfg.BootstrapToken
+	}
+
+	args, err := json.Marshal(signReq)
+	if err != nil {
+		return err
+	}
+	client, err := NewITlsRpcClient(r.cfg.CACertPath, certPath, keyPath, r.cfg.Address, "cert-renewer", r.cfg.ClientOptions...)
+	if err != nil {
+		return err
+	}
+	client.SetLogger(r.log())
+	defer client.CloseClient()
+
+	replyData, err := client.ConnectToRpcServerTls(CASignMethod, args)
+	if err != nil {
+		return err
+	}
+	var reply SignResponse
+	if err := json.Unmarshal(replyData, &reply); err != nil {
+		return fmt.Errorf("invalid sign response: %w", err)
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	cert, err := tls.X509KeyPair(reply.Certificate, keyPEM)
+	if err != nil {
+		return fmt.Errorf("issued certificate does not match the key: %w", err)
+	}
+	if err := r.store(reply.Certificate, keyPEM); err != nil {
+		return err
+	}
+
+	r.log().Infof("Renewed certificate for %s", r.cfg.CommonName)
+	if r.cfg.OnRenew != nil {
+		r.cfg.OnRenew(cert)
+	}
+	return nil
+}
+
+// pendingSuffix marks the files of a renewed key pair that is not yet
+// fully in place.
+const pendingSuffix = ".pending"
+
+// store replaces the stored key pair with certPEM and keyPEM. Both are
+// written next to their destinations first, the certificate last, and only
+// then moved in place, so that a crash in between leaves either the old pair
+// or a pending one that finishPending completes.
+func (r *CertificateRenewer) store(certPEM, keyPEM []byte) error {
+	if err := writeFileAtomic(r.cfg.KeyPath+pendingSuffix, keyPEM, 0o600); err != nil {
+		return err
+	}
+	if err := writeFileAtomic(r.cfg.CertPath+pendingSuffix, certPEM, 0o644); err != nil {
+		os.Remove(r.cfg.KeyPath + pendingSuffix)
+		return err
+	}
+	return r.finishPending()
+}
+
+// finishPending moves a pending key pair left by store in place. A pending
+// key without a pending certificate was never complete and is discarded, as
+// is a pending certificate that does not match its key.
+func (r *CertificateRenewer) finishPending() error {
+	pendingCert, pendingKey := r.cfg.CertPath+pendingSuffix, r.cfg.KeyPath+pendingSuffix
+	certPEM, err := os.ReadFile(pendingCert)
+	if errors.Is(err, os.ErrNotExist) {
+		os.Remove(pendingKey)
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("failed to read %s: %w", pendingCert, err)
+	}
+
+	// The key is moved in place first, so it may already be there.
+	keyPath := pendingKey
+	if _, err := os.Stat(pendingKey); errors.Is(err, os.ErrNotExist) {
+		keyPath = r.cfg.KeyPath
+	}
+	keyPEM, err := os.ReadFile(keyPath)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", keyPath, err)
+	}
+	if _, err := tls.X509KeyPair(certPEM, keyPEM); err != nil {
+		os.Remove(pendingCert)
+		os.Remove(pendingKey)
+		return fmt.Errorf("discarded pending certificate %s: %w", pendingCert, err)
+	}
+
+	if keyPath == pendingKey {
+		if err := os.Rename(pendingKey, r.cfg.KeyPath); err != nil {
+			return fmt.Errorf("failed to write %s: %w", r.cfg.KeyPath, err)
+		}
+	}
+	if err := os.Rename(pendingCert, r.cfg.CertPath); err != nil {
+		return fmt.Errorf("failed to write %s: %w", r.cfg.CertPath, err)
+	}
+	return nil
+}
+
+// current loads the stored certificate, failing if it is missing or no
+// longer valid. A renewal interrupted while storing its key pair is
+// completed first.
+func (r *CertificateRenewer) current() (*x509.Certificate, error) {
+	if err := r.finishPending(); err != nil {
+		r.log().Warnf("Failed to finish storing the renewed certificate for %s: %v", r.cfg.CommonName, err)
+	}
+	pair, err := tls.LoadX509KeyPair(r.cfg.CertPath, r.cfg.KeyPath)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+	if now := r.now(); now.Before(cert.NotBefore) || now.After(cert.NotAfter) {
+		return nil, errors.New("certificate is not currently valid")
+	}
+	return cert, nil
+}
+
+// nextRenewal returns how long Run waits before renewing cert. A RenewBefore
+// not shorter than the lifetime of cert would make it due as soon as it was
+// issued, so Run then renews once two thirds of the lifetime have passed.
+func (r *CertificateRenewer) nextRenewal(cert *x509.Certificate) time.Duration {
+	due := r.renewAt(cert)
+	if lifetime := cert.NotAfter.Sub(cert.NotBefore); r.cfg.RenewBefore >= lifetime {
+		r.log().Warnf("RenewBefore %s is not shorter than the %s lifetime of the certificate for %s; renewing after two thirds of it", r.cfg.RenewBefore, lifetime, r.cfg.CommonName)
+		due = cert.NotAfter.Add(-lifetime / 3)
+	}
+	return max(due.Sub(r.now()), r.cfg.RetryInterval)
+}
+
+// renewAt returns when cert is due for renewal.
+func (r *CertificateRenewer) renewAt(cert *x509.Certificate) time.Time {
+	before := r.cfg.RenewBefore
+	if before <= 0 {
+		before = cert.NotAfter.Sub(cert.NotBefore) / 3
+	}
+	return cert.NotAfter.Add(-before)
+}
+
+// writeFileAtomic replaces path with data so that readers never see a
+// partially written file.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+	if err != nil {
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	return nil
+}
@@ -0,0 +1,63 @@
+package swissknife
+
+import (
+	"context"
+	"errors"
+)
+
+// ErrUnauthenticated is returned for calls from clients that presented no
+// certificate to methods not listed in WithUnauthenticatedMethods.
+var ErrUnauthenticated = errors.New("rpc: client certificate required")
+
+// Request is the argument type for service methods that need to know who is
+// calling. A method declared as
+//
+//	func (t *T) Method(req *swissknife.Request, reply *[]byte) error
+//
+// receives the raw arguments together with the details of the connection
+// the call arrived on. Methods taking *[]byte receive the arguments only.
+// These are the only argument types RegisterMethod accepts.
+type Request struct {
+	// Args are the arguments sent by the client.
+	Args []byte
+
+	// Conn describes the connection the call arrived on.
+	Conn ConnInfo
+
+	// Principal is the caller authenticated by the call's bearer token on
+	// servers created with WithTokenAuthentication, and nil otherwise.
+	Principal *Principal
+
+	ctx context.Context
+}
+
+// Context returns the context of the call. It is cancelled when the
+// caller's deadline passes or its connection closes, after which the reply
+// will not be read.
+func (r *Request) Context() context.Context {
+	if r.ctx != nil {
+		return r.ctx
+	}
+	return context.Background()
+}
+
+// Identity returns the subject of the caller's certificate, or an empty
+// string if the caller presented none.
+func (r *Request) Identity() string {
+	return r.Conn.Identity()
+}
+
+// WithUnauthenticatedMethods lets clients without a certificate connect, but
+// only to call the listed methods, such as CASignMethod for clients
+// bootstrapping their first certificate. Certificates that are presented
+// must still verify.
+func WithUnauthenticatedMethods(methods ...string) ServerOption {
+	return func(s *tlsRpcServer) {
+		if s.unauthenticated == nil {
+			s.unauthenticated = make(map[string]bool)
+		}
+		for _, method := range methods {
+			s.unauthenticated[method] = true
+		}
+	}
+}
@@ -0,0 +1,195 @@
+package swissknife
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// ErrCertificateRevoked is returned when a peer certificate, or one of the
+// intermediates it chains through, is listed in a loaded CRL.
+var ErrCertificateRevoked = errors.New("rpc: certificate revoked")
+
+// RevocationConfig configures certificate revocation checking against
+// certificate revocation lists.
+type RevocationConfig struct {
+	// CRLFiles are the CRLs to load, PEM ("X509 CRL" blocks) or DER encoded.
+	// A CRL is only honoured for certificates whose issuer signed it.
+	CRLFiles []string
+
+	// ReloadInterval is how often the files are read again, in the
+	// background while the server is serving. Zero loads them once. When a
+	// reload fails the previously loaded lists stay in use. Clients ignore
+	// it, since they check the server's certificate only when they connect.
+	ReloadInterval time.Duration
+}
+
+// WithRevocation rejects client certificates revoked by the configured
+// CRLs. The CRLs must load when the server is created.
+func WithRevocation(cfg RevocationConfig) ServerOption {
+	return func(s *tlsRpcServer) {
+		s.revocation = &cfg
+	}
+}
+
+// WithClientRevocation rejects server certificates revoked by the
+// configured CRLs. The CRLs are loaded and checked once, when the client is
+// created and connects.
+func WithClientRevocation(cfg RevocationConfig) ClientOption {
+	return func(c *tlsRpcClient) {
+		c.revocation = &cfg
+	}
+}
+
+// revocationChecker holds the parsed CRLs of a RevocationConfig. The lists
+// are replaced as a whole on reload, so handshakes read them without
+// locking.
+type revocationChecker struct {
+	cfg    RevocationConfig
+	logger func() Logger
+	now    func() time.Time
+
+	lists atomic.Pointer[[]*revocationList]
+}
+
+// revocationList is a single parsed CRL with its revoked serial numbers.
+type revocationList struct {
+	source  string
+	crl     *x509.RevocationList
+	revoked map[string]bool
+}
+
+// newRevocationChecker loads the CRLs named by cfg.
+func newRevocationChecker(cfg RevocationConfig, logger func() Logger) (*revocationChecker, error) {
+	rc := &revocationChecker{cfg: cfg, logger: logger, now: time.Now}
+	lists, err := rc.load()
+	if err != nil {
+		return nil, err
+	}
+	rc.lists.Store(&lists)
+	return rc, nil
+}
+
+// load reads and parses every configured CRL file.
+func (rc *revocationChecker) load() ([]*revocationList, error) {
+	var lists []*revocationList
+	for _, path := range rc.cfg.CRLFiles {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CRL %s: %w", path, err)
+		}
+
+		ders := [][]byte{data}
+		if bytes.Contains(data, []byte("-----BEGIN")) {
+			ders = nil
+			for block, rest := pem.Decode(data); block != nil; block, rest = pem.Decode(rest) {
+				if block.Type == "X509 CRL" {
+					ders = append(ders, block.Bytes)
+				}
+			}
+			if len(ders) == 0 {
+				return nil, fmt.Errorf("no X509 CRL blocks found in %s", path)
+			}
+		}
+
+		for _, der := range ders {
+			crl, err := x509.ParseRevocationList(der)
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse CRL %s: %w", path, err)
+			}
+			if !crl.NextUpdate.IsZero() && rc.now().After(crl.NextUpdate) {
+				rc.logger().Warnf("CRL %s from %s is stale: next update was due %s", path, crl.Issuer, crl.NextUpdate.Format(time.RFC3339))
+			}
+
+			list := &revocationList{source: path, crl: crl, revoked: make(map[string]bool)}
+			for _, entry := range crl.RevokedCertificateEntries {
+				list.revoked[entry.SerialNumber.String()] = true
+			}
+			lists = append(lists, list)
+		}
+	}
+	return lists, nil
+}
+
+// current returns the loaded CRLs.
+func (rc *revocationChecker) current() []*revocationList {
+	return *rc.lists.Load()
+}
+
+// reload reads the CRL files again, keeping the previous lists when that
+// fails.
+func (rc *revocationChecker) reload() {
+	lists, err := rc.load()
+	if err != nil {
+		rc.logger().Warnf("Failed to reload CRLs, keeping the previous ones: %v", err)
+		return
+	}
+	rc.lists.Store(&lists)
+}
+
+// run reloads the CRLs every ReloadInterval until done is closed.
+func (rc *revocationChecker) run(done <-chan struct{}) {
+	if rc.cfg.ReloadInterval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(rc.cfg.ReloadInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			rc.reload()
+		}
+	}
+}
+
+// verify is a tls.Config.VerifyPeerCertificate callback that rejects the
+// peer when any certificate in a verified chain is revoked by a CRL signed
+// by that certificate's issuer.
+func (rc *revocationChecker) verify(_ [][]byte, verifiedChains [][]*x509.Certificate) error {
+	lists := rc.current()
+	for _, chain := range verifiedChains {
+		for i := 0; i+1 < len(chain); i++ {
+			cert, issuer := chain[i], chain[i+1]
+			for _, list := range lists {
+				if !bytes.Equal(list.crl.RawIssuer, issuer.RawSubject) || !list.revoked[cert.SerialNumber.String()] {
+					continue
+				}
+				if err := list.crl.CheckSignatureFrom(issuer); err != nil {
+					continue
+				}
+				return fmt.Errorf("%w: serial %s (%s) is listed in %s", ErrCertificateRevoked, cert.SerialNumber, cert.Subject, list.source)
+			}
+		}
+	}
+	return nil
+}
+
+// chainVerifiers combines tls.Config.VerifyPeerCertificate callbacks, run in
+// order until one fails. Nil callbacks are skipped.
+func chainVerifiers(verifiers ...func([][]byte, [][]*x509.Certificate) error) func([][]byte, [][]*x509.Certificate) error {
+	var active []func([][]byte, [][]*x509.Certificate) error
+	for _, v := range verifiers {
+		if v != nil {
+			active = append(active, v)
+		}
+	}
+	if len(active) == 0 {
+		return nil
+	}
+	return func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+		for _, v := range active {
+			if err := v(rawCerts, verifiedChains); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
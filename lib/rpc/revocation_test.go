@@ -0,0 +1,113 @@
+package swissknife
+
+import (
+	"bytes"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// revocationHooks reports the error of every failed handshake on failures.
+func revocationHooks(failures chan<- error) ServerOption {
+	return WithConnHooks(ConnHooks{
+		OnHandshakeFailure: func(_ net.Addr, err error) {
+			failures <- err
+		},
+	})
+}
+
+// connectAndCall connects and makes a call, returning the first error. In
+// TLS 1.3 the client finishes its handshake before the server has verified
+// the client certificate, so a rejection may only surface on the first call.
+func connectAndCall(pki *testPKI, addr string, opts ...ClientOption) error {
+	client, err := NewITlsRpcClient(pki.caCert, pki.clientCert, pki.clientKey, addr, "test-client", opts...)
+	if err != nil {
+		return err
+	}
+	defer client.CloseClient()
+	_, err = client.ConnectToRpcServerTls("TestService.Add", []byte(`{"A":1,"B":2}`))
+	return err
+}
+
+func TestServerRejectsRevokedClient(t *testing.T) {
+	pki := newTestPKI(t)
+	crl := pki.writeCRL(t, "clients.crl", false, leaf(t, pki.clientCert))
+	failures := make(chan error, 1)
+	_, addr := startTestServer(t, pki, WithRevocation(RevocationConfig{CRLFiles: []string{crl}}), revocationHooks(failures))
+
+	require.Error(t, connectAndCall(pki, addr))
+	select {
+	case err := <-failures:
+		require.ErrorIs(t, err, ErrCertificateRevoked)
+	case <-time.After(2 * time.Second):
+		t.Fatal("handshake did not fail")
+	}
+}
+
+func TestClientRejectsRevokedServer(t *testing.T) {
+	pki := newTestPKI(t)
+	crl := pki.writeCRL(t, "servers.der", true, leaf(t, pki.serverCert))
+	_, addr := startTestServer(t, pki)
+
+	err := connectAndCall(pki, addr, WithClientRevocation(RevocationConfig{CRLFiles: []string{crl}}))
+	require.ErrorIs(t, err, ErrCertificateRevoked)
+}
+
+func TestRevocationListsAreReloaded(t *testing.T) {
+	pki := newTestPKI(t)
+	crl := pki.writeCRL(t, "clients.crl", false)
+	_, addr := startTestServer(t, pki, WithRevocation(RevocationConfig{
+		CRLFiles:       []string{crl},
+		ReloadInterval: time.Millisecond,
+	}))
+	require.NoError(t, connectAndCall(pki, addr))
+
+	revoked := pki.writeCRL(t, "revoked.crl", false, leaf(t, pki.clientCert))
+	require.NoError(t, os.Rename(revoked, crl))
+	require.Eventually(t, func() bool { return connectAndCall(pki, addr) != nil }, time.Second, 5*time.Millisecond)
+}
+
+func TestRevocationReloadKeepsListsOnFailure(t *testing.T) {
+	pki := newTestPKI(t)
+	crl := pki.writeCRL(t, "clients.crl", false, leaf(t, pki.clientCert))
+	var warnings bytes.Buffer
+	rc, err := newRevocationChecker(RevocationConfig{CRLFiles: []string{crl}, ReloadInterval: time.Millisecond}, func() Logger {
+		return newTestLogger(&bytes.Buffer{}, &warnings, LogLevelWarn)
+	})
+	require.NoError(t, err)
+	lists := rc.current()
+	require.Len(t, lists, 1)
+
+	require.NoError(t, os.WriteFile(crl, []byte("not a crl"), 0o600))
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		rc.run(done)
+		close(stopped)
+	}()
+	time.Sleep(20 * time.Millisecond)
+	close(done)
+	<-stopped
+
+	require.Equal(t, lists, rc.current())
+	require.Contains(t, warnings.String(), "keeping the previous ones")
+}
+
+func TestRevocationRequiresLoadableCRL(t *testing.T) {
+	pki := newTestPKI(t)
+
+	_, err := NewITlsRpcServer(pki.serverCert, pki.serverKey, pki.caCert, "0", WithRevocation(RevocationConfig{CRLFiles: []string{pki.caCert}}))
+	require.Error(t, err)
+}
+
+func TestRevocationIgnoresCRLFromOtherIssuer(t *testing.T) {
+	pki := newTestPKI(t)
+	other := newTestPKI(t)
+	crl := other.writeCRL(t, "other.crl", false, leaf(t, pki.clientCert))
+	_, addr := startTestServer(t, pki, WithRevocation(RevocationConfig{CRLFiles: []string{crl}}))
+
+	require.NoError(t, connectAndCall(pki, addr))
+}
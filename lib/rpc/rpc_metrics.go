@@ -0,0 +1,220 @@
+package swissknife
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"time"
+)
+
+// unknownMethod labels calls to methods that are not registered, so that
+// clients cannot create series at will.
+const unknownMethod = "unknown"
+
+// serverMetrics instruments a tlsRpcServer. A nil *serverMetrics records
+// nothing.
+type serverMetrics struct {
+	calls             *CounterVec
+	latency           *HistogramVec
+	handshakeFailures *Counter
+	openConns         *Gauge
+	received          *Counter
+	sent              *Counter
+	certExpiry        *GaugeVec
+}
+
+// WithMetrics records server metrics in reg: calls per method and status,
+// call latency, handshake failures, open connections and bytes transferred.
+// A registry may be shared by several servers and clients.
+func WithMetrics(reg *MetricsRegistry) ServerOption {
+	return func(s *tlsRpcServer) {
+		s.metrics = &serverMetrics{
+			calls:             reg.Counter("swissknife_rpc_server_calls_total", "RPC calls handled by the server.", "method", "status"),
+			latency:           reg.Histogram("swissknife_rpc_server_call_duration_seconds", "Time taken to run RPC calls.", nil, "method"),
+			handshakeFailures: reg.Counter("swissknife_rpc_server_handshake_failures_total", "Client connections that failed the TLS handshake.").With(),
+			openConns:         reg.Gauge("swissknife_rpc_server_open_connections", "Client connections currently open.").With(),
+			received:          reg.Counter("swissknife_rpc_server_received_bytes_total", "Bytes read from client connections after the handshake.").With(),
+			sent:              reg.Counter("swissknife_rpc_server_sent_bytes_total", "Bytes written to client connections after the handshake.").With(),
+			certExpiry:        reg.Gauge("swissknife_rpc_server_cert_expiry_days", "Days until a certificate loaded by the server expires.", "kind", "subject", "serial"),
+		}
+	}
+}
+
+// callDone records a call that ran for elapsed.
+func (m *serverMetrics) callDone(method string, err error, elapsed time.Duration) {
+	if m == nil {
+		return
+	}
+	m.calls.With(method, callStatus(err)).Inc()
+	m.latency.With(method).Observe(elapsed.Seconds())
+}
+
+// callRejected records a call refused before it ran.
+func (m *serverMetrics) callRejected(method string, err error) {
+	if m == nil {
+		return
+	}
+	m.calls.With(method, callStatus(err)).Inc()
+}
+
+func (m *serverMetrics) handshakeFailed() {
+	if m == nil {
+		return
+	}
+	m.handshakeFailures.Inc()
+}
+
+func (m *serverMetrics) connOpened() {
+	if m == nil {
+		return
+	}
+	m.openConns.Inc()
+}
+
+func (m *serverMetrics) connClosed() {
+	if m == nil {
+		return
+	}
+	m.openConns.Dec()
+}
+
+// byteCounters returns the counters for bytes received and sent, or nils.
+func (m *serverMetrics) byteCounters() (received, sent *Counter) {
+	if m == nil {
+		return nil, nil
+	}
+	return m.received, m.sent
+}
+
+// expiryDays returns the certificate expiry gauge, or nil.
+func (m *serverMetrics) expiryDays() *GaugeVec {
+	if m == nil {
+		return nil
+	}
+	return m.certExpiry
+}
+
+// clientMetrics instruments a tlsRpcClient. A nil *clientMetrics records
+// nothing.
+type clientMetrics struct {
+	calls             *CounterVec
+	latency           *HistogramVec
+	handshakeFailures *Counter
+	openConns         *Gauge
+	received          *Counter
+	sent              *Counter
+	certExpiry        *GaugeVec
+}
+
+// WithClientMetrics records client metrics in reg: calls per method and
+// status, call latency, failed connection attempts, open connections and
+// bytes transferred.
+func WithClientMetrics(reg *MetricsRegistry) ClientOption {
+	return func(c *tlsRpcClient) {
+		c.metrics = &clientMetrics{
+			calls:             reg.Counter("swissknife_rpc_client_calls_total", "RPC calls made by the client.", "method", "status"),
+			latency:           reg.Histogram("swissknife_rpc_client_call_duration_seconds", "Time taken for RPC calls to be answered.", nil, "method"),
+			handshakeFailures: reg.Counter("swissknife_rpc_client_handshake_failures_total", "Connections to the server that failed to dial or complete the TLS handshake.").With(),
+			openConns:         reg.Gauge("swissknife_rpc_client_open_connections", "Client connections currently open.").With(),
+			received:          reg.Counter("swissknife_rpc_client_received_bytes_total", "Bytes read from the server.").With(),
+			sent:              reg.Counter("swissknife_rpc_client_sent_bytes_total", "Bytes written to the server.").With(),
+			certExpiry:        reg.Gauge("swissknife_rpc_client_cert_expiry_days", "Days until a certificate loaded by the client expires.", "kind", "subject", "serial"),
+		}
+	}
+}
+
+func (m *clientMetrics) callDone(method string, err error, elapsed time.Duration) {
+	if m == nil {
+		return
+	}
+	m.calls.With(method, callStatus(err)).Inc()
+	m.latency.With(method).Observe(elapsed.Seconds())
+}
+
+func (m *clientMetrics) handshakeFailed() {
+	if m == nil {
+		return
+	}
+	m.handshakeFailures.Inc()
+}
+
+func (m *clientMetrics) connOpened() {
+	if m == nil {
+		return
+	}
+	m.openConns.Inc()
+}
+
+func (m *clientMetrics) connClosed() {
+	if m == nil {
+		return
+	}
+	m.openConns.Dec()
+}
+
+func (m *clientMetrics) byteCounters() (received, sent *Counter) {
+	if m == nil {
+		return nil, nil
+	}
+	return m.received, m.sent
+}
+
+func (m *clientMetrics) expiryDays() *GaugeVec {
+	if m == nil {
+		return nil
+	}
+	return m.certExpiry
+}
+
+// callStatus classifies the outcome of a call for the status label.
+func callStatus(err error) string {
+	switch {
+	case err == nil:
+		return "ok"
+	case errors.Is(err, ErrResourceExhausted):
+		return "resource_exhausted"
+	case errors.Is(err, ErrTooManyCalls):
+		return "too_many_calls"
+	case errors.Is(err, ErrRequestTooLarge), errors.Is(err, ErrResponseTooLarge):
+		return "too_large"
+	case errors.Is(err, ErrConnectionRejected), errors.Is(err, ErrTooManyConnections):
+		return "rejected"
+	case errors.Is(err, ErrUnauthenticated), errors.Is(err, ErrPermissionDenied), errors.Is(err, ErrInvalidToken):
+		return "denied"
+	case errors.Is(err, context.DeadlineExceeded):
+		return "deadline_exceeded"
+	}
+	return "error"
+}
+
+// recordMethods remembers the exported methods of a registered service so
+// that methodLabel can tell them apart from arbitrary client input.
+func (s *tlsRpcServer) recordMethods(serviceName string, service any) {
+	typ := reflect.TypeOf(service)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.methods == nil {
+		s.methods = make(map[string]bool)
+	}
+	for i := 0; i < typ.NumMethod(); i++ {
+		s.methods[serviceName+"."+typ.Method(i).Name] = true
+	}
+}
+
+// methodLabel returns serviceMethod when it names a registered method and
+// unknownMethod otherwise.
+func (s *tlsRpcServer) methodLabel(serviceMethod string) string {
+	if s.metrics == nil || s.registered(serviceMethod) {
+		return serviceMethod
+	}
+	return unknownMethod
+}
+
+// registered reports whether serviceMethod names a method of a registered
+// service.
+func (s *tlsRpcServer) registered(serviceMethod string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.methods[serviceMethod]
+}
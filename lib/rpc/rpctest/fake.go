@@ -0,0 +1,104 @@
+package rpctest
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+
+	swissknife "github.com/joey1123455/swiss-knife/lib/rpc"
+)
+
+// HandlerFunc answers a call made to a FakeService.
+type HandlerFunc func(req *swissknife.Request) ([]byte, error)
+
+// JSON adapts a function taking and returning JSON encoded values into a
+// HandlerFunc.
+func JSON[Args, Reply any](fn func(args Args) (Reply, error)) HandlerFunc {
+	return func(req *swissknife.Request) ([]byte, error) {
+		var args Args
+		if err := json.Unmarshal(req.Args, &args); err != nil {
+			return nil, fmt.Errorf("invalid arguments: %w", err)
+		}
+		reply, err := fn(args)
+		if err != nil {
+			return nil, err
+		}
+		return json.Marshal(reply)
+	}
+}
+
+// RecordedCall is a call received by a FakeService.
+type RecordedCall struct {
+	// Method is the name of the FakeService method called: Call, Echo or
+	// Fail.
+	Method string
+
+	Args     []byte
+	Identity string
+}
+
+// FakeService is a service that records the calls it receives. Register it
+// with swissknife.ITlsRpcServer.RegisterMethod or Server.Fake. Its methods
+// are:
+//
+//   - Call runs the handler given to NewFakeService;
+//   - Echo replies with the arguments;
+//   - Fail returns an error whose text is the arguments.
+type FakeService struct {
+	handler HandlerFunc
+
+	mu    sync.Mutex
+	calls []RecordedCall
+}
+
+// NewFakeService returns a fake whose Call method runs handler. A nil
+// handler makes Call behave like Echo.
+func NewFakeService(handler HandlerFunc) *FakeService {
+	return &FakeService{handler: handler}
+}
+
+// Call runs the handler of the fake.
+func (f *FakeService) Call(req *swissknife.Request, reply *[]byte) error {
+	f.record("Call", req)
+	if f.handler == nil {
+		*reply = req.Args
+		return nil
+	}
+	out, err := f.handler(req)
+	if err != nil {
+		return err
+	}
+	*reply = out
+	return nil
+}
+
+// Echo replies with the arguments.
+func (f *FakeService) Echo(req *swissknife.Request, reply *[]byte) error {
+	f.record("Echo", req)
+	*reply = req.Args
+	return nil
+}
+
+// Fail returns an error whose text is the arguments.
+func (f *FakeService) Fail(req *swissknife.Request, reply *[]byte) error {
+	f.record("Fail", req)
+	return errors.New(string(req.Args))
+}
+
+func (f *FakeService) record(method string, req *swissknife.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls = append(f.calls, RecordedCall{
+		Method:   method,
+		Args:     append([]byte(nil), req.Args...),
+		Identity: req.Identity(),
+	})
+}
+
+// Calls returns the calls received so far, oldest first.
+func (f *FakeService) Calls() []RecordedCall {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]RecordedCall(nil), f.calls...)
+}
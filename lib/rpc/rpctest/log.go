@@ -0,0 +1,163 @@
+package rpctest
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	swissknife "github.com/joey1123455/swiss-knife/lib/rpc"
+)
+
+// LogEntry is a message captured by a LogRecorder.
+type LogEntry struct {
+	Level   swissknife.LogLevel
+	Message string
+}
+
+// LogRecorder is a swissknife.Logger that keeps every message in memory so
+// that tests can assert on it. It is safe for concurrent use. Fatal and
+// Fatalf record the message and panic instead of exiting.
+type LogRecorder struct {
+	mu      sync.Mutex
+	level   swissknife.LogLevel
+	entries []LogEntry
+}
+
+// NewLogRecorder returns a recorder that captures messages of every level.
+func NewLogRecorder() *LogRecorder {
+	return &LogRecorder{level: swissknife.LogLevelDebug}
+}
+
+func (r *LogRecorder) record(level swissknife.LogLevel, msg string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if level >= r.level {
+		r.entries = append(r.entries, LogEntry{Level: level, Message: strings.TrimSuffix(msg, "\n")})
+	}
+}
+
+func (r *LogRecorder) Debug(v ...interface{}) {
+	r.record(swissknife.LogLevelDebug, fmt.Sprintln(v...))
+}
+
+func (r *LogRecorder) Debugf(format string, v ...interface{}) {
+	r.record(swissknife.LogLevelDebug, fmt.Sprintf(format, v...))
+}
+
+func (r *LogRecorder) Info(v ...interface{}) {
+	r.record(swissknife.LogLevelInfo, fmt.Sprintln(v...))
+}
+
+func (r *LogRecorder) Infof(format string, v ...interface{}) {
+	r.record(swissknife.LogLevelInfo, fmt.Sprintf(format, v...))
+}
+
+func (r *LogRecorder) Warn(v ...interface{}) {
+	r.record(swissknife.LogLevelWarn, fmt.Sprintln(v...))
+}
+
+func (r *LogRecorder) Warnf(format string, v ...interface{}) {
+	r.record(swissknife.LogLevelWarn, fmt.Sprintf(format, v...))
+}
+
+func (r *LogRecorder) Error(v ...interface{}) {
+	r.record(swissknife.LogLevelError, fmt.Sprintln(v...))
+}
+
+func (r *LogRecorder) Errorf(format string, v ...interface{}) {
+	r.record(swissknife.LogLevelError, fmt.Sprintf(format, v...))
+}
+
+func (r *LogRecorder) Fatal(v ...interface{}) {
+	msg := fmt.Sprintln(v...)
+	r.record(swissknife.LogLevelFatal, msg)
+	panic("rpctest: fatal log: " + msg)
+}
+
+func (r *LogRecorder) Fatalf(format string, v ...interface{}) {
+	msg := fmt.Sprintf(format, v...)
+	r.record(swissknife.LogLevelFatal, msg)
+	panic("rpctest: fatal log: " + msg)
+}
+
+func (r *LogRecorder) SetLevel(level swissknife.LogLevel) {
+	r.mu.Lock()
+	r.level = level
+	r.mu.Unlock()
+}
+
+func (r *LogRecorder) GetLevel() swissknife.LogLevel {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.level
+}
+
+// Entries returns a copy of the messages recorded so far.
+func (r *LogRecorder) Entries() []LogEntry {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]LogEntry(nil), r.entries...)
+}
+
+// Reset discards the messages recorded so far.
+func (r *LogRecorder) Reset() {
+	r.mu.Lock()
+	r.entries = nil
+	r.mu.Unlock()
+}
+
+// Contains reports whether a message of the given level containing substr
+// was recorded.
+func (r *LogRecorder) Contains(level swissknife.LogLevel, substr string) bool {
+	for _, entry := range r.Entries() {
+		if entry.Level == level && strings.Contains(entry.Message, substr) {
+			return true
+		}
+	}
+	return false
+}
+
+// String lists the recorded messages, one per line.
+func (r *LogRecorder) String() string {
+	var b strings.Builder
+	for _, entry := range r.Entries() {
+		fmt.Fprintf(&b, "%s: %s\n", entry.Level, entry.Message)
+	}
+	return b.String()
+}
+
+// AssertLogged fails the test unless a message of the given level
+// containing substr was recorded.
+func (r *LogRecorder) AssertLogged(t testing.TB, level swissknife.LogLevel, substr string) {
+	t.Helper()
+	if !r.Contains(level, substr) {
+		t.Errorf("no %s message containing %q was logged; got:\n%s", level, substr, r)
+	}
+}
+
+// AssertNotLogged fails the test if a message of the given level containing
+// substr was recorded.
+func (r *LogRecorder) AssertNotLogged(t testing.TB, level swissknife.LogLevel, substr string) {
+	t.Helper()
+	if r.Contains(level, substr) {
+		t.Errorf("unexpected %s message containing %q was logged; got:\n%s", level, substr, r)
+	}
+}
+
+// WaitFor waits up to timeout for a message of the given level containing
+// substr, for output logged by other goroutines, and fails the test if none
+// arrives.
+func (r *LogRecorder) WaitFor(t testing.TB, level swissknife.LogLevel, substr string, timeout time.Duration) {
+	t.Helper()
+
+	deadline := time.Now().Add(timeout)
+	for !r.Contains(level, substr) {
+		if time.Now().After(deadline) {
+			t.Errorf("no %s message containing %q was logged within %s; got:\n%s", level, substr, timeout, r)
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
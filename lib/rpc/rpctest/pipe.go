@@ -0,0 +1,265 @@
+// Package rpctest provides utilities for testing code built on the TLS RPC
+// server and client: an in-memory listener, throwaway certificates created
+// in process, fake services that record their calls and a logger that
+// captures output for assertions.
+package rpctest
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// PipeListener is a net.Listener whose connections are in-memory pipes
+// created by DialContext, so that tests need no network ports. The pipes
+// support deadlines and buffer writes.
+type PipeListener struct {
+	conns     chan net.Conn
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// NewPipeListener returns a listener ready to accept connections.
+func NewPipeListener() *PipeListener {
+	return &PipeListener{
+		conns: make(chan net.Conn),
+		done:  make(chan struct{}),
+	}
+}
+
+// Accept waits for the next connection made with DialContext.
+func (l *PipeListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, &net.OpError{Op: "accept", Net: pipeNetwork, Addr: l.Addr(), Err: net.ErrClosed}
+	}
+}
+
+// Close stops the listener. Connections already accepted stay open.
+func (l *PipeListener) Close() error {
+	l.closeOnce.Do(func() { close(l.done) })
+	return nil
+}
+
+// Addr returns the listener's address.
+func (l *PipeListener) Addr() net.Addr {
+	return pipeAddr{}
+}
+
+// DialContext connects to the listener. The network and address are
+// ignored, which lets it be passed to swissknife.WithDialContext.
+func (l *PipeListener) DialContext(ctx context.Context, _, _ string) (net.Conn, error) {
+	client, server := newPipe()
+	select {
+	case l.conns <- server:
+		return client, nil
+	case <-l.done:
+		client.Close()
+		server.Close()
+		return nil, &net.OpError{Op: "dial", Net: pipeNetwork, Addr: l.Addr(), Err: net.ErrClosed}
+	case <-ctx.Done():
+		client.Close()
+		server.Close()
+		return nil, &net.OpError{Op: "dial", Net: pipeNetwork, Addr: l.Addr(), Err: ctx.Err()}
+	}
+}
+
+const pipeNetwork = "pipe"
+
+type pipeAddr struct{}
+
+func (pipeAddr) Network() string { return pipeNetwork }
+func (pipeAddr) String() string  { return pipeNetwork }
+
+// pipeBuffer holds the bytes written to one end of a pipe until the other
+// end reads them. Unlike net.Pipe, writes never wait for the reader, so a
+// peer that stops reading, as TLS does after sending an alert, cannot
+// deadlock the writer.
+type pipeBuffer struct {
+	mu     sync.Mutex
+	buf    bytes.Buffer
+	closed bool
+
+	// ready is closed and replaced whenever data arrives or the buffer is
+	// closed.
+	ready chan struct{}
+}
+
+func newPipeBuffer() *pipeBuffer {
+	return &pipeBuffer{ready: make(chan struct{})}
+}
+
+// signal wakes readers. It must be called with mu held.
+func (b *pipeBuffer) signal() {
+	close(b.ready)
+	b.ready = make(chan struct{})
+}
+
+func (b *pipeBuffer) write(p []byte) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return io.ErrClosedPipe
+	}
+	b.buf.Write(p)
+	b.signal()
+	return nil
+}
+
+// close makes reads return io.EOF once the buffered data is drained.
+func (b *pipeBuffer) close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.closed {
+		b.closed = true
+		b.signal()
+	}
+}
+
+// pipeConn is one end of an in-memory connection.
+type pipeConn struct {
+	in, out *pipeBuffer
+
+	mu            sync.Mutex
+	readDeadline  time.Time
+	writeDeadline time.Time
+	deadlineSet   chan struct{}
+	closed        chan struct{}
+	closeOnce     sync.Once
+}
+
+func newPipe() (net.Conn, net.Conn) {
+	a, b := newPipeBuffer(), newPipeBuffer()
+	return newPipeConn(a, b), newPipeConn(b, a)
+}
+
+func newPipeConn(in, out *pipeBuffer) *pipeConn {
+	return &pipeConn{
+		in:          in,
+		out:         out,
+		deadlineSet: make(chan struct{}),
+		closed:      make(chan struct{}),
+	}
+}
+
+func (c *pipeConn) Read(p []byte) (int, error) {
+	for {
+		c.in.mu.Lock()
+		if c.in.buf.Len() > 0 {
+			n, _ := c.in.buf.Read(p)
+			c.in.mu.Unlock()
+			return n, nil
+		}
+		eof, ready := c.in.closed, c.in.ready
+		c.in.mu.Unlock()
+
+		select {
+		case <-c.closed:
+			return 0, c.opError("read", net.ErrClosed)
+		default:
+		}
+		if eof {
+			return 0, io.EOF
+		}
+
+		c.mu.Lock()
+		deadline, deadlineSet := c.readDeadline, c.deadlineSet
+		c.mu.Unlock()
+		var timer *time.Timer
+		var expired <-chan time.Time
+		if !deadline.IsZero() {
+			wait := time.Until(deadline)
+			if wait <= 0 {
+				return 0, c.opError("read", os.ErrDeadlineExceeded)
+			}
+			timer = time.NewTimer(wait)
+			expired = timer.C
+		}
+
+		var err error
+		select {
+		case <-ready:
+		case <-deadlineSet:
+		case <-expired:
+			err = c.opError("read", os.ErrDeadlineExceeded)
+		case <-c.closed:
+			err = c.opError("read", net.ErrClosed)
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+}
+
+func (c *pipeConn) Write(p []byte) (int, error) {
+	select {
+	case <-c.closed:
+		return 0, c.opError("write", net.ErrClosed)
+	default:
+	}
+	c.mu.Lock()
+	deadline := c.writeDeadline
+	c.mu.Unlock()
+	if !deadline.IsZero() && !time.Now().Before(deadline) {
+		return 0, c.opError("write", os.ErrDeadlineExceeded)
+	}
+	if err := c.out.write(p); err != nil {
+		return 0, c.opError("write", err)
+	}
+	return len(p), nil
+}
+
+func (c *pipeConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		c.out.close()
+		c.in.close()
+	})
+	return nil
+}
+
+func (c *pipeConn) LocalAddr() net.Addr  { return pipeAddr{} }
+func (c *pipeConn) RemoteAddr() net.Addr { return pipeAddr{} }
+
+func (c *pipeConn) SetDeadline(t time.Time) error {
+	c.setDeadlines(t, true, t, true)
+	return nil
+}
+
+func (c *pipeConn) SetReadDeadline(t time.Time) error {
+	c.setDeadlines(t, true, time.Time{}, false)
+	return nil
+}
+
+func (c *pipeConn) SetWriteDeadline(t time.Time) error {
+	c.setDeadlines(time.Time{}, false, t, true)
+	return nil
+}
+
+// setDeadlines updates the deadlines and wakes a blocked Read so that it
+// picks up the new read deadline.
+func (c *pipeConn) setDeadlines(read time.Time, setRead bool, write time.Time, setWrite bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if setRead {
+		c.readDeadline = read
+	}
+	if setWrite {
+		c.writeDeadline = write
+	}
+	close(c.deadlineSet)
+	c.deadlineSet = make(chan struct{})
+}
+
+func (c *pipeConn) opError(op string, err error) error {
+	return &net.OpError{Op: op, Net: pipeNetwork, Addr: pipeAddr{}, Err: err}
+}
@@ -0,0 +1,155 @@
+package rpctest
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// ServerName is the DNS name in the server certificates issued by PKI.
+// Clients connecting through a PipeListener verify the server against it.
+const ServerName = "rpctest.local"
+
+// ClientName is the common name of the client certificate issued by NewPKI.
+const ClientName = "rpctest-client"
+
+// PKI is a throwaway certificate authority with a server and a client
+// certificate, written to a temporary directory because the server and
+// client constructors take file paths. The certificates are valid for a day.
+type PKI struct {
+	Dir string
+
+	// CACert is the path of the CA certificate, and CAKey of its key.
+	CACert string
+	CAKey  string
+
+	// ServerCert and ServerKey are valid for ServerName, localhost and the
+	// loopback addresses.
+	ServerCert string
+	ServerKey  string
+
+	// ClientCert and ClientKey are a client certificate for ClientName.
+	ClientCert string
+	ClientKey  string
+
+	ca    *x509.Certificate
+	caKey *ecdsa.PrivateKey
+}
+
+// NewPKI creates a CA and issues a server and a client certificate from it.
+// The files are removed when the test ends.
+func NewPKI(t testing.TB) *PKI {
+	t.Helper()
+
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("rpctest: failed to generate CA key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "rpctest CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatalf("rpctest: failed to create CA certificate: %v", err)
+	}
+	ca, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("rpctest: failed to parse CA certificate: %v", err)
+	}
+
+	p := &PKI{Dir: t.TempDir(), ca: ca, caKey: caKey}
+	p.CACert = p.write(t, "ca.crt", "CERTIFICATE", der)
+	p.CAKey = p.writeKey(t, "ca.key", caKey)
+	p.ServerCert, p.ServerKey = p.Issue(t, "server", &x509.Certificate{
+		Subject:     pkix.Name{CommonName: ServerName},
+		DNSNames:    []string{ServerName, "localhost"},
+		IPAddresses: []net.IP{net.ParseIP("127.0.0.1"), net.IPv6loopback},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	})
+	p.ClientCert, p.ClientKey = p.IssueClient(t, ClientName)
+	return p
+}
+
+// IssueClient issues a client certificate for commonName, carrying uris,
+// such as SPIFFE IDs, as URI SANs.
+func (p *PKI) IssueClient(t testing.TB, commonName string, uris ...string) (certPath, keyPath string) {
+	t.Helper()
+
+	template := &x509.Certificate{
+		Subject:     pkix.Name{CommonName: commonName},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	for _, s := range uris {
+		uri, err := url.Parse(s)
+		if err != nil {
+			t.Fatalf("rpctest: invalid URI %q: %v", s, err)
+		}
+		template.URIs = append(template.URIs, uri)
+	}
+	return p.Issue(t, commonName, template)
+}
+
+// Issue signs template with the CA and writes name.crt and name.key. The
+// serial number, key usage and, when unset, validity period are filled in.
+func (p *PKI) Issue(t testing.TB, name string, template *x509.Certificate) (certPath, keyPath string) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("rpctest: failed to generate key: %v", err)
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		t.Fatalf("rpctest: failed to generate serial number: %v", err)
+	}
+	template.SerialNumber = serial
+	template.KeyUsage = x509.KeyUsageDigitalSignature
+	if template.NotBefore.IsZero() {
+		template.NotBefore = time.Now().Add(-time.Hour)
+	}
+	if template.NotAfter.IsZero() {
+		template.NotAfter = time.Now().Add(24 * time.Hour)
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, p.ca, &key.PublicKey, p.caKey)
+	if err != nil {
+		t.Fatalf("rpctest: failed to issue certificate %s: %v", name, err)
+	}
+	return p.write(t, name+".crt", "CERTIFICATE", der), p.writeKey(t, name+".key", key)
+}
+
+func (p *PKI) writeKey(t testing.TB, name string, key *ecdsa.PrivateKey) string {
+	t.Helper()
+
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("rpctest: failed to encode key %s: %v", name, err)
+	}
+	return p.write(t, name, "EC PRIVATE KEY", der)
+}
+
+func (p *PKI) write(t testing.TB, name, blockType string, der []byte) string {
+	t.Helper()
+
+	path := filepath.Join(p.Dir, name)
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0o600); err != nil {
+		t.Fatalf("rpctest: failed to write %s: %v", path, err)
+	}
+	return path
+}
@@ -0,0 +1,133 @@
+package rpctest
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	swissknife "github.com/joey1123455/swiss-knife/lib/rpc"
+	"github.com/stretchr/testify/require"
+)
+
+type sumArgs struct{ A, B int }
+
+type sumReply struct{ Sum int }
+
+func TestServerOverPipe(t *testing.T) {
+	s := NewServer(t)
+	fake := s.Fake(t, "Math", JSON(func(args sumArgs) (sumReply, error) {
+		return sumReply{Sum: args.A + args.B}, nil
+	}))
+
+	client := s.Client(t)
+	reply, err := client.ConnectToRpcServerTls("Math.Call", []byte(`{"A":20,"B":22}`))
+	require.NoError(t, err)
+	require.JSONEq(t, `{"Sum":42}`, string(reply))
+
+	reply, err = client.ConnectToRpcServerTls("Math.Echo", []byte("hello"))
+	require.NoError(t, err)
+	require.Equal(t, "hello", string(reply))
+
+	_, err = client.ConnectToRpcServerTls("Math.Fail", []byte("boom"))
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "boom")
+
+	calls := fake.Calls()
+	require.Len(t, calls, 3)
+	require.Equal(t, "Call", calls[0].Method)
+	require.Equal(t, `{"A":20,"B":22}`, string(calls[0].Args))
+	require.Equal(t, "CN="+ClientName, calls[0].Identity)
+	require.Equal(t, "Fail", calls[2].Method)
+
+	s.Log.AssertLogged(t, swissknife.LogLevelInfo, "Successfully registered RPC service: Math")
+	s.Log.AssertNotLogged(t, swissknife.LogLevelError, "")
+}
+
+func TestServerRejectsUnknownClientCertificate(t *testing.T) {
+	s := NewServer(t)
+	other := NewPKI(t)
+
+	client, err := s.Dial(other.ClientCert, other.ClientKey)
+	if err == nil {
+		// With TLS 1.3 the client learns of the rejection on its first call.
+		defer client.CloseClient()
+		_, err = client.ConnectToRpcServerTls("Math.Echo", nil)
+	}
+	require.Error(t, err)
+	s.Log.WaitFor(t, swissknife.LogLevelError, "TLS handshake failed", 2*time.Second)
+}
+
+func TestClientsWithOwnCertificates(t *testing.T) {
+	s := NewServer(t, swissknife.WithSPIFFEAuthorization(swissknife.SPIFFERule{Allow: []string{"spiffe://test/**"}}))
+	fake := s.Fake(t, "Svc", nil)
+
+	certPath, keyPath := s.PKI.IssueClient(t, "worker", "spiffe://test/worker")
+	client, err := s.Dial(certPath, keyPath)
+	require.NoError(t, err)
+	defer client.CloseClient()
+
+	_, err = client.ConnectToRpcServerTls("Svc.Call", []byte("x"))
+	require.NoError(t, err)
+	require.Equal(t, "CN=worker", fake.Calls()[0].Identity)
+
+	_, err = s.Client(t).ConnectToRpcServerTls("Svc.Call", []byte("x"))
+	require.ErrorIs(t, err, swissknife.ErrPermissionDenied)
+}
+
+func TestPipeListenerClose(t *testing.T) {
+	l := NewPipeListener()
+	require.NoError(t, l.Close())
+
+	_, err := l.Accept()
+	require.True(t, errors.Is(err, net.ErrClosed))
+	_, err = l.DialContext(context.Background(), "pipe", "pipe")
+	require.True(t, errors.Is(err, net.ErrClosed))
+}
+
+func TestPipeDeadlinesAndClose(t *testing.T) {
+	a, b := newPipe()
+
+	require.NoError(t, a.SetReadDeadline(time.Now().Add(20*time.Millisecond)))
+	_, err := a.Read(make([]byte, 1))
+	require.True(t, errors.Is(err, os.ErrDeadlineExceeded))
+
+	// Writes are buffered and never wait for the reader.
+	_, err = b.Write([]byte("hello"))
+	require.NoError(t, err)
+	require.NoError(t, b.Close())
+
+	require.NoError(t, a.SetReadDeadline(time.Time{}))
+	data, err := io.ReadAll(a)
+	require.NoError(t, err)
+	require.Equal(t, "hello", string(data))
+
+	_, err = a.Write([]byte("x"))
+	require.Error(t, err)
+}
+
+func TestLogRecorder(t *testing.T) {
+	r := NewLogRecorder()
+	r.SetLevel(swissknife.LogLevelInfo)
+	r.Debug("hidden")
+	r.Infof("shown %d", 1)
+	r.Warn("careful", "now")
+
+	require.Equal(t, []LogEntry{
+		{Level: swissknife.LogLevelInfo, Message: "shown 1"},
+		{Level: swissknife.LogLevelWarn, Message: "careful now"},
+	}, r.Entries())
+	require.True(t, r.Contains(swissknife.LogLevelWarn, "careful"))
+	require.False(t, r.Contains(swissknife.LogLevelInfo, "careful"))
+	require.True(t, strings.HasPrefix(r.String(), "INFO: shown 1\n"))
+
+	require.Panics(t, func() { r.Fatalf("fatal %s", "error") })
+	require.True(t, r.Contains(swissknife.LogLevelFatal, "fatal error"))
+
+	r.Reset()
+	require.Empty(t, r.Entries())
+}
@@ -0,0 +1,105 @@
+package rpctest
+
+import (
+	"testing"
+
+	swissknife "github.com/joey1123455/swiss-knife/lib/rpc"
+)
+
+// Server is a TLS RPC server serving over a PipeListener, with its
+// certificates and captured logs.
+type Server struct {
+	swissknife.ITlsRpcServer
+
+	PKI      *PKI
+	Listener *PipeListener
+
+	// Log captures the server's output, and ClientLog the output of the
+	// clients created by Client and Dial.
+	Log       *LogRecorder
+	ClientLog *LogRecorder
+}
+
+// NewServer starts a server with a fresh PKI. It is closed when the test
+// ends.
+func NewServer(t testing.TB, opts ...swissknife.ServerOption) *Server {
+	t.Helper()
+	return NewPKI(t).NewServer(t, opts...)
+}
+
+// NewServer starts a server using the server certificate of p. It is closed
+// when the test ends.
+func (p *PKI) NewServer(t testing.TB, opts ...swissknife.ServerOption) *Server {
+	t.Helper()
+
+	listener := NewPipeListener()
+	server, err := swissknife.NewITlsRpcServerListener(p.ServerCert, p.ServerKey, p.CACert, listener, opts...)
+	if err != nil {
+		listener.Close()
+		t.Fatalf("rpctest: failed to create server: %v", err)
+	}
+	s := &Server{
+		ITlsRpcServer: server,
+		PKI:           p,
+		Listener:      listener,
+		Log:           NewLogRecorder(),
+		ClientLog:     NewLogRecorder(),
+	}
+	server.SetLogger(s.Log)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		server.Serve()
+	}()
+	t.Cleanup(func() {
+		server.CloseServer()
+		<-done
+	})
+	return s
+}
+
+// Register registers service under name, failing the test on error.
+func (s *Server) Register(t testing.TB, name string, service any) {
+	t.Helper()
+	if err := s.RegisterMethod(name, service); err != nil {
+		t.Fatalf("rpctest: failed to register %s: %v", name, err)
+	}
+}
+
+// Fake registers a FakeService running handler under name and returns it.
+func (s *Server) Fake(t testing.TB, name string, handler HandlerFunc) *FakeService {
+	t.Helper()
+
+	fake := NewFakeService(handler)
+	s.Register(t, name, fake)
+	return fake
+}
+
+// Client connects a client using the client certificate of the PKI,
+// failing the test on error. It is closed when the test ends.
+func (s *Server) Client(t testing.TB, opts ...swissknife.ClientOption) swissknife.ITlsRpcClient {
+	t.Helper()
+
+	client, err := s.Dial(s.PKI.ClientCert, s.PKI.ClientKey, opts...)
+	if err != nil {
+		t.Fatalf("rpctest: failed to connect client: %v", err)
+	}
+	t.Cleanup(client.CloseClient)
+	return client
+}
+
+// Dial connects a client with the given certificate, which may be empty to
+// connect without one. The caller closes the client.
+func (s *Server) Dial(certPath, keyPath string, opts ...swissknife.ClientOption) (swissknife.ITlsRpcClient, error) {
+	opts = append([]swissknife.ClientOption{
+		swissknife.WithDialContext(s.Listener.DialContext),
+		swissknife.WithServerName(ServerName),
+	}, opts...)
+	client, err := swissknife.NewITlsRpcClient(s.PKI.CACert, certPath, keyPath, pipeNetwork, ClientName, opts...)
+	if err != nil {
+		return nil, err
+	}
+	client.SetLogger(s.ClientLog)
+	return client, nil
+}
@@ -0,0 +1,35 @@
+package swissknife
+
+import (
+	"errors"
+	"time"
+)
+
+const (
+	// minAcceptBackoff and maxAcceptBackoff bound the delay between retries
+	// after a temporary accept error.
+	minAcceptBackoff = 5 * time.Millisecond
+	maxAcceptBackoff = time.Second
+)
+
+// ErrServerClosed is returned by Serve and ServeContext after the server has
+// been closed.
+var ErrServerClosed = errors.New("rpc: server closed")
+
+// isTemporary reports whether an accept error is expected to clear up on its
+// own, such as running out of file descriptors.
+func isTemporary(err error) bool {
+	var temporary interface{ Temporary() bool }
+	return errors.As(err, &temporary) && temporary.Temporary()
+}
+
+// nextAcceptBackoff doubles the previous backoff within the allowed range.
+func nextAcceptBackoff(previous time.Duration) time.Duration {
+	if previous == 0 {
+		return minAcceptBackoff
+	}
+	if next := 2 * previous; next < maxAcceptBackoff {
+		return next
+	}
+	return maxAcceptBackoff
+}
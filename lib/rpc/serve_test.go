@@ -0,0 +1,134 @@
+package swissknife
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+type temporaryError struct{}
+
+func (temporaryError) Error() string   { return "temporary failure" }
+func (temporaryError) Temporary() bool { return true }
+func (temporaryError) Timeout() bool   { return false }
+
+// scriptedListener returns the queued errors from Accept, then blocks until
+// it is closed.
+type scriptedListener struct {
+	mu      sync.Mutex
+	errs    []error
+	accepts int
+	closed  chan struct{}
+	once    sync.Once
+}
+
+func newScriptedListener(errs ...error) *scriptedListener {
+	return &scriptedListener{errs: errs, closed: make(chan struct{})}
+}
+
+func (l *scriptedListener) Accept() (net.Conn, error) {
+	l.mu.Lock()
+	l.accepts++
+	if len(l.errs) > 0 {
+		err := l.errs[0]
+		l.errs = l.errs[1:]
+		l.mu.Unlock()
+		return nil, err
+	}
+	l.mu.Unlock()
+
+	<-l.closed
+	return nil, net.ErrClosed
+}
+
+func (l *scriptedListener) Close() error {
+	l.once.Do(func() { close(l.closed) })
+	return nil
+}
+
+func (l *scriptedListener) Addr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}
+}
+
+func newScriptedServer(t *testing.T, listener net.Listener) ITlsRpcServer {
+	t.Helper()
+
+	pki := newTestPKI(t)
+	server, err := NewITlsRpcServerListener(pki.serverCert, pki.serverKey, pki.caCert, listener)
+	require.NoError(t, err)
+	server.SetLogger(newTestLogger(&bytes.Buffer{}, &bytes.Buffer{}, LogLevelDebug))
+	return server
+}
+
+func TestServeReturnsErrServerClosed(t *testing.T) {
+	pki := newTestPKI(t)
+	server, err := NewITlsRpcServer(pki.serverCert, pki.serverKey, pki.caCert, "0")
+	require.NoError(t, err)
+	server.SetLogger(newTestLogger(&bytes.Buffer{}, &bytes.Buffer{}, LogLevelDebug))
+
+	done := make(chan error, 1)
+	go func() { done <- server.Serve() }()
+	time.Sleep(50 * time.Millisecond)
+	server.CloseServer()
+	server.CloseServer()
+
+	select {
+	case err := <-done:
+		require.ErrorIs(t, err, ErrServerClosed)
+	case <-time.After(2 * time.Second):
+		t.Fatal("Serve did not return after CloseServer")
+	}
+}
+
+func TestServeRetriesTemporaryErrors(t *testing.T) {
+	listener := newScriptedListener(temporaryError{}, temporaryError{}, temporaryError{})
+	server := newScriptedServer(t, listener)
+
+	done := make(chan error, 1)
+	go func() { done <- server.Serve() }()
+	require.Eventually(t, func() bool {
+		listener.mu.Lock()
+		defer listener.mu.Unlock()
+		return listener.accepts == 4
+	}, 2*time.Second, 5*time.Millisecond)
+
+	server.CloseServer()
+	require.ErrorIs(t, <-done, ErrServerClosed)
+}
+
+func TestServeReturnsPermanentErrors(t *testing.T) {
+	failure := errors.New("listener broke")
+	server := newScriptedServer(t, newScriptedListener(failure))
+
+	err := server.Serve()
+	require.ErrorIs(t, err, failure)
+	require.False(t, errors.Is(err, ErrServerClosed))
+}
+
+func TestServeContextStopsOnCancel(t *testing.T) {
+	server := newScriptedServer(t, newScriptedListener())
+	ctx, cancel := context.WithCancel(context.Background())
+
+	done := make(chan error, 1)
+	go func() { done <- server.ServeContext(ctx) }()
+	cancel()
+
+	select {
+	case err := <-done:
+		require.ErrorIs(t, err, ErrServerClosed)
+	case <-time.After(2 * time.Second):
+		t.Fatal("ServeContext did not return after cancel")
+	}
+}
+
+func TestNextAcceptBackoff(t *testing.T) {
+	require.Equal(t, minAcceptBackoff, nextAcceptBackoff(0))
+	require.Equal(t, 2*minAcceptBackoff, nextAcceptBackoff(minAcceptBackoff))
+	require.Equal(t, maxAcceptBackoff, nextAcceptBackoff(maxAcceptBackoff))
+}
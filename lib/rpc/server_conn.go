@@ -0,0 +1,508 @@
+package swissknife
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/rpc"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// rejectTimeout bounds how long a connection refused for exceeding
+// MaxConnections is kept open to deliver the rejection.
+const rejectTimeout = 5 * time.Second
+
+// serverConn is a single client connection accepted by a tlsRpcServer.
+type serverConn struct {
+	server *tlsRpcServer
+	conn   net.Conn
+	codec  *serverCodec
+	remote string
+
+	// info describes the connection once the handshake has completed, and
+	// identity is the subject of the verified client certificate, or empty
+	// when the client presented none. Both are written under mu so that
+	// Connections can read them.
+	info     ConnInfo
+	identity string
+	accepted time.Time
+
+	// peer is set when the connection is bidirectional.
+	peer *Peer
+
+	// ctx is the parent of every call's context. It is cancelled once the
+	// read loop stops, when the client has gone away.
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// lastHeard is when the last request or heartbeat arrived; heartbeating
+	// is set once the client has sent a heartbeat. Both are only touched by
+	// the read loop.
+	lastHeard    time.Time
+	heartbeating bool
+
+	id uint64
+
+	mu          sync.Mutex
+	active      map[*serverRequest]time.Time
+	callsServed int64
+	lastActive  time.Time
+	calls       sync.WaitGroup
+}
+
+func newServerConn(s *tlsRpcServer, conn net.Conn) *serverConn {
+	now := time.Now()
+	received, sent := s.metrics.byteCounters()
+	ctx, cancel := context.WithCancel(context.Background())
+	return &serverConn{
+		server:     s,
+		conn:       conn,
+		codec:      newServerCodec(conn, s.limits.MaxRequestSize, s.timeouts, received, sent),
+		remote:     conn.RemoteAddr().String(),
+		accepted:   now,
+		lastHeard:  now,
+		lastActive: now,
+		id:         s.nextConnID.Add(1),
+		active:     make(map[*serverRequest]time.Time),
+		ctx:        ctx,
+		cancel:     cancel,
+	}
+}
+
+// serve completes the handshake, runs the connection hooks and then reads
+// requests until the connection fails or is closed, dispatching each one on
+// its own goroutine. It returns the error that ended the connection once
+// every call has replied.
+func (sc *serverConn) serve() error {
+	hooks := sc.server.hooks
+	defer sc.cancel()
+	if err := sc.handshake(); err != nil {
+		sc.server.logger.Errorf("TLS handshake failed for client %s: %v", sc.remote, err)
+		sc.server.metrics.handshakeFailed()
+		if hooks.OnHandshakeFailure != nil {
+			hooks.OnHandshakeFailure(sc.conn.RemoteAddr(), err)
+		}
+		return err
+	}
+
+	if sc.info.TLSVersion != 0 {
+		sc.server.logger.Infof("Client %s (%s) negotiated %s", sc.remote, sc.identity, describeTLS(sc.info.TLSVersion, sc.info.CipherSuite))
+	}
+
+	if hooks.OnConnect != nil {
+		if err := hooks.OnConnect(sc.info); err != nil {
+			sc.server.logger.Warnf("Rejecting client %s (%s): %v", sc.remote, sc.identity, err)
+			sc.codec.refuse(ErrConnectionRejected, rejectTimeout)
+			return err
+		}
+	}
+
+	err := sc.readLoop()
+	sc.cancel()
+	sc.peer.close()
+	sc.calls.Wait()
+	if hooks.OnDisconnect != nil {
+		hooks.OnDisconnect(sc.info, err)
+	}
+	return err
+}
+
+// readLoop reads and dispatches requests until reading fails.
+func (sc *serverConn) readLoop() error {
+	for {
+		if err := sc.awaitRequest(); err != nil {
+			sc.server.logger.Debugf("Stopped reading from client %s: %v", sc.remote, err)
+			return err
+		}
+
+		req, err := sc.codec.readRequest()
+		if err != nil {
+			if !sc.readFailed(req, err) {
+				return err
+			}
+			continue
+		}
+
+		sc.lastHeard = time.Now()
+		if req.response != nil {
+			sc.peer.deliver(req.response, req.args)
+			continue
+		}
+		if req.header.ServiceMethod == heartbeatMethod {
+			sc.heartbeating = true
+			sc.reply(req, nil, nil)
+			continue
+		}
+
+		// The calls in a batch are admitted one by one when it runs.
+		if req.header.ServiceMethod != batchMethod {
+			if err := sc.admit(req); err != nil {
+				sc.reject(req, err)
+				continue
+			}
+		}
+
+		if !sc.acquire(req) {
+			sc.server.logger.Warnf("Rejecting call %s from %s: %v", req.header.ServiceMethod, sc.remote, ErrTooManyCalls)
+			sc.reject(req, ErrTooManyCalls)
+			continue
+		}
+
+		sc.calls.Add(1)
+		go sc.dispatch(req)
+	}
+}
+
+// handshake completes the TLS handshake, when the connection is TLS, and
+// records the connection details and verified client identity.
+func (sc *serverConn) handshake() error {
+	if tlsConn, ok := sc.conn.(*tls.Conn); ok {
+		sc.conn.SetDeadline(deadline(sc.server.timeouts.HandshakeTimeout))
+		defer sc.conn.SetDeadline(time.Time{})
+		if err := tlsConn.Handshake(); err != nil {
+			return err
+		}
+	}
+	info := newConnInfo(sc.conn)
+	if info.NegotiatedProtocol == bidiProtocol {
+		sc.codec.bidi = true
+		sc.peer = newPeer(sc.codec, sc.remote)
+		info.Peer = sc.peer
+	}
+	sc.mu.Lock()
+	sc.info = info
+	sc.identity = info.Identity()
+	sc.mu.Unlock()
+	return nil
+}
+
+// awaitRequest blocks until the next request starts arriving. It closes the
+// connection once it has been idle for IdleTimeout, or once a client that
+// sends heartbeats has been silent for HeartbeatTimeout.
+func (sc *serverConn) awaitRequest() error {
+	timeouts := sc.server.timeouts
+	for {
+		var idleAt, deadAt time.Time
+		if timeouts.IdleTimeout > 0 {
+			idleAt = sc.idleSince().Add(timeouts.IdleTimeout)
+		}
+		if sc.heartbeating && timeouts.HeartbeatTimeout > 0 {
+			deadAt = sc.lastHeard.Add(timeouts.HeartbeatTimeout)
+		}
+
+		sc.conn.SetReadDeadline(earliest(idleAt, deadAt))
+		err := sc.codec.reader.awaitFrame()
+		if err == nil || !isTimeout(err) {
+			return err
+		}
+
+		now := time.Now()
+		if !deadAt.IsZero() && !now.Before(deadAt) {
+			sc.server.logger.Warnf("Closing connection from %s: no heartbeat for %s", sc.remote, timeouts.HeartbeatTimeout)
+			return err
+		}
+		if timeouts.IdleTimeout > 0 && now.Sub(sc.idleSince()) >= timeouts.IdleTimeout {
+			sc.server.logger.Infof("Closing connection from %s: idle for %s", sc.remote, timeouts.IdleTimeout)
+			return err
+		}
+	}
+}
+
+// idleSince returns when the connection last became idle. While calls are in
+// flight in either direction the connection is not idle, which is reported
+// as the current time.
+func (sc *serverConn) idleSince() time.Time {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	if len(sc.active) > 0 || sc.peer.busy() {
+		return time.Now()
+	}
+	return sc.lastActive
+}
+
+// admit decides whether req may run, returning the error to send back to the
+// client when it may not.
+func (sc *serverConn) admit(req *serverRequest) error {
+	method := req.header.ServiceMethod
+	if len(sc.info.PeerCertificates) == 0 && !sc.server.unauthenticated[method] {
+		sc.server.logger.Warnf("Rejecting call %s from %s: %v", method, sc.remote, ErrUnauthenticated)
+		return ErrUnauthenticated
+	}
+	if sc.server.requireTokens && !sc.server.unauthenticated[method] {
+		principal, err := sc.server.authenticateToken(req.header.Token, sc.info)
+		if err != nil {
+			sc.server.logger.Warnf("Rejecting call %s from %s (%s): %v", method, sc.remote, sc.identity, err)
+			return err
+		}
+		req.principal = principal
+	}
+	if sc.server.spiffe != nil && !sc.server.unauthenticated[method] {
+		if err := sc.server.spiffe.authorize(sc.info, method); err != nil {
+			sc.server.logger.Warnf("Rejecting call %s from %s (%s): %v", method, sc.remote, sc.identity, err)
+			return err
+		}
+	}
+	if err := sc.server.checkRateLimit(sc.identity, method); err != nil {
+		sc.server.logger.Warnf("Rejecting call %s from %s (%s): %v", method, sc.remote, sc.identity, err)
+		return err
+	}
+	return nil
+}
+
+// readFailed handles an error from readRequest and reports whether the
+// connection can keep serving.
+func (sc *serverConn) readFailed(req *serverRequest, err error) bool {
+	if errors.Is(err, ErrRequestTooLarge) {
+		sc.server.logger.Warnf("Closing connection from %s: %v (limit %d bytes)", sc.remote, err, sc.server.limits.MaxRequestSize)
+		if req != nil {
+			sc.reject(req, err)
+		}
+		return false
+	}
+
+	if req == nil || sc.codec.broken() {
+		sc.server.logger.Debugf("Stopped reading from client %s: %v", sc.remote, err)
+		return false
+	}
+
+	// The body was read in full but did not decode; answer and carry on.
+	sc.server.logger.Warnf("Invalid request body for %s from %s: %v", req.header.ServiceMethod, sc.remote, err)
+	sc.reject(req, fmt.Errorf("rpc: cannot decode request body: %w", err))
+	return true
+}
+
+// acquire reserves a call slot for req, honouring MaxConcurrentCalls.
+func (sc *serverConn) acquire(req *serverRequest) bool {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	if limit := sc.server.limits.MaxConcurrentCalls; limit > 0 && len(sc.active) >= limit {
+		return false
+	}
+	sc.active[req] = time.Now()
+	return true
+}
+
+func (sc *serverConn) release(req *serverRequest) {
+	sc.mu.Lock()
+	delete(sc.active, req)
+	sc.callsServed++
+	sc.lastActive = time.Now()
+	sc.mu.Unlock()
+}
+
+// dispatch runs a single call, or a batch of calls, and writes the reply.
+func (sc *serverConn) dispatch(req *serverRequest) {
+	defer sc.calls.Done()
+	defer sc.release(req)
+
+	ctx, cancel := deadlineContext(sc.ctx, req.deadline)
+	defer cancel()
+
+	if req.header.ServiceMethod != batchMethod {
+		reply, err := sc.call(ctx, req)
+		sc.reply(req, reply, err)
+		return
+	}
+
+	reply, err := sc.runBatch(ctx, req)
+	if err == nil {
+		if limit := sc.server.limits.MaxResponseSize; limit > 0 && int64(len(reply)) > limit {
+			sc.server.logger.Warnf("Dropping %d byte batch reply for client %s: %v", len(reply), sc.remote, ErrResponseTooLarge)
+			reply, err = nil, ErrResponseTooLarge
+		}
+	}
+	sc.reply(req, reply, err)
+}
+
+// call runs the registered method named by req with ctx and records its
+// outcome. Calls whose caller has already given up are not run, and repeats
+// of a call with the same idempotency key get the first call's outcome.
+func (sc *serverConn) call(ctx context.Context, req *serverRequest) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		sc.server.logger.Debugf("Skipping call %s from %s: %v", req.header.ServiceMethod, sc.remote, err)
+		sc.server.metrics.callRejected(sc.server.methodLabel(req.header.ServiceMethod), err)
+		return nil, err
+	}
+
+	scope := sc.idempotencyScope(req)
+	if scope == "" {
+		return sc.run(ctx, req)
+	}
+	ran := false
+	reply, replayed, err := sc.server.idempotency.do(ctx, scope, req.args, func() ([]byte, error) {
+		ran = true
+		return sc.run(ctx, req)
+	})
+	switch {
+	case replayed:
+		sc.server.logger.Debugf("Replaying outcome of call %s with idempotency key %q to %s", req.header.ServiceMethod, req.header.IdempotencyKey, sc.remote)
+	case !ran:
+		sc.server.logger.Warnf("Rejecting call %s from %s (%s): %v", req.header.ServiceMethod, sc.remote, sc.identity, err)
+		sc.server.metrics.callRejected(sc.server.methodLabel(req.header.ServiceMethod), err)
+	}
+	return reply, err
+}
+
+// run invokes the registered method named by req with ctx and records its
+// outcome.
+func (sc *serverConn) run(ctx context.Context, req *serverRequest) ([]byte, error) {
+	started := time.Now()
+	reply, err := sc.server.invoke(req.header.ServiceMethod, &Request{Args: req.args, Conn: sc.info, Principal: req.principal, ctx: ctx})
+	if err == nil {
+		if limit := sc.server.limits.MaxResponseSize; limit > 0 && int64(len(reply)) > limit {
+			sc.server.logger.Warnf("Dropping %d byte reply to %s for client %s: %v", len(reply), req.header.ServiceMethod, sc.remote, ErrResponseTooLarge)
+			reply, err = nil, ErrResponseTooLarge
+		}
+	}
+	sc.server.metrics.callDone(sc.server.methodLabel(req.header.ServiceMethod), err, time.Since(started))
+	return reply, err
+}
+
+// reject answers req with err without running it.
+func (sc *serverConn) reject(req *serverRequest, err error) {
+	sc.server.metrics.callRejected(sc.server.methodLabel(req.header.ServiceMethod), err)
+	sc.reply(req, nil, err)
+}
+
+// reply writes the response for req. A failed write closes the connection so
+// the read loop stops as well.
+func (sc *serverConn) reply(req *serverRequest, reply []byte, callErr error) {
+	header := &responseHeader{
+		ServiceMethod: req.header.ServiceMethod,
+		Seq:           req.header.Seq,
+	}
+	if callErr != nil {
+		header.Error = callErr.Error()
+	}
+
+	if err := sc.codec.writeResponse(header, reply); err != nil {
+		sc.server.logger.Errorf("Failed to write response for %s to client %s: %v", req.header.ServiceMethod, sc.remote, err)
+		sc.conn.Close()
+	}
+}
+
+// rejectConnection answers the first request on conn with err and closes it.
+// It is used for connections refused by a server-wide limit so the client
+// sees an explicit error instead of a dropped connection.
+func (s *tlsRpcServer) rejectConnection(conn net.Conn, err error) {
+	defer conn.Close()
+
+	received, sent := s.metrics.byteCounters()
+	codec := newServerCodec(conn, s.limits.MaxRequestSize, s.timeouts, received, sent)
+	if readErr := codec.refuse(err, rejectTimeout); readErr != nil {
+		s.logger.Debugf("Rejected client %s went away: %v", conn.RemoteAddr().String(), readErr)
+	}
+}
+
+// invoke calls a registered method with the given request and returns its
+// reply. Panics raised by the method are converted into errors.
+func (s *tlsRpcServer) invoke(serviceMethod string, req *Request) ([]byte, error) {
+	return invokeService(s.rpcServer, s.logger, serviceMethod, req)
+}
+
+// invokeService calls a method registered on services, as invoke does. It
+// also runs the services a client registered with WithClientService.
+func invokeService(services *rpc.Server, logger Logger, serviceMethod string, req *Request) (reply []byte, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			logger.Errorf("RPC method %s panicked: %v", serviceMethod, r)
+			reply, err = nil, fmt.Errorf("rpc: method %s panicked", serviceMethod)
+		}
+	}()
+
+	codec := &callCodec{serviceMethod: serviceMethod, req: req}
+	services.ServeRequest(codec)
+	if codec.err != "" {
+		return nil, errors.New(codec.err)
+	}
+	return codec.reply, nil
+}
+
+var (
+	bytesType   = reflect.TypeOf([]byte(nil))
+	requestType = reflect.TypeOf(Request{})
+	errorType   = reflect.TypeOf((*error)(nil)).Elem()
+)
+
+// checkServiceTypes returns an error naming the first method of service that
+// net/rpc would register but callCodec cannot serve. Arguments cross the
+// connection as raw bytes, so methods must take []byte or Request, by value
+// or pointer, and reply with *[]byte.
+func checkServiceTypes(service any) error {
+	typ := reflect.TypeOf(service)
+	for i := 0; i < typ.NumMethod(); i++ {
+		method := typ.Method(i)
+		mtype := method.Type
+		// Mirror net/rpc, which ignores methods without the shape
+		// func (t *T) Method(args A, reply *R) error.
+		if !method.IsExported() || mtype.NumIn() != 3 || mtype.NumOut() != 1 ||
+			mtype.Out(0) != errorType || mtype.In(2).Kind() != reflect.Pointer {
+			continue
+		}
+		args := mtype.In(1)
+		if args.Kind() == reflect.Pointer {
+			args = args.Elem()
+		}
+		if args != bytesType && args != requestType {
+			return fmt.Errorf("method %s takes %s; methods must take *[]byte or *swissknife.Request", method.Name, mtype.In(1))
+		}
+		if mtype.In(2).Elem() != bytesType {
+			return fmt.Errorf("method %s replies with %s; methods must reply with *[]byte", method.Name, mtype.In(2))
+		}
+	}
+	return nil
+}
+
+// callCodec is a single-use rpc.ServerCodec that feeds one already decoded
+// request to rpc.Server.ServeRequest and captures the result. It lets the
+// server keep net/rpc's method registry while owning the connection.
+type callCodec struct {
+	serviceMethod string
+	req           *Request
+	reply         []byte
+	err           string
+}
+
+func (c *callCodec) ReadRequestHeader(r *rpc.Request) error {
+	r.ServiceMethod = c.serviceMethod
+	return nil
+}
+
+func (c *callCodec) ReadRequestBody(body any) error {
+	switch b := body.(type) {
+	case nil:
+		return nil
+	case *[]byte:
+		*b = c.req.Args
+		return nil
+	case *Request:
+		*b = *c.req
+		return nil
+	default:
+		return fmt.Errorf("rpc: unsupported argument type %T for %s", body, c.serviceMethod)
+	}
+}
+
+func (c *callCodec) WriteResponse(r *rpc.Response, body any) error {
+	if r.Error != "" {
+		c.err = r.Error
+		return nil
+	}
+	reply, ok := body.(*[]byte)
+	if !ok {
+		c.err = fmt.Sprintf("rpc: unsupported reply type %T for %s", body, c.serviceMethod)
+		return nil
+	}
+	c.reply = *reply
+	return nil
+}
+
+func (c *callCodec) Close() error {
+	return nil
+}
@@ -0,0 +1,267 @@
+package swissknife
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// ErrPermissionDenied is returned for calls the caller is not authorized to
+// make.
+var ErrPermissionDenied = errors.New("rpc: permission denied")
+
+// SPIFFEID is a SPIFFE identity such as spiffe://corp/ns/payments/sa/api,
+// carried as a URI SAN of an X.509 certificate.
+type SPIFFEID struct {
+	TrustDomain string
+	Path        string
+}
+
+// String returns the ID in its URI form.
+func (id SPIFFEID) String() string {
+	return "spiffe://" + id.TrustDomain + id.Path
+}
+
+// ParseSPIFFEID parses and validates a SPIFFE ID: the trust domain must be
+// lower case letters, digits, '.', '-' and '_', and the path must consist
+// of non-empty segments of letters, digits, '.', '-' and '_' other than "."
+// and "..". Query, fragment, port and user info are not allowed.
+func ParseSPIFFEID(s string) (SPIFFEID, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return SPIFFEID{}, fmt.Errorf("invalid SPIFFE ID %q: %w", s, err)
+	}
+	if u.Scheme != "spiffe" {
+		return SPIFFEID{}, fmt.Errorf("invalid SPIFFE ID %q: scheme must be spiffe", s)
+	}
+	if u.User != nil || u.Port() != "" || u.RawQuery != "" || u.Fragment != "" || u.Opaque != "" {
+		return SPIFFEID{}, fmt.Errorf("invalid SPIFFE ID %q: only a trust domain and path are allowed", s)
+	}
+	if u.Host == "" || !validSPIFFEChars(u.Host, false) {
+		return SPIFFEID{}, fmt.Errorf("invalid SPIFFE ID %q: invalid trust domain", s)
+	}
+	if u.Path != "" {
+		for _, segment := range strings.Split(u.Path[1:], "/") {
+			if segment == "" || segment == "." || segment == ".." || !validSPIFFEChars(segment, true) {
+				return SPIFFEID{}, fmt.Errorf("invalid SPIFFE ID %q: invalid path segment %q", s, segment)
+			}
+		}
+	}
+	return SPIFFEID{TrustDomain: u.Host, Path: u.Path}, nil
+}
+
+func validSPIFFEChars(s string, upper bool) bool {
+	for _, r := range s {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9', r == '.', r == '-', r == '_':
+		case upper && r >= 'A' && r <= 'Z':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// SPIFFEIDFromCertificate returns the SPIFFE ID of cert, which must carry
+// exactly one spiffe URI SAN.
+func SPIFFEIDFromCertificate(cert *x509.Certificate) (SPIFFEID, error) {
+	var found []string
+	for _, uri := range cert.URIs {
+		if uri.Scheme == "spiffe" {
+			found = append(found, uri.String())
+		}
+	}
+	switch len(found) {
+	case 0:
+		return SPIFFEID{}, fmt.Errorf("certificate %s has no SPIFFE ID", cert.Subject)
+	case 1:
+		return ParseSPIFFEID(found[0])
+	}
+	return SPIFFEID{}, fmt.Errorf("certificate %s has %d SPIFFE IDs", cert.Subject, len(found))
+}
+
+// SPIFFEID returns the SPIFFE ID of the peer's certificate.
+func (c ConnInfo) SPIFFEID() (SPIFFEID, error) {
+	if len(c.PeerCertificates) == 0 {
+		return SPIFFEID{}, errors.New("peer presented no certificate")
+	}
+	return SPIFFEIDFromCertificate(c.PeerCertificates[0])
+}
+
+// spiffePattern matches SPIFFE IDs. Patterns are written like IDs, with
+// path.Match wildcards allowed in the trust domain and in each path segment,
+// and a final "**" segment matching any number of remaining segments:
+// spiffe://corp/ns/*/sa/api or spiffe://corp/ns/payments/**.
+type spiffePattern struct {
+	trustDomain string
+	segments    []string
+}
+
+func parseSPIFFEPattern(s string) (spiffePattern, error) {
+	rest, ok := strings.CutPrefix(s, "spiffe://")
+	if !ok {
+		return spiffePattern{}, fmt.Errorf("invalid SPIFFE pattern %q: must start with spiffe://", s)
+	}
+	trustDomain, pathPart, _ := strings.Cut(rest, "/")
+	p := spiffePattern{trustDomain: trustDomain}
+	if pathPart != "" {
+		p.segments = strings.Split(pathPart, "/")
+	}
+
+	for i, segment := range append([]string{trustDomain}, p.segments...) {
+		if segment == "" {
+			return spiffePattern{}, fmt.Errorf("invalid SPIFFE pattern %q: empty segment", s)
+		}
+		if segment == "**" {
+			if i != len(p.segments) || i == 0 {
+				return spiffePattern{}, fmt.Errorf("invalid SPIFFE pattern %q: ** must be the last path segment", s)
+			}
+			continue
+		}
+		if _, err := path.Match(segment, ""); err != nil {
+			return spiffePattern{}, fmt.Errorf("invalid SPIFFE pattern %q: %w", s, err)
+		}
+	}
+	return p, nil
+}
+
+func (p spiffePattern) match(id SPIFFEID) bool {
+	if ok, _ := path.Match(p.trustDomain, id.TrustDomain); !ok {
+		return false
+	}
+
+	var segments []string
+	if id.Path != "" {
+		segments = strings.Split(id.Path[1:], "/")
+	}
+	for i, pattern := range p.segments {
+		if pattern == "**" {
+			return true
+		}
+		if i >= len(segments) {
+			return false
+		}
+		if ok, _ := path.Match(pattern, segments[i]); !ok {
+			return false
+		}
+	}
+	return len(segments) == len(p.segments)
+}
+
+// parseSPIFFEPatterns parses every pattern in patterns.
+func parseSPIFFEPatterns(patterns []string) ([]spiffePattern, error) {
+	parsed := make([]spiffePattern, 0, len(patterns))
+	for _, s := range patterns {
+		p, err := parseSPIFFEPattern(s)
+		if err != nil {
+			return nil, err
+		}
+		parsed = append(parsed, p)
+	}
+	return parsed, nil
+}
+
+func matchAnySPIFFE(patterns []spiffePattern, id SPIFFEID) bool {
+	for _, p := range patterns {
+		if p.match(id) {
+			return true
+		}
+	}
+	return false
+}
+
+// SPIFFERule allows callers whose SPIFFE ID matches one of Allow to call the
+// methods matching Methods.
+type SPIFFERule struct {
+	// Methods are path.Match patterns on "Service.Method", such as
+	// "Payments.*". Empty matches every method.
+	Methods []string
+
+	// Allow are SPIFFE ID patterns, such as "spiffe://corp/ns/payments/**".
+	Allow []string
+}
+
+// WithSPIFFEAuthorization authorizes every call by the SPIFFE ID of the
+// caller's certificate: a call is allowed when a rule matching its method
+// allows the caller. Calls matched by no rule, and callers without a valid
+// SPIFFE ID, are refused with ErrPermissionDenied. Methods listed in
+// WithUnauthenticatedMethods are exempt.
+func WithSPIFFEAuthorization(rules ...SPIFFERule) ServerOption {
+	return func(s *tlsRpcServer) {
+		s.spiffeRules = append(s.spiffeRules, rules...)
+	}
+}
+
+// WithServerSPIFFEID requires the server certificate to carry a SPIFFE ID
+// matching one of patterns, in addition to the usual verification.
+func WithServerSPIFFEID(patterns ...string) ClientOption {
+	return func(c *tlsRpcClient) {
+		c.serverSPIFFE = append(c.serverSPIFFE, patterns...)
+	}
+}
+
+// spiffeAuthorizer is the compiled form of a list of SPIFFERules.
+type spiffeAuthorizer struct {
+	rules []compiledSPIFFERule
+}
+
+type compiledSPIFFERule struct {
+	methods []string
+	allow   []spiffePattern
+}
+
+func newSPIFFEAuthorizer(rules []SPIFFERule) (*spiffeAuthorizer, error) {
+	a := &spiffeAuthorizer{}
+	for _, rule := range rules {
+		for _, method := range rule.Methods {
+			if _, err := path.Match(method, ""); err != nil {
+				return nil, fmt.Errorf("invalid method pattern %q: %w", method, err)
+			}
+		}
+		allow, err := parseSPIFFEPatterns(rule.Allow)
+		if err != nil {
+			return nil, err
+		}
+		a.rules = append(a.rules, compiledSPIFFERule{methods: rule.Methods, allow: allow})
+	}
+	return a, nil
+}
+
+// authorize checks a call to serviceMethod on the connection described by
+// info.
+func (a *spiffeAuthorizer) authorize(info ConnInfo, serviceMethod string) error {
+	id, err := info.SPIFFEID()
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrPermissionDenied, err)
+	}
+	for _, rule := range a.rules {
+		if len(rule.methods) > 0 && !matchAnyName(rule.methods, serviceMethod) {
+			continue
+		}
+		if matchAnySPIFFE(rule.allow, id) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: %s may not call %s", ErrPermissionDenied, id, serviceMethod)
+}
+
+// verifySPIFFE returns a tls.Config.VerifyPeerCertificate callback requiring
+// the verified leaf to carry a SPIFFE ID matching patterns.
+func verifySPIFFE(patterns []spiffePattern) func([][]byte, [][]*x509.Certificate) error {
+	return func(_ [][]byte, verifiedChains [][]*x509.Certificate) error {
+		if len(verifiedChains) == 0 || len(verifiedChains[0]) == 0 {
+			return fmt.Errorf("%w: no verified server certificate", ErrPermissionDenied)
+		}
+		id, err := SPIFFEIDFromCertificate(verifiedChains[0][0])
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrPermissionDenied, err)
+		}
+		if !matchAnySPIFFE(patterns, id) {
+			return fmt.Errorf("%w: server identity %s is not allowed", ErrPermissionDenied, id)
+		}
+		return nil
+	}
+}
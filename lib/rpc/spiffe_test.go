@@ -0,0 +1,138 @@
+package swissknife
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// issueSPIFFE issues a client certificate carrying id as a URI SAN.
+func (p *testPKI) issueSPIFFE(t *testing.T, name, id string) (certPath, keyPath string) {
+	t.Helper()
+
+	uri, err := url.Parse(id)
+	require.NoError(t, err)
+	return p.issue(t, name, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: name},
+		URIs:        []*url.URL{uri},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+}
+
+func TestParseSPIFFEID(t *testing.T) {
+	id, err := ParseSPIFFEID("spiffe://corp.example/ns/payments/sa/api")
+	require.NoError(t, err)
+	require.Equal(t, SPIFFEID{TrustDomain: "corp.example", Path: "/ns/payments/sa/api"}, id)
+	require.Equal(t, "spiffe://corp.example/ns/payments/sa/api", id.String())
+
+	for _, invalid := range []string{
+		"https://corp/ns/api",
+		"spiffe:///ns/api",
+		"spiffe://Corp/ns/api",
+		"spiffe://corp:443/ns/api",
+		"spiffe://user@corp/ns/api",
+		"spiffe://corp/ns//api",
+		"spiffe://corp/ns/../api",
+		"spiffe://corp/ns/api/",
+		"spiffe://corp/ns/api?x=1",
+		"spiffe://corp/ns/api#frag",
+		"spiffe://corp/ns/a%20b",
+	} {
+		_, err := ParseSPIFFEID(invalid)
+		require.Error(t, err, invalid)
+	}
+}
+
+func TestSPIFFEPatternMatch(t *testing.T) {
+	for _, tc := range []struct {
+		pattern, id string
+		match       bool
+	}{
+		{"spiffe://corp/ns/payments/sa/api", "spiffe://corp/ns/payments/sa/api", true},
+		{"spiffe://corp/ns/*/sa/api", "spiffe://corp/ns/billing/sa/api", true},
+		{"spiffe://corp/ns/*/sa/api", "spiffe://corp/ns/billing/sa/web", false},
+		{"spiffe://corp/ns/payments/**", "spiffe://corp/ns/payments", true},
+		{"spiffe://corp/ns/payments/**", "spiffe://corp/ns/payments/sa/api", true},
+		{"spiffe://corp/ns/payments/**", "spiffe://corp/ns/billing/sa/api", false},
+		{"spiffe://corp/ns/payments", "spiffe://corp/ns/payments/sa/api", false},
+		{"spiffe://*.corp/**", "spiffe://eu.corp/anything", true},
+		{"spiffe://corp/**", "spiffe://other/ns/payments", false},
+		{"spiffe://corp/ns/api-*", "spiffe://corp/ns/api-v2", true},
+	} {
+		p, err := parseSPIFFEPattern(tc.pattern)
+		require.NoError(t, err, tc.pattern)
+		id, err := ParseSPIFFEID(tc.id)
+		require.NoError(t, err, tc.id)
+		require.Equal(t, tc.match, p.match(id), "%s against %s", tc.pattern, tc.id)
+	}
+
+	for _, invalid := range []string{"corp/ns", "spiffe://corp/**/api", "spiffe://**", "spiffe://corp/[", "spiffe://corp//api"} {
+		_, err := parseSPIFFEPattern(invalid)
+		require.Error(t, err, invalid)
+	}
+}
+
+func TestSPIFFEIDFromCertificate(t *testing.T) {
+	pki := newTestPKI(t)
+	certPath, _ := pki.issueSPIFFE(t, "api", "spiffe://corp/ns/payments/sa/api")
+
+	id, err := SPIFFEIDFromCertificate(leaf(t, certPath))
+	require.NoError(t, err)
+	require.Equal(t, "spiffe://corp/ns/payments/sa/api", id.String())
+
+	_, err = SPIFFEIDFromCertificate(leaf(t, pki.clientCert))
+	require.Error(t, err)
+}
+
+func TestServerAuthorizesCallsBySPIFFEID(t *testing.T) {
+	pki := newTestPKI(t)
+	_, addr := startTestServer(t, pki, WithSPIFFEAuthorization(
+		SPIFFERule{Methods: []string{"TestService.*"}, Allow: []string{"spiffe://corp/ns/payments/**"}},
+		SPIFFERule{Methods: []string{"TestService.Echo"}, Allow: []string{"spiffe://corp/ns/*/sa/web"}},
+	))
+
+	call := func(certPath, keyPath, method string) error {
+		client, err := NewITlsRpcClient(pki.caCert, certPath, keyPath, addr, "spiffe-client")
+		require.NoError(t, err)
+		defer client.CloseClient()
+		_, err = client.ConnectToRpcServerTls(method, []byte(`{"A":1,"B":2}`))
+		return err
+	}
+
+	payments, paymentsKey := pki.issueSPIFFE(t, "payments", "spiffe://corp/ns/payments/sa/api")
+	require.NoError(t, call(payments, paymentsKey, "TestService.Add"))
+
+	web, webKey := pki.issueSPIFFE(t, "web", "spiffe://corp/ns/billing/sa/web")
+	err := call(web, webKey, "TestService.Add")
+	require.ErrorIs(t, err, ErrPermissionDenied)
+	require.Contains(t, err.Error(), "spiffe://corp/ns/billing/sa/web may not call TestService.Add")
+
+	require.ErrorIs(t, call(pki.clientCert, pki.clientKey, "TestService.Add"), ErrPermissionDenied)
+}
+
+func TestClientRequiresServerSPIFFEID(t *testing.T) {
+	pki := newTestPKI(t)
+	uri, err := url.Parse("spiffe://corp/ns/rpc/sa/server")
+	require.NoError(t, err)
+	pki.serverCert, pki.serverKey = pki.issue(t, "spiffe-server", &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "localhost"},
+		DNSNames:    []string{"localhost"},
+		IPAddresses: []net.IP{net.ParseIP("127.0.0.1"), net.IPv6loopback},
+		URIs:        []*url.URL{uri},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	})
+	_, addr := startTestServer(t, pki)
+
+	client := newTestClient(t, pki, addr, WithServerSPIFFEID("spiffe://corp/ns/rpc/**"))
+	require.Equal(t, 42, callAdd(t, client))
+
+	_, err = NewITlsRpcClient(pki.caCert, pki.clientCert, pki.clientKey, addr, "test-client", WithServerSPIFFEID("spiffe://other/**"))
+	require.ErrorIs(t, err, ErrPermissionDenied)
+
+	_, err = NewITlsRpcClient(pki.caCert, pki.clientCert, pki.clientKey, addr, "test-client", WithServerSPIFFEID("not-a-pattern"))
+	require.Error(t, err)
+}
@@ -0,0 +1,181 @@
+package swissknife
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// testPKI holds the paths of a throwaway CA and the server and client key
+// pairs it signed.
+type testPKI struct {
+	dir        string
+	caCert     string
+	caKeyPath  string
+	serverCert string
+	serverKey  string
+	clientCert string
+	clientKey  string
+
+	ca    *x509.Certificate
+	caKey *ecdsa.PrivateKey
+}
+
+// newTestPKI writes a fresh CA, a localhost server certificate and a client
+// certificate into a temporary directory.
+func newTestPKI(t *testing.T) *testPKI {
+	t.Helper()
+
+	dir := t.TempDir()
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "swissknife test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	require.NoError(t, err)
+	ca, err := x509.ParseCertificate(caDER)
+	require.NoError(t, err)
+
+	pki := &testPKI{dir: dir, ca: ca, caKey: caKey}
+	pki.caCert = writePEM(t, dir, "ca.crt", "CERTIFICATE", caDER)
+	caKeyDER, err := x509.MarshalECPrivateKey(caKey)
+	require.NoError(t, err)
+	pki.caKeyPath = writePEM(t, dir, "ca.key", "EC PRIVATE KEY", caKeyDER)
+	pki.serverCert, pki.serverKey = pki.issue(t, "server", &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "localhost"},
+		DNSNames:    []string{"localhost"},
+		IPAddresses: []net.IP{net.ParseIP("127.0.0.1"), net.IPv6loopback},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	})
+	pki.clientCert, pki.clientKey = pki.issue(t, "client", &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "test-client"},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	return pki
+}
+
+// issue signs template with the test CA and writes name.crt and name.key.
+func (p *testPKI) issue(t *testing.T, name string, template *x509.Certificate) (certPath, keyPath string) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	require.NoError(t, err)
+	template.SerialNumber = serial
+	if template.NotBefore.IsZero() {
+		template.NotBefore = time.Now().Add(-time.Hour)
+	}
+	if template.NotAfter.IsZero() {
+		template.NotAfter = time.Now().Add(24 * time.Hour)
+	}
+	template.KeyUsage = x509.KeyUsageDigitalSignature
+
+	der, err := x509.CreateCertificate(rand.Reader, template, p.ca, &key.PublicKey, p.caKey)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	certPath = writePEM(t, p.dir, name+".crt", "CERTIFICATE", der)
+	keyPath = writePEM(t, p.dir, name+".key", "EC PRIVATE KEY", keyDER)
+	return certPath, keyPath
+}
+
+func writePEM(t *testing.T, dir, name, blockType string, der []byte) string {
+	t.Helper()
+
+	path := filepath.Join(dir, name)
+	data := pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der})
+	require.NoError(t, os.WriteFile(path, data, 0o600))
+	return path
+}
+
+// startTestServer starts a server for pki on a random local port with
+// TestService registered and returns it with its address.
+func startTestServer(t *testing.T, pki *testPKI, opts ...ServerOption) (*tlsRpcServer, string) {
+	t.Helper()
+
+	server, err := NewITlsRpcServer(pki.serverCert, pki.serverKey, pki.caCert, "0", opts...)
+	require.NoError(t, err)
+	server.SetLogger(newTestLogger(&bytes.Buffer{}, &bytes.Buffer{}, LogLevelDebug))
+	require.NoError(t, server.RegisterMethod("TestService", new(TestService)))
+	go server.Serve()
+	t.Cleanup(server.CloseServer)
+
+	s := server.(*tlsRpcServer)
+	_, port, err := net.SplitHostPort(s.listener.Addr().String())
+	require.NoError(t, err)
+	return s, net.JoinHostPort("localhost", port)
+}
+
+// newTestClient connects a client using the client certificate of pki.
+func newTestClient(t *testing.T, pki *testPKI, addr string, opts ...ClientOption) ITlsRpcClient {
+	t.Helper()
+
+	client, err := NewITlsRpcClient(pki.caCert, pki.clientCert, pki.clientKey, addr, "test-client", opts...)
+	require.NoError(t, err)
+	client.SetLogger(newTestLogger(&bytes.Buffer{}, &bytes.Buffer{}, LogLevelDebug))
+	t.Cleanup(client.CloseClient)
+	return client
+}
+
+// leaf parses the certificate stored at certPath.
+func leaf(t *testing.T, certPath string) *x509.Certificate {
+	t.Helper()
+
+	data, err := os.ReadFile(certPath)
+	require.NoError(t, err)
+	block, _ := pem.Decode(data)
+	require.NotNil(t, block)
+	cert, err := x509.ParseCertificate(block.Bytes)
+	require.NoError(t, err)
+	return cert
+}
+
+// writeCRL writes a CRL signed by the test CA revoking the given
+// certificates, PEM encoded unless der is set, and returns its path.
+func (p *testPKI) writeCRL(t *testing.T, name string, der bool, revoked ...*x509.Certificate) string {
+	t.Helper()
+
+	template := &x509.RevocationList{
+		Number:     big.NewInt(time.Now().UnixNano()),
+		ThisUpdate: time.Now().Add(-time.Minute),
+		NextUpdate: time.Now().Add(time.Hour),
+	}
+	for _, cert := range revoked {
+		template.RevokedCertificateEntries = append(template.RevokedCertificateEntries, x509.RevocationListEntry{
+			SerialNumber:   cert.SerialNumber,
+			RevocationTime: time.Now().Add(-time.Minute),
+		})
+	}
+	crl, err := x509.CreateRevocationList(rand.Reader, template, p.ca, p.caKey)
+	require.NoError(t, err)
+
+	if der {
+		path := filepath.Join(p.dir, name)
+		require.NoError(t, os.WriteFile(path, crl, 0o600))
+		return path
+	}
+	return writePEM(t, p.dir, name, "X509 CRL", crl)
+}
@@ -0,0 +1,114 @@
+package swissknife
+
+import (
+	"errors"
+	"net"
+	"os"
+	"time"
+)
+
+// heartbeatMethod is the reserved method clients call to ping the server. The
+// server answers it directly without consulting registered services.
+const heartbeatMethod = "_Heartbeat.Ping"
+
+// Timeouts configures deadlines and liveness checks on TLS RPC connections.
+// A zero duration disables the corresponding timeout.
+type Timeouts struct {
+	// HandshakeTimeout bounds dialing and the TLS handshake.
+	HandshakeTimeout time.Duration
+
+	// IdleTimeout closes server connections that have had no calls in
+	// flight and received no requests, heartbeats aside, for this long.
+	IdleTimeout time.Duration
+
+	// ReadTimeout bounds reading a single message once its first byte has
+	// arrived.
+	ReadTimeout time.Duration
+
+	// WriteTimeout bounds writing a single message.
+	WriteTimeout time.Duration
+
+	// HeartbeatInterval is how often a client pings the server.
+	HeartbeatInterval time.Duration
+
+	// HeartbeatTimeout is how long a client waits for the reply to a ping,
+	// and how long a server waits for the next ping from a client that has
+	// sent one, before treating the peer as dead and closing the connection.
+	HeartbeatTimeout time.Duration
+
+	// KeepAlive configures TCP keepalive probes on dialed and accepted
+	// connections. Probes are disabled unless KeepAlive.Enable is set.
+	KeepAlive net.KeepAliveConfig
+}
+
+// DefaultTimeouts returns the timeouts used by clients and servers that are
+// not given WithTimeouts or WithClientTimeouts. Idle connections are kept
+// open; dead peers are detected through heartbeats and TCP keepalives.
+func DefaultTimeouts() Timeouts {
+	return Timeouts{
+		HandshakeTimeout:  10 * time.Second,
+		ReadTimeout:       30 * time.Second,
+		WriteTimeout:      30 * time.Second,
+		HeartbeatInterval: 15 * time.Second,
+		HeartbeatTimeout:  45 * time.Second,
+		KeepAlive: net.KeepAliveConfig{
+			Enable:   true,
+			Idle:     30 * time.Second,
+			Interval: 10 * time.Second,
+			Count:    3,
+		},
+	}
+}
+
+// WithTimeouts replaces the server's connection timeouts.
+func WithTimeouts(timeouts Timeouts) ServerOption {
+	return func(s *tlsRpcServer) {
+		s.timeouts = timeouts
+	}
+}
+
+// WithClientTimeouts replaces the client's connection timeouts.
+func WithClientTimeouts(timeouts Timeouts) ClientOption {
+	return func(c *tlsRpcClient) {
+		c.timeouts = timeouts
+	}
+}
+
+// listenConfig returns a net.ListenConfig applying the keepalive settings.
+func (t Timeouts) listenConfig() net.ListenConfig {
+	lc := net.ListenConfig{KeepAliveConfig: t.KeepAlive}
+	if !t.KeepAlive.Enable {
+		lc.KeepAlive = -1
+	}
+	return lc
+}
+
+// dialer returns a net.Dialer applying the handshake and keepalive settings.
+func (t Timeouts) dialer() *net.Dialer {
+	d := &net.Dialer{Timeout: t.HandshakeTimeout, KeepAliveConfig: t.KeepAlive}
+	if !t.KeepAlive.Enable {
+		d.KeepAlive = -1
+	}
+	return d
+}
+
+// deadline returns the absolute deadline for a timeout starting now, or the
+// zero time when the timeout is disabled.
+func deadline(timeout time.Duration) time.Time {
+	if timeout <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(timeout)
+}
+
+// earliest returns the earlier of two deadlines, ignoring zero values.
+func earliest(a, b time.Time) time.Time {
+	if a.IsZero() || (!b.IsZero() && b.Before(a)) {
+		return b
+	}
+	return a
+}
+
+func isTimeout(err error) bool {
+	return errors.Is(err, os.ErrDeadlineExceeded)
+}
@@ -0,0 +1,129 @@
+package swissknife
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/rpc"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestServerClosesIdleConnections(t *testing.T) {
+	pki := newTestPKI(t)
+	timeouts := DefaultTimeouts()
+	timeouts.IdleTimeout = 100 * time.Millisecond
+	_, addr := startTestServer(t, pki, WithTimeouts(timeouts))
+
+	noHeartbeat := DefaultTimeouts()
+	noHeartbeat.HeartbeatInterval = 0
+	client := newTestClient(t, pki, addr, WithClientTimeouts(noHeartbeat))
+
+	argsData, err := json.Marshal(Args{A: 1, B: 2})
+	require.NoError(t, err)
+	_, err = client.ConnectToRpcServerTls("TestService.Add", argsData)
+	require.NoError(t, err)
+
+	time.Sleep(300 * time.Millisecond)
+	_, err = client.ConnectToRpcServerTls("TestService.Add", argsData)
+	require.Error(t, err)
+}
+
+func TestHeartbeatsKeepConnectionAlive(t *testing.T) {
+	pki := newTestPKI(t)
+	serverTimeouts := DefaultTimeouts()
+	serverTimeouts.HeartbeatTimeout = 150 * time.Millisecond
+	_, addr := startTestServer(t, pki, WithTimeouts(serverTimeouts))
+
+	clientTimeouts := DefaultTimeouts()
+	clientTimeouts.HeartbeatInterval = 30 * time.Millisecond
+	client := newTestClient(t, pki, addr, WithClientTimeouts(clientTimeouts))
+
+	time.Sleep(400 * time.Millisecond)
+	argsData, err := json.Marshal(Args{A: 1, B: 2})
+	require.NoError(t, err)
+	_, err = client.ConnectToRpcServerTls("TestService.Add", argsData)
+	require.NoError(t, err)
+}
+
+func TestServerDropsSilentHeartbeatClient(t *testing.T) {
+	pki := newTestPKI(t)
+	timeouts := DefaultTimeouts()
+	timeouts.HeartbeatTimeout = 100 * time.Millisecond
+	_, addr := startTestServer(t, pki, WithTimeouts(timeouts))
+
+	raw := dialRawClient(t, pki, addr)
+	var reply []byte
+	require.NoError(t, raw.Call(heartbeatMethod, []byte(nil), &reply))
+
+	time.Sleep(300 * time.Millisecond)
+	err := raw.Call(heartbeatMethod, []byte(nil), &reply)
+	require.Error(t, err)
+}
+
+func TestServerReadTimeout(t *testing.T) {
+	pki := newTestPKI(t)
+	timeouts := DefaultTimeouts()
+	timeouts.ReadTimeout = 100 * time.Millisecond
+	_, addr := startTestServer(t, pki, WithTimeouts(timeouts))
+
+	cert, err := tls.LoadX509KeyPair(pki.clientCert, pki.clientKey)
+	require.NoError(t, err)
+	roots, err := loadCertPool(pki.caCert, nil)
+	require.NoError(t, err)
+	conn, err := tls.Dial("tcp", addr, &tls.Config{RootCAs: roots, Certificates: []tls.Certificate{cert}})
+	require.NoError(t, err)
+	defer conn.Close()
+
+	// Start a frame and never finish it.
+	_, err = conn.Write([]byte{0x20})
+	require.NoError(t, err)
+
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	require.ErrorIs(t, err, io.EOF)
+}
+
+func TestClientDetectsDeadServer(t *testing.T) {
+	pki := newTestPKI(t)
+	cert, err := tls.LoadX509KeyPair(pki.serverCert, pki.serverKey)
+	require.NoError(t, err)
+
+	// A server that completes the handshake and then never answers.
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	require.NoError(t, err)
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go io.Copy(io.Discard, conn)
+		}
+	}()
+
+	timeouts := DefaultTimeouts()
+	timeouts.HeartbeatInterval = 30 * time.Millisecond
+	timeouts.HeartbeatTimeout = 60 * time.Millisecond
+	client := newTestClient(t, pki, listener.Addr().String(), WithClientTimeouts(timeouts))
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := client.ConnectToRpcServerTls("TestService.Add", nil)
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		require.Error(t, err)
+		var opErr *net.OpError
+		require.True(t, errors.Is(err, rpc.ErrShutdown) || errors.Is(err, io.ErrUnexpectedEOF) || errors.As(err, &opErr), "got %v", err)
+	case <-time.After(2 * time.Second):
+		t.Fatal("call to dead server did not fail")
+	}
+}
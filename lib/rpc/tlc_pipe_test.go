@@ -0,0 +1,78 @@
+package swissknife_test
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"testing"
+
+	swissknife "github.com/joey1123455/swiss-knife/lib/rpc"
+	"github.com/joey1123455/swiss-knife/lib/rpc/rpctest"
+	"github.com/stretchr/testify/require"
+	"github.com/zeebo/assert"
+)
+
+// These tests run over the in-memory listener of rpctest, which imports
+// this package and so can only be used from an external test package.
+
+type Args struct {
+	A, B int
+}
+
+type Reply struct {
+	Sum int
+}
+
+type ArithService struct{}
+
+func (s *ArithService) Add(args *[]byte, reply *[]byte) error {
+	var argsStruct Args
+	if err := json.Unmarshal(*args, &argsStruct); err != nil {
+		return err
+	}
+	data, err := json.Marshal(Reply{Sum: argsStruct.A + argsStruct.B})
+	if err != nil {
+		return err
+	}
+	*reply = data
+	return nil
+}
+
+func TestTlsRpcClientServer(t *testing.T) {
+	server := rpctest.NewServer(t)
+	server.Register(t, "TestService", new(ArithService))
+
+	client, err := swissknife.NewITlsRpcClient(server.PKI.CACert, server.PKI.ClientCert, server.PKI.ClientKey, "pipe", "test-client",
+		swissknife.WithServerName(rpctest.ServerName), swissknife.WithDialContext(server.Listener.DialContext))
+	require.NoError(t, err)
+	defer client.CloseClient()
+
+	args := Args{A: 5, B: 3}
+	argsData, err := json.Marshal(args)
+	require.NoError(t, err)
+
+	replyAny, err := client.ConnectToRpcServerTls("TestService.Add", argsData)
+	require.NoError(t, err)
+
+	var reply Reply
+	err = json.Unmarshal(replyAny, &reply)
+	require.NoError(t, err)
+	assert.Equal(t, 8, reply.Sum)
+}
+
+func TestServerRejectsInvalidCert(t *testing.T) {
+	server := rpctest.NewServer(t)
+
+	conn, err := server.Listener.DialContext(context.Background(), "", "")
+	require.NoError(t, err)
+	defer conn.Close()
+
+	// The system roots do not trust the test CA.
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: false,
+		ServerName:         rpctest.ServerName,
+	}
+
+	err = tls.Client(conn, tlsConfig).Handshake()
+	require.Error(t, err, "Expected connection to fail due to Incorrect certificate")
+}
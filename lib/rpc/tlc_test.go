@@ -2,17 +2,13 @@ package swissknife
 
 import (
 	"bytes"
-	"crypto/tls"
 	"encoding/json"
 	"log"
 	"os"
-	"path/filepath"
 	"strings"
 	"testing"
-	"time"
 
 	"github.com/stretchr/testify/require"
-	"github.com/zeebo/assert"
 )
 
 func newTestLogger(bufOut, bufErr *bytes.Buffer, level LogLevel) *DefaultLogger {
@@ -148,68 +144,52 @@ func (s *TestService) Add(args *[]byte, reply *[]byte) error {
 	return nil
 }
 
-func getCertPaths(t *testing.T) (certPath, keyPath string) {
-	base := filepath.Join("testdata", "tls")
-	cert := filepath.Join(base, "server.crt")
-	key := filepath.Join(base, "server.key")
-	if _, err := os.Stat(cert); os.IsNotExist(err) {
-		t.Skip("TLS cert not found")
-	}
-	if _, err := os.Stat(key); os.IsNotExist(err) {
-		t.Skip("TLS key not found")
-	}
-	return cert, key
-}
+// TypedService has a method whose arguments cannot cross the connection.
+type TypedService struct{}
 
-func TestTlsRpcClientServer(t *testing.T) {
-	certPath, keyPath := getCertPaths(t)
-	crtPath := ""
-	port := "7000"
+func (s *TypedService) Add(args *Args, reply *Reply) error {
+	reply.Sum = args.A + args.B
+	return nil
+}
 
-	server, err := NewITlsRpcServer(certPath, keyPath, crtPath, port)
-	require.NoError(t, err)
-	defer server.CloseServer()
+// ValueService takes its arguments by value, and has a helper method that
+// is not an RPC method.
+type ValueService struct{}
 
-	err = server.RegisterMethod("TestService", new(TestService))
-	require.NoError(t, err)
+func (s *ValueService) Echo(args []byte, reply *[]byte) error {
+	*reply = args
+	return nil
+}
 
-	go server.Serve()
-	time.Sleep(500 * time.Millisecond) // Give time to start
+func (s *ValueService) Caller(req Request, reply *[]byte) error {
+	*reply = []byte(req.Identity())
+	return nil
+}
 
-	client, err := NewITlsRpcClient(crtPath, certPath, keyPath, "localhost:"+port, "test-client")
-	require.NoError(t, err)
-	defer client.CloseClient()
+func (s *ValueService) Name() string {
+	return "value"
+}
 
-	args := Args{A: 5, B: 3}
-	argsData, err := json.Marshal(args)
-	require.NoError(t, err)
+func TestRegisterMethodChecksTypes(t *testing.T) {
+	pki := newTestPKI(t)
+	s, addr := startTestServer(t, pki)
 
-	replyAny, err := client.ConnectToRpcServerTls("TestService.Add", argsData)
-	require.NoError(t, err)
+	err := s.RegisterMethod("Typed", new(TypedService))
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "method Add takes *swissknife.Args")
+	require.False(t, s.registered("Typed.Add"))
 
-	var reply Reply
-	err = json.Unmarshal(replyAny, &reply)
+	require.NoError(t, s.RegisterMethod("Value", new(ValueService)))
+	client := newTestClient(t, pki, addr)
+	reply, err := client.ConnectToRpcServerTls("Value.Echo", []byte("hi"))
 	require.NoError(t, err)
-	assert.Equal(t, 8, reply.Sum)
-}
-
-func TestServerRejectsInvalidCert(t *testing.T) {
-	certPath, keyPath := getCertPaths(t)
-	crtPath := ""
-	port := "7001"
-
-	server, err := NewITlsRpcServer(certPath, keyPath, crtPath, port)
+	require.Equal(t, "hi", string(reply))
+	reply, err = client.ConnectToRpcServerTls("Value.Caller", nil)
 	require.NoError(t, err)
-	defer server.CloseServer()
-
-	go server.Serve()
-	time.Sleep(500 * time.Millisecond)
+	require.Equal(t, "CN=test-client", string(reply))
 
-	// Use an empty cert pool (invalid)
-	tlsConfig := &tls.Config{
-		InsecureSkipVerify: false, // Force connection even with invalid cert
-	}
-
-	_, err = tls.Dial("tcp", "localhost:"+port, tlsConfig)
-	require.Error(t, err, "Expected connection to fail due to Incorrect certificate")
+	_, err = NewITlsRpcClient(pki.caCert, pki.clientCert, pki.clientKey, addr, "worker", WithClientService("Typed", new(TypedService)))
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "method Add takes")
 }
+
@@ -1,51 +1,135 @@
 package swissknife
 
 import (
+	"context"
 	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"fmt"
 	"net"
 	"net/rpc"
+	"time"
 )
 
 // NewITlsRpcClient creates a new TLS RPC client and connects to the specified
 // RPC server, using the specified certificate path to load the TLS
-// configuration. The client is named for logging purposes.
+// configuration. The client is named for logging purposes. Optional
+// behaviour such as timeouts is configured with opts.
+//
+// When clientCrtPath and clientKeyPath are both empty the client connects
+// without a certificate, which servers only accept for the methods they list
+// in WithUnauthenticatedMethods.
 //
 // The returned error is non-nil if the client fails to connect to the server.
-func NewITlsRpcClient(caCrtPath, clientCrtPath, clientKeyPath, address, name string) (ITlsRpcClient, error) {
+func NewITlsRpcClient(caCrtPath, clientCrtPath, clientKeyPath, address, name string, opts ...ClientOption) (ITlsRpcClient, error) {
 	logger := NewDefaultLogger()
-	cert, err := tls.LoadX509KeyPair(clientCrtPath, clientKeyPath)
-	if err != nil {
-		logger.Errorf("Failed to load TLS certificate and key for client %s: %v", name, err)
-		return nil, fmt.Errorf("failed to load TLS certificate and key: %w", err)
+	client := &tlsRpcClient{
+		name:     name,
+		network:  "tcp",
+		timeouts: DefaultTimeouts(),
+		logger:   logger,
+		done:     make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(client)
 	}
 
-	certPool, err := loadCertPool(caCrtPath)
+	var cert tls.Certificate
+	var certificates []tls.Certificate
+	if clientCrtPath != "" || clientKeyPath != "" {
+		loaded, err := tls.LoadX509KeyPair(clientCrtPath, clientKeyPath)
+		if err != nil {
+			logger.Errorf("Failed to load TLS certificate and key for client %s: %v", name, err)
+			return nil, fmt.Errorf("failed to load TLS certificate and key: %w", err)
+		}
+		cert, certificates = loaded, []tls.Certificate{loaded}
+	}
+
+	certPool, caCerts, err := client.rootPool(caCrtPath)
 	if err != nil {
 		logger.Errorf("Failed to load cert pool for client %s: %v", name, err)
 		return nil, fmt.Errorf("failed to load cert pool: %w", err)
 	}
 
+	var expiry *expiryMonitor
+	if client.expiryConfig != nil {
+		expiry, err = newExpiryMonitor(*client.expiryConfig, cert, caCerts, client.log, client.metrics.expiryDays())
+		if err != nil {
+			logger.Errorf("Refusing to start client %s: %v", name, err)
+			return nil, err
+		}
+	}
+
 	tlsConfig := &tls.Config{
 		RootCAs:            certPool,
 		InsecureSkipVerify: false,
-		Certificates:       []tls.Certificate{cert},
+		Certificates:       certificates,
+		ServerName:         client.serverName,
+	}
+	if err := applyTLSPolicy(client.tlsPolicy, tlsConfig); err != nil {
+		logger.Errorf("Failed to configure TLS for client %s: %v", name, err)
+		return nil, err
+	}
+	if err := client.configureVerification(tlsConfig); err != nil {
+		logger.Errorf("Failed to configure TLS for client %s: %v", name, err)
+		return nil, err
+	}
+	services, err := client.registerServices()
+	if err != nil {
+		logger.Errorf("Failed to configure client %s: %v", name, err)
+		return nil, err
+	}
+	if client.webSocketPath != "" {
+		tlsConfig.NextProtos = []string{"http/1.1"}
+	} else if services != nil {
+		tlsConfig.NextProtos = []string{bidiProtocol}
 	}
 
 	logger.Infof("Connecting to TLS RPC server at %s for client %s", address, name)
 	logger.Debugf("TLS configuration loaded for client %s", name)
 
-	conn, err := tls.Dial("tcp", address, tlsConfig)
+	tlsConn, err := client.dialTLS(address, tlsConfig)
 	if err != nil {
 		logger.Errorf("Connection failed for client %s to %s: %v", name, address, err)
+		client.metrics.handshakeFailed()
 		return nil, fmt.Errorf("failed to connect to server %s: %w", name, err)
 	}
 
+	var conn net.Conn = tlsConn
+	state := tlsConn.ConnectionState()
+	if client.webSocketPath != "" {
+		wsConn, err := client.upgradeWebSocket(tlsConn, address, services != nil)
+		if err != nil {
+			tlsConn.Close()
+			logger.Errorf("WebSocket upgrade failed for client %s to %s: %v", name, address, err)
+			client.metrics.handshakeFailed()
+			return nil, fmt.Errorf("failed to connect to server %s: %w", name, err)
+		}
+		conn, state = wsConn, wsConn.ConnectionState()
+	}
+
 	logger.Infof("Successfully connected to TLS RPC server at %s for client %s", address, name)
-	return &tlsRpcClient{
-		conn:   conn,
-		logger: logger,
-	}, nil
+	logger.Infof("Negotiated %s with server %s for client %s", describeTLS(state.Version, state.CipherSuite), address, name)
+	if services != nil && state.NegotiatedProtocol != bidiProtocol {
+		conn.Close()
+		logger.Errorf("Server %s does not accept bidirectional connections from client %s", address, name)
+		return nil, fmt.Errorf("server %s does not accept bidirectional connections", address)
+	}
+	client.conn = conn
+	received, sent := client.metrics.byteCounters()
+	codec := newClientCodec(conn, client.timeouts, received, sent)
+	if services != nil {
+		codec.serveCalls(services, newConnInfo(conn), client.log)
+	}
+	client.rpc = rpc.NewClientWithCodec(codec)
+	client.metrics.connOpened()
+	if client.timeouts.HeartbeatInterval > 0 {
+		go client.heartbeat()
+	}
+	if expiry != nil {
+		go expiry.run(client.done)
+	}
+	return client, nil
 }
 
 // NewITlsRpcServer creates a new TLS RPC server that listens on the specified
@@ -54,79 +138,360 @@ func NewITlsRpcClient(caCrtPath, clientCrtPath, clientKeyPath, address, name str
 // the specified port.
 //
 // The returned ITlsRpcServer object is ready to use for RPC registrations and
-// serving.
-func NewITlsRpcServer(certPath, keyPath, capath, port string) (ITlsRpcServer, error) {
+// serving. Optional behaviour such as resource limits is configured with opts.
+func NewITlsRpcServer(certPath, keyPath, capath, port string, opts ...ServerOption) (ITlsRpcServer, error) {
+	return NewITlsRpcServerAddr(certPath, keyPath, capath, "tcp", fmt.Sprintf(":%s", port), opts...)
+}
+
+// NewITlsRpcServerAddr creates a new TLS RPC server listening on address of
+// the given network, as accepted by net.Listen. This allows binding a single
+// interface ("tcp", "10.0.0.1:7000"), an IPv6 literal ("tcp6", "[::1]:7000")
+// or a Unix domain socket ("unix", "/run/app.sock").
+func NewITlsRpcServerAddr(certPath, keyPath, capath, network, address string, opts ...ServerOption) (ITlsRpcServer, error) {
+	server, err := newTlsRpcServer(certPath, keyPath, capath, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	lc := server.timeouts.listenConfig()
+	listener, err := lc.Listen(context.Background(), network, address)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %s %s: %w", network, address, err)
+	}
+
+	server.listener = tls.NewListener(listener, server.tlsConfig)
+	return server, nil
+}
+
+// NewITlsRpcServerListener creates a new TLS RPC server that accepts
+// connections from an existing listener, such as one inherited from systemd
+// (see SystemdListeners). The listener must not already speak TLS; the
+// server wraps it with its own TLS configuration and closes it on
+// CloseServer. Keepalive settings from Timeouts are not applied to it.
+func NewITlsRpcServerListener(certPath, keyPath, capath string, listener net.Listener, opts ...ServerOption) (ITlsRpcServer, error) {
+	server, err := newTlsRpcServer(certPath, keyPath, capath, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	server.listener = tls.NewListener(listener, server.tlsConfig)
+	return server, nil
+}
+
+// newTlsRpcServer applies opts and loads the TLS configuration shared by the
+// server constructors.
+func newTlsRpcServer(certPath, keyPath, capath string, opts []ServerOption) (*tlsRpcServer, error) {
+	server := &tlsRpcServer{
+		logger:    NewDefaultLogger(), // Set default logger
+		rpcServer: rpc.NewServer(),
+		limits:    DefaultServerLimits(),
+		timeouts:  DefaultTimeouts(),
+		conns:     make(map[*serverConn]struct{}),
+	}
+	for _, opt := range opts {
+		opt(server)
+	}
+
 	cert, err := tls.LoadX509KeyPair(certPath, keyPath)
 	if err != nil {
 		return nil, fmt.Errorf("failed to load TLS certificate and key: %w", err)
 	}
 
-	clientCACertPool, err := loadCertPool(capath)
+	clientCACertPool := x509.NewCertPool()
+	caCerts, err := addCACertificates(clientCACertPool, capath, server.logger)
 	if err != nil {
 		return nil, fmt.Errorf("failed to load ca certificate: %w", err)
 	}
 
-	config := &tls.Config{
+	if server.expiryConfig != nil {
+		server.expiry, err = newExpiryMonitor(*server.expiryConfig, cert, caCerts, func() Logger { return server.logger }, server.metrics.expiryDays())
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	server.tlsConfig = &tls.Config{
 		Certificates: []tls.Certificate{cert},
 		ClientAuth:   tls.RequireAndVerifyClientCert,
 		ClientCAs:    clientCACertPool,
 	}
+	if len(server.unauthenticated) > 0 {
+		server.tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	if server.bidirectional {
+		server.tlsConfig.NextProtos = []string{bidiProtocol}
+	}
+	if err := applyTLSPolicy(server.tlsPolicy, server.tlsConfig); err != nil {
+		return nil, err
+	}
+	if server.revocation != nil {
+		server.crls, err = newRevocationChecker(*server.revocation, func() Logger { return server.logger })
+		if err != nil {
+			return nil, err
+		}
+		server.tlsConfig.VerifyPeerCertificate = server.crls.verify
+	}
+	if len(server.spiffeRules) > 0 {
+		server.spiffe, err = newSPIFFEAuthorizer(server.spiffeRules)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if server.requireTokens && server.tokens == nil {
+		return nil, errors.New("token authentication requires a validator")
+	}
+	if server.idempotency != nil && server.idempotency.ttl <= 0 {
+		return nil, errors.New("idempotency TTL must be positive")
+	}
+	return server, nil
+}
+
+// rootPool returns the CAs the client trusts, and the certificates loaded
+// from caCrtPath: those are added to the system pool when WithSystemRoots is
+// set, in which case caCrtPath may be empty.
+func (c *tlsRpcClient) rootPool(caCrtPath string) (*x509.CertPool, []*x509.Certificate, error) {
+	pool := x509.NewCertPool()
+	if c.systemRoots {
+		system, err := x509.SystemCertPool()
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to load system cert pool: %w", err)
+		}
+		if caCrtPath == "" {
+			return system, nil, nil
+		}
+		pool = system
+	}
+	certs, err := addCACertificates(pool, caCrtPath, c.log())
+	if err != nil {
+		return nil, nil, err
+	}
+	return pool, certs, nil
+}
+
+// dialTLS connects to address and completes the TLS handshake, using the
+// dialer set with WithDialContext and the proxy set with WithProxy if there
+// are any.
+func (c *tlsRpcClient) dialTLS(address string, config *tls.Config) (*tls.Conn, error) {
+	if c.dial == nil && c.proxy == nil {
+		return tls.DialWithDialer(c.timeouts.dialer(), c.network, address, config)
+	}
 
-	listener, err := tls.Listen("tcp", fmt.Sprintf(":%s", port), config)
+	ctx := context.Background()
+	if c.timeouts.HandshakeTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.timeouts.HandshakeTimeout)
+		defer cancel()
+	}
+	raw, err := c.dialConn(ctx, address)
 	if err != nil {
-		return nil, fmt.Errorf("failed to listen on port %s: %w", port, err)
+		return nil, err
+	}
+	if config.ServerName == "" {
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			host = address
+		}
+		config = config.Clone()
+		config.ServerName = host
+	}
+	conn := tls.Client(raw, config)
+	if err := conn.HandshakeContext(ctx); err != nil {
+		raw.Close()
+		return nil, err
 	}
+	return conn, nil
+}
 
-	return &tlsRpcServer{
-		listener: listener,
-		logger:   NewDefaultLogger(), // Set default logger
-	}, nil
+// configureVerification installs the checks run on the server certificate
+// after chain verification: pinning, SPIFFE identity and revocation.
+func (c *tlsRpcClient) configureVerification(config *tls.Config) error {
+	var pinned, identified, revoked func([][]byte, [][]*x509.Certificate) error
+	if len(c.pins) > 0 {
+		pins, err := parsePins(c.pins)
+		if err != nil {
+			return err
+		}
+		pinned = verifyPins(pins)
+	}
+	if len(c.serverSPIFFE) > 0 {
+		patterns, err := parseSPIFFEPatterns(c.serverSPIFFE)
+		if err != nil {
+			return err
+		}
+		identified = verifySPIFFE(patterns)
+	}
+	if c.revocation != nil {
+		checker, err := newRevocationChecker(*c.revocation, c.log)
+		if err != nil {
+			return err
+		}
+		revoked = checker.verify
+	}
+	config.VerifyPeerCertificate = chainVerifiers(pinned, identified, revoked)
+	return nil
 }
 
 // CloseClient closes the TLS RPC client connection. If the connection is
 // already closed, this function has no effect.
 func (c *tlsRpcClient) CloseClient() {
-	if c.conn != nil {
-		c.logger.Info("Closing TLS RPC client connection")
-		c.conn.Close()
-	}
+	c.closeOnce.Do(func() {
+		c.log().Info("Closing TLS RPC client connection")
+		close(c.done)
+		c.rpc.Close()
+		c.metrics.connClosed()
+	})
 }
 
 // SetLogger sets the logger used by the TLS RPC client. If not set, the
 // client will use the default logger.
 func (c *tlsRpcClient) SetLogger(logger Logger) {
+	c.loggerMu.Lock()
 	c.logger = logger
+	c.loggerMu.Unlock()
+}
+
+// log returns the current logger. The heartbeat goroutine logs concurrently
+// with SetLogger, so access is guarded.
+func (c *tlsRpcClient) log() Logger {
+	c.loggerMu.RLock()
+	defer c.loggerMu.RUnlock()
+	return c.logger
 }
 
 // ConnectToRpcServerTls calls the specified RPC method on the connected TLS
 // RPC server using the provided arguments. The returned error is non-nil if
 // the RPC call fails.
 func (c *tlsRpcClient) ConnectToRpcServerTls(serviceMethod string, args []byte) ([]byte, error) {
-	c.logger.Infof("Calling RPC method: %s", serviceMethod)
-	c.logger.Debugf("RPC method %s called with args: %+v", serviceMethod, args)
+	return c.ConnectToRpcServerTlsContext(context.Background(), serviceMethod, args)
+}
 
-	client := rpc.NewClient(c.conn)
-	defer client.Close()
+// ConnectToRpcServerTlsContext is like ConnectToRpcServerTls but gives up
+// when ctx is done. The time left until ctx's deadline is sent with the
+// call, so the server cancels the handler's context once the client has
+// stopped waiting.
+func (c *tlsRpcClient) ConnectToRpcServerTlsContext(ctx context.Context, serviceMethod string, args []byte) ([]byte, error) {
+	logger := c.log()
+	logger.Infof("Calling RPC method: %s", serviceMethod)
+	logger.Debugf("RPC method %s called with args: %+v", serviceMethod, args)
 
 	var reply []byte
-	err := client.Call(serviceMethod, &args, &reply)
+	started := time.Now()
+	err := c.call(ctx, serviceMethod, args, &reply)
 	if err != nil {
-		c.logger.Errorf("RPC call failed for method %s: %v", serviceMethod, err)
+		err = remoteError(err)
+	}
+	c.metrics.callDone(serviceMethod, err, time.Since(started))
+	if err != nil {
+		logger.Errorf("RPC call failed for method %s: %v", serviceMethod, err)
 		return nil, fmt.Errorf("failed to call RPC method %s: %w", serviceMethod, err)
 	}
 
-	c.logger.Infof("RPC call successful for method: %s", serviceMethod)
-	c.logger.Debugf("RPC method %s returned: %+v", serviceMethod, reply)
+	logger.Infof("RPC call successful for method: %s", serviceMethod)
+	logger.Debugf("RPC method %s returned: %+v", serviceMethod, reply)
 	return reply, nil
 }
 
+// callArgs carries the arguments of a call to clientCodec.WriteRequest,
+// together with the values it sends in the request header.
+type callArgs struct {
+	args           []byte
+	timeout        time.Duration
+	token          string
+	idempotencyKey string
+}
+
+// call sends a call carrying ctx's deadline, bearer token and idempotency
+// key and waits for its reply or for ctx to be done. An abandoned call's
+// reply is discarded when it arrives.
+func (c *tlsRpcClient) call(ctx context.Context, serviceMethod string, args []byte, reply *[]byte) error {
+	timeout, err := callTimeout(ctx)
+	if err != nil {
+		return err
+	}
+
+	body := &callArgs{args: args, timeout: timeout, token: c.callToken(ctx), idempotencyKey: callIdempotencyKey(ctx)}
+	call := c.rpc.Go(serviceMethod, body, reply, make(chan *rpc.Call, 1))
+	select {
+	case <-call.Done:
+		return call.Error
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// heartbeat pings the server every HeartbeatInterval and closes the
+// connection when a ping is not answered within HeartbeatTimeout, failing
+// any calls still waiting on a dead server.
+func (c *tlsRpcClient) heartbeat() {
+	ticker := time.NewTicker(c.timeouts.HeartbeatInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+		}
+
+		if err := c.ping(); err != nil {
+			select {
+			case <-c.done:
+				return
+			default:
+			}
+			c.log().Errorf("Heartbeat to server failed for client %s, closing connection: %v", c.name, err)
+			c.conn.Close()
+			return
+		}
+	}
+}
+
+// ping sends a single heartbeat and waits up to HeartbeatTimeout for the
+// reply.
+func (c *tlsRpcClient) ping() error {
+	var reply []byte
+	call := c.rpc.Go(heartbeatMethod, []byte(nil), &reply, make(chan *rpc.Call, 1))
+	if c.timeouts.HeartbeatTimeout <= 0 {
+		<-call.Done
+		return call.Error
+	}
+
+	timer := time.NewTimer(c.timeouts.HeartbeatTimeout)
+	defer timer.Stop()
+	select {
+	case <-call.Done:
+		return call.Error
+	case <-timer.C:
+		return fmt.Errorf("no reply within %s", c.timeouts.HeartbeatTimeout)
+	}
+}
+
 // CloseServer closes the TLS RPC server listener. If the server is already
-// closed, this method has no effect.
+// closed, this method has no effect. Serve and ServeContext return
+// ErrServerClosed once the listener is closed.
 func (s *tlsRpcServer) CloseServer() {
-	if s.listener != nil {
-		s.logger.Info("Closing TLS RPC server")
-		s.listener.Close()
+	s.mu.Lock()
+	if s.closed || s.listener == nil {
+		s.mu.Unlock()
+		return
 	}
+	s.closed = true
+	s.mu.Unlock()
+
+	s.logger.Info("Closing TLS RPC server")
+	s.listener.Close()
+}
+
+func (s *tlsRpcServer) isClosed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closed
+}
+
+// Addr returns the address the server is listening on. It is useful after
+// listening on port "0" to learn the port picked by the system.
+func (s *tlsRpcServer) Addr() net.Addr {
+	return s.listener.Addr()
 }
 
 // RegisterMethod registers a new RPC service with the server. The
@@ -134,13 +499,20 @@ func (s *tlsRpcServer) CloseServer() {
 // to access the service. The service parameter is a pointer to the actual service
 // implementation.
 //
+// Methods must take *[]byte or *Request and reply with *[]byte; services
+// with methods of other types are refused.
+//
 // The returned error is non-nil if the registration fails.
 func (s *tlsRpcServer) RegisterMethod(serviceName string, service any) error {
-	err := rpc.RegisterName(serviceName, service)
+	err := checkServiceTypes(service)
+	if err == nil {
+		err = s.rpcServer.RegisterName(serviceName, service)
+	}
 	if err != nil {
 		s.logger.Errorf("Failed to register RPC service %s: %v", serviceName, err)
 		return fmt.Errorf("failed to register RPC service %s: %w", serviceName, err)
 	}
+	s.recordMethods(serviceName, service)
 	s.logger.Infof("Successfully registered RPC service: %s", serviceName)
 	return nil
 }
@@ -157,19 +529,44 @@ func (s *tlsRpcServer) SetLogger(logger Logger) {
 // while accepting connections. The server will also log a message when a new
 // client connects or disconnects. The server will automatically spawn a new
 // goroutine to handle each incoming connection.
-func (s *tlsRpcServer) Serve() {
+//
+// Temporary accept failures, such as running out of file descriptors, are
+// retried with a backoff. Serve always returns a non-nil error:
+// ErrServerClosed after CloseServer, or the accept error that stopped it.
+func (s *tlsRpcServer) Serve() error {
 	s.logger.Infof("TLS RPC server started, listening on %s", s.listener.Addr().String())
 	s.logger.Debugf("Server configuration: TLS enabled, RPC protocol")
+	done := make(chan struct{})
+	defer close(done)
+	if s.expiry != nil {
+		go s.expiry.run(done)
+	}
+	if s.crls != nil {
+		go s.crls.run(done)
+	}
 
+	var backoff time.Duration
 	for {
 		conn, err := s.listener.Accept()
 		if err != nil {
-			// Log the error and continue, unless it's due to listener being closed
-			if opErr, ok := err.(*net.OpError); ok && opErr.Op == "accept" {
+			if s.isClosed() {
 				s.logger.Info("Server stopped accepting connections")
-				break
+				return ErrServerClosed
+			}
+			if isTemporary(err) {
+				backoff = nextAcceptBackoff(backoff)
+				s.logger.Warnf("Failed to accept connection: %v; retrying in %s", err, backoff)
+				time.Sleep(backoff)
+				continue
 			}
 			s.logger.Errorf("Failed to accept connection: %v", err)
+			return fmt.Errorf("failed to accept connection: %w", err)
+		}
+		backoff = 0
+
+		if !s.admitConnection() {
+			s.logger.Warnf("Rejecting client %s: %v (limit %d)", conn.RemoteAddr().String(), ErrTooManyConnections, s.limits.MaxConnections)
+			go s.rejectConnection(conn, ErrTooManyConnections)
 			continue
 		}
 
@@ -179,14 +576,25 @@ func (s *tlsRpcServer) Serve() {
 	}
 }
 
+// ServeContext is like Serve but also closes the server when ctx is done, in
+// which case it returns ErrServerClosed.
+func (s *tlsRpcServer) ServeContext(ctx context.Context) error {
+	stop := context.AfterFunc(ctx, s.CloseServer)
+	defer stop()
+	return s.Serve()
+}
+
 // handleConnection manages a single RPC connection for the TLS RPC server.
 // It logs the connection details, serves the RPC requests, and ensures
 // the connection is closed after use. The function also captures and logs
 // any panics that may occur during RPC handling to prevent the server from
 // crashing.
 func (s *tlsRpcServer) handleConnection(conn net.Conn) {
+	sc := newServerConn(s, conn)
+	s.trackConn(sc)
 	defer func() {
 		conn.Close()
+		s.untrackConn(sc)
 		s.logger.Infof("Connection closed for client %s", conn.RemoteAddr().String())
 	}()
 
@@ -200,6 +608,41 @@ func (s *tlsRpcServer) handleConnection(conn net.Conn) {
 		}
 	}()
 
-	rpc.ServeConn(conn)
+	sc.serve()
 	s.logger.Debugf("RPC handler finished for client %s", conn.RemoteAddr().String())
 }
+
+// admitConnection reserves a connection slot, honouring MaxConnections. The
+// slot is released by untrackConn once handleConnection returns.
+func (s *tlsRpcServer) admitConnection() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if limit := s.limits.MaxConnections; limit > 0 && s.open >= limit {
+		return false
+	}
+	s.open++
+	s.metrics.connOpened()
+	return true
+}
+
+func (s *tlsRpcServer) trackConn(sc *serverConn) {
+	s.mu.Lock()
+	s.conns[sc] = struct{}{}
+	s.mu.Unlock()
+}
+
+func (s *tlsRpcServer) untrackConn(sc *serverConn) {
+	s.mu.Lock()
+	delete(s.conns, sc)
+	s.mu.Unlock()
+	s.releaseConnection()
+}
+
+// releaseConnection gives back a slot reserved by admitConnection.
+func (s *tlsRpcServer) releaseConnection() {
+	s.mu.Lock()
+	s.open--
+	s.metrics.connClosed()
+	s.mu.Unlock()
+}
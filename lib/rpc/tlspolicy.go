@@ -0,0 +1,159 @@
+package swissknife
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// TLS policy profile names accepted by TLSPolicyProfile.
+const (
+	TLSProfileModern       = "modern"
+	TLSProfileIntermediate = "intermediate"
+	TLSProfileCompliance   = "compliance"
+)
+
+// TLSPolicy restricts the protocol versions, cipher suites and key exchange
+// curves a client or server negotiates. Zero fields keep the crypto/tls
+// defaults, so a profile can be customised by overriding single fields.
+type TLSPolicy struct {
+	// Name identifies the policy in logs.
+	Name string
+
+	// MinVersion and MaxVersion bound the protocol version, for example
+	// tls.VersionTLS12.
+	MinVersion uint16
+	MaxVersion uint16
+
+	// CipherSuites lists the TLS 1.2 suites allowed, by ID. crypto/tls does
+	// not allow TLS 1.3 suites to be configured.
+	CipherSuites []uint16
+
+	// CurvePreferences lists the key exchange groups allowed, in order of
+	// preference.
+	CurvePreferences []tls.CurveID
+}
+
+// ModernTLSPolicy allows TLS 1.3 only.
+func ModernTLSPolicy() TLSPolicy {
+	return TLSPolicy{
+		Name:             TLSProfileModern,
+		MinVersion:       tls.VersionTLS13,
+		CurvePreferences: []tls.CurveID{tls.X25519, tls.CurveP256, tls.CurveP384},
+	}
+}
+
+// IntermediateTLSPolicy allows TLS 1.2 and 1.3, restricting TLS 1.2 to
+// ECDHE key exchange with AEAD ciphers.
+func IntermediateTLSPolicy() TLSPolicy {
+	return TLSPolicy{
+		Name:       TLSProfileIntermediate,
+		MinVersion: tls.VersionTLS12,
+		CipherSuites: []uint16{
+			tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256,
+			tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256,
+		},
+		CurvePreferences: []tls.CurveID{tls.X25519, tls.CurveP256, tls.CurveP384},
+	}
+}
+
+// ComplianceTLSPolicy allows only NIST-approved algorithms: AES-GCM suites
+// with ECDHE over P-256 or P-384. Since crypto/tls cannot restrict TLS 1.3
+// suites, which include ChaCha20, the policy is pinned to TLS 1.2.
+func ComplianceTLSPolicy() TLSPolicy {
+	return TLSPolicy{
+		Name:       TLSProfileCompliance,
+		MinVersion: tls.VersionTLS12,
+		MaxVersion: tls.VersionTLS12,
+		CipherSuites: []uint16{
+			tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+		},
+		CurvePreferences: []tls.CurveID{tls.CurveP256, tls.CurveP384},
+	}
+}
+
+// TLSPolicyProfile returns the named profile, as used in configuration
+// files.
+func TLSPolicyProfile(name string) (TLSPolicy, error) {
+	switch strings.ToLower(name) {
+	case TLSProfileModern:
+		return ModernTLSPolicy(), nil
+	case TLSProfileIntermediate:
+		return IntermediateTLSPolicy(), nil
+	case TLSProfileCompliance:
+		return ComplianceTLSPolicy(), nil
+	}
+	return TLSPolicy{}, fmt.Errorf("unknown TLS policy profile %q", name)
+}
+
+// WithTLSPolicy restricts the TLS parameters the server accepts.
+func WithTLSPolicy(policy TLSPolicy) ServerOption {
+	return func(s *tlsRpcServer) {
+		s.tlsPolicy = &policy
+	}
+}
+
+// WithClientTLSPolicy restricts the TLS parameters the client offers.
+func WithClientTLSPolicy(policy TLSPolicy) ClientOption {
+	return func(c *tlsRpcClient) {
+		c.tlsPolicy = &policy
+	}
+}
+
+// validate rejects policies that cannot be negotiated or that allow cipher
+// suites crypto/tls considers insecure.
+func (p TLSPolicy) validate() error {
+	if p.MinVersion != 0 && p.MinVersion < tls.VersionTLS12 {
+		return fmt.Errorf("minimum version %s is not supported", tls.VersionName(p.MinVersion))
+	}
+	if p.MaxVersion != 0 && p.MinVersion > p.MaxVersion {
+		return fmt.Errorf("minimum version %s is above maximum version %s", tls.VersionName(p.MinVersion), tls.VersionName(p.MaxVersion))
+	}
+	if len(p.CipherSuites) > 0 && p.MinVersion == tls.VersionTLS13 {
+		return errors.New("cipher suites cannot be configured for TLS 1.3")
+	}
+
+	secure := make(map[uint16]bool)
+	for _, suite := range tls.CipherSuites() {
+		secure[suite.ID] = true
+	}
+	for _, id := range p.CipherSuites {
+		if !secure[id] {
+			return fmt.Errorf("cipher suite %s is not allowed", tls.CipherSuiteName(id))
+		}
+	}
+	return nil
+}
+
+// apply copies the policy onto config.
+func (p TLSPolicy) apply(config *tls.Config) {
+	config.MinVersion = p.MinVersion
+	config.MaxVersion = p.MaxVersion
+	config.CipherSuites = p.CipherSuites
+	config.CurvePreferences = p.CurvePreferences
+}
+
+// applyTLSPolicy validates policy, when set, and applies it to config.
+func applyTLSPolicy(policy *TLSPolicy, config *tls.Config) error {
+	if policy == nil {
+		return nil
+	}
+	if err := policy.validate(); err != nil {
+		return fmt.Errorf("invalid TLS policy %s: %w", policy.Name, err)
+	}
+	policy.apply(config)
+	return nil
+}
+
+// describeTLS summarises the negotiated parameters of a connection for logs.
+func describeTLS(version, cipherSuite uint16) string {
+	return fmt.Sprintf("%s, %s", tls.VersionName(version), tls.CipherSuiteName(cipherSuite))
+}
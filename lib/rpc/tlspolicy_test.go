@@ -0,0 +1,80 @@
+package swissknife
+
+import (
+	"crypto/tls"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTLSPolicyProfileByName(t *testing.T) {
+	policy, err := TLSPolicyProfile("Modern")
+	require.NoError(t, err)
+	require.Equal(t, ModernTLSPolicy(), policy)
+
+	_, err = TLSPolicyProfile("legacy")
+	require.Error(t, err)
+}
+
+func TestCompliancePolicyNegotiatesTLS12(t *testing.T) {
+	pki := newTestPKI(t)
+	s, addr := startTestServer(t, pki, WithTLSPolicy(ComplianceTLSPolicy()))
+	client := newTestClient(t, pki, addr, WithClientTLSPolicy(IntermediateTLSPolicy()))
+	require.Equal(t, 42, callAdd(t, client))
+
+	conns := s.Connections()
+	require.Len(t, conns, 1)
+	require.Equal(t, "TLS 1.2", conns[0].TLSVersion)
+
+	info := s.connInfo(t)
+	require.Contains(t, ComplianceTLSPolicy().CipherSuites, info.CipherSuite)
+}
+
+func TestModernServerRefusesTLS12Client(t *testing.T) {
+	pki := newTestPKI(t)
+	_, addr := startTestServer(t, pki, WithTLSPolicy(ModernTLSPolicy()))
+
+	_, err := NewITlsRpcClient(pki.caCert, pki.clientCert, pki.clientKey, addr, "test-client", WithClientTLSPolicy(ComplianceTLSPolicy()))
+	require.Error(t, err)
+}
+
+func TestCustomPolicyOverrides(t *testing.T) {
+	pki := newTestPKI(t)
+	policy := IntermediateTLSPolicy()
+	policy.MaxVersion = tls.VersionTLS12
+	policy.CurvePreferences = []tls.CurveID{tls.CurveP384}
+	s, addr := startTestServer(t, pki, WithTLSPolicy(policy))
+	client := newTestClient(t, pki, addr)
+	require.Equal(t, 42, callAdd(t, client))
+	require.Equal(t, uint16(tls.VersionTLS12), s.connInfo(t).TLSVersion)
+}
+
+func TestInvalidTLSPolicyIsRejected(t *testing.T) {
+	pki := newTestPKI(t)
+
+	insecure := IntermediateTLSPolicy()
+	insecure.CipherSuites = append(insecure.CipherSuites, tls.TLS_RSA_WITH_RC4_128_SHA)
+	_, err := NewITlsRpcServer(pki.serverCert, pki.serverKey, pki.caCert, "0", WithTLSPolicy(insecure))
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "is not allowed")
+
+	inverted := TLSPolicy{MinVersion: tls.VersionTLS13, MaxVersion: tls.VersionTLS12}
+	_, err = NewITlsRpcClient(pki.caCert, pki.clientCert, pki.clientKey, "localhost:1", "test-client", WithClientTLSPolicy(inverted))
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "above maximum version")
+}
+
+// connInfo returns the details of the single open connection of s.
+func (s *tlsRpcServer) connInfo(t *testing.T) ConnInfo {
+	t.Helper()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	require.Len(t, s.conns, 1)
+	for sc := range s.conns {
+		sc.mu.Lock()
+		defer sc.mu.Unlock()
+		return sc.info
+	}
+	return ConnInfo{}
+}
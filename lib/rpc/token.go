@@ -0,0 +1,190 @@
+package swissknife
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// minHMACKeySize is the shortest key accepted by NewHMACTokens, the size of
+// a SHA-256 digest.
+const minHMACKeySize = sha256.Size
+
+// ErrInvalidToken is returned for calls whose bearer token is missing or
+// does not validate on a server created with WithTokenAuthentication.
+var ErrInvalidToken = errors.New("rpc: invalid bearer token")
+
+// Principal is the caller authenticated by a bearer token, as opposed to the
+// client certificate that carried the call.
+type Principal struct {
+	Subject   string
+	Claims    map[string]string
+	ExpiresAt time.Time
+}
+
+// TokenValidator checks the bearer token sent with a call. conn describes
+// the connection the call arrived on, so that validators can tie tokens to
+// the gateways allowed to present them.
+type TokenValidator interface {
+	ValidateToken(token string, conn ConnInfo) (*Principal, error)
+}
+
+// TokenValidatorFunc adapts a function to TokenValidator.
+type TokenValidatorFunc func(token string, conn ConnInfo) (*Principal, error)
+
+// ValidateToken calls f(token, conn).
+func (f TokenValidatorFunc) ValidateToken(token string, conn ConnInfo) (*Principal, error) {
+	return f(token, conn)
+}
+
+// WithTokenAuthentication requires every call, other than those allowed by
+// WithUnauthenticatedMethods, to carry a bearer token accepted by
+// validator. The resulting principal is available to methods as
+// Request.Principal, next to the certificate identity.
+func WithTokenAuthentication(validator TokenValidator) ServerOption {
+	return func(s *tlsRpcServer) {
+		s.tokens = validator
+		s.requireTokens = true
+	}
+}
+
+// authenticateToken validates the token sent with a call.
+func (s *tlsRpcServer) authenticateToken(token string, info ConnInfo) (*Principal, error) {
+	if token == "" {
+		return nil, fmt.Errorf("%w: missing", ErrInvalidToken)
+	}
+	principal, err := s.tokens.ValidateToken(token, info)
+	if err != nil {
+		if errors.Is(err, ErrInvalidToken) {
+			return nil, err
+		}
+		return nil, fmt.Errorf("%w: %v", ErrInvalidToken, err)
+	}
+	if principal == nil {
+		return nil, fmt.Errorf("%w: no principal", ErrInvalidToken)
+	}
+	return principal, nil
+}
+
+// WithBearerToken sends token with every call made by the client, unless
+// the call's context carries another one set with ContextWithToken.
+func WithBearerToken(token string) ClientOption {
+	return func(c *tlsRpcClient) {
+		c.token = token
+	}
+}
+
+type tokenKey struct{}
+
+// ContextWithToken returns a copy of ctx that makes
+// ConnectToRpcServerTlsContext send token with the call, for clients calling
+// on behalf of several users.
+func ContextWithToken(ctx context.Context, token string) context.Context {
+	return context.WithValue(ctx, tokenKey{}, token)
+}
+
+// callToken returns the token to send with a call made with ctx.
+func (c *tlsRpcClient) callToken(ctx context.Context) string {
+	if token, ok := ctx.Value(tokenKey{}).(string); ok {
+		return token
+	}
+	return c.token
+}
+
+// HMACTokens issues and validates bearer tokens signed with HMAC-SHA256. A
+// token is the base64url encoded JSON claims followed by a dot and the
+// base64url encoded signature of the first part. It implements
+// TokenValidator.
+type HMACTokens struct {
+	keys [][]byte
+}
+
+type hmacClaims struct {
+	Subject   string            `json:"sub"`
+	ExpiresAt int64             `json:"exp"`
+	Claims    map[string]string `json:"claims,omitempty"`
+}
+
+// NewHMACTokens returns tokens signed with key. Tokens signed with any of
+// the previous keys are still accepted, so that keys can be rotated. Keys
+// must be at least 32 bytes long.
+func NewHMACTokens(key []byte, previous ...[]byte) (*HMACTokens, error) {
+	keys := append([][]byte{key}, previous...)
+	for _, k := range keys {
+		if len(k) < minHMACKeySize {
+			return nil, fmt.Errorf("HMAC token key must be at least %d bytes, got %d", minHMACKeySize, len(k))
+		}
+	}
+	return &HMACTokens{keys: keys}, nil
+}
+
+// Issue returns a token for subject that expires after ttl.
+func (h *HMACTokens) Issue(subject string, ttl time.Duration, claims map[string]string) (string, error) {
+	if subject == "" {
+		return "", errors.New("HMAC token subject is empty")
+	}
+	payload, err := json.Marshal(hmacClaims{
+		Subject:   subject,
+		ExpiresAt: time.Now().Add(ttl).Unix(),
+		Claims:    claims,
+	})
+	if err != nil {
+		return "", err
+	}
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+	signature := base64.RawURLEncoding.EncodeToString(hmacSign(h.keys[0], encoded))
+	return encoded + "." + signature, nil
+}
+
+// ValidateToken checks the signature and expiry of token.
+func (h *HMACTokens) ValidateToken(token string, _ ConnInfo) (*Principal, error) {
+	encoded, signature, ok := strings.Cut(token, ".")
+	if !ok {
+		return nil, fmt.Errorf("%w: malformed", ErrInvalidToken)
+	}
+	mac, err := base64.RawURLEncoding.DecodeString(signature)
+	if err != nil {
+		return nil, fmt.Errorf("%w: malformed signature", ErrInvalidToken)
+	}
+	if !h.verify(encoded, mac) {
+		return nil, fmt.Errorf("%w: bad signature", ErrInvalidToken)
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("%w: malformed claims", ErrInvalidToken)
+	}
+	var claims hmacClaims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, fmt.Errorf("%w: malformed claims", ErrInvalidToken)
+	}
+	expiresAt := time.Unix(claims.ExpiresAt, 0)
+	if !time.Now().Before(expiresAt) {
+		return nil, fmt.Errorf("%w: expired at %s", ErrInvalidToken, expiresAt.UTC().Format(time.RFC3339))
+	}
+	if claims.Subject == "" {
+		return nil, fmt.Errorf("%w: no subject", ErrInvalidToken)
+	}
+	return &Principal{Subject: claims.Subject, Claims: claims.Claims, ExpiresAt: expiresAt}, nil
+}
+
+func (h *HMACTokens) verify(encoded string, mac []byte) bool {
+	for _, key := range h.keys {
+		if hmac.Equal(mac, hmacSign(key, encoded)) {
+			return true
+		}
+	}
+	return false
+}
+
+func hmacSign(key []byte, encoded string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(encoded))
+	return mac.Sum(nil)
+}
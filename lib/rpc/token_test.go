@@ -0,0 +1,135 @@
+package swissknife
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// WhoAmIService replies with the principal and certificate identity of the
+// caller.
+type WhoAmIService struct{}
+
+func (s *WhoAmIService) Get(req *Request, reply *[]byte) error {
+	if req.Principal == nil {
+		return errors.New("no principal")
+	}
+	*reply = []byte(req.Principal.Subject + "@" + req.Principal.Claims["tenant"] + " via " + req.Identity())
+	return nil
+}
+
+func newHMACTokens(t *testing.T) *HMACTokens {
+	t.Helper()
+
+	tokens, err := NewHMACTokens(bytes.Repeat([]byte("k"), 32))
+	require.NoError(t, err)
+	return tokens
+}
+
+func TestHMACTokens(t *testing.T) {
+	tokens := newHMACTokens(t)
+	token, err := tokens.Issue("alice", time.Hour, map[string]string{"tenant": "acme"})
+	require.NoError(t, err)
+
+	principal, err := tokens.ValidateToken(token, ConnInfo{})
+	require.NoError(t, err)
+	require.Equal(t, "alice", principal.Subject)
+	require.Equal(t, "acme", principal.Claims["tenant"])
+	require.WithinDuration(t, time.Now().Add(time.Hour), principal.ExpiresAt, 2*time.Second)
+
+	encoded, signature, _ := strings.Cut(token, ".")
+	for name, bad := range map[string]string{
+		"empty":     "",
+		"unsigned":  encoded,
+		"tampered":  encoded + "x." + signature,
+		"signature": encoded + ".!!",
+	} {
+		_, err := tokens.ValidateToken(bad, ConnInfo{})
+		require.ErrorIs(t, err, ErrInvalidToken, name)
+	}
+
+	expired, err := tokens.Issue("alice", -time.Minute, nil)
+	require.NoError(t, err)
+	_, err = tokens.ValidateToken(expired, ConnInfo{})
+	require.ErrorIs(t, err, ErrInvalidToken)
+	require.Contains(t, err.Error(), "expired")
+
+	_, err = tokens.Issue("", time.Hour, nil)
+	require.Error(t, err)
+	_, err = NewHMACTokens([]byte("short"))
+	require.Error(t, err)
+}
+
+func TestHMACTokensKeyRotation(t *testing.T) {
+	oldKey := bytes.Repeat([]byte("o"), 32)
+	old, err := NewHMACTokens(oldKey)
+	require.NoError(t, err)
+	token, err := old.Issue("alice", time.Hour, nil)
+	require.NoError(t, err)
+
+	rotated, err := NewHMACTokens(bytes.Repeat([]byte("n"), 32), oldKey)
+	require.NoError(t, err)
+	_, err = rotated.ValidateToken(token, ConnInfo{})
+	require.NoError(t, err)
+
+	fresh, err := NewHMACTokens(bytes.Repeat([]byte("n"), 32))
+	require.NoError(t, err)
+	_, err = fresh.ValidateToken(token, ConnInfo{})
+	require.ErrorIs(t, err, ErrInvalidToken)
+}
+
+func TestTokenAuthentication(t *testing.T) {
+	pki := newTestPKI(t)
+	tokens := newHMACTokens(t)
+	s, addr := startTestServer(t, pki, WithTokenAuthentication(tokens))
+	require.NoError(t, s.RegisterMethod("WhoAmI", new(WhoAmIService)))
+
+	anonymous := newTestClient(t, pki, addr)
+	_, err := anonymous.ConnectToRpcServerTls("WhoAmI.Get", nil)
+	require.ErrorIs(t, err, ErrInvalidToken)
+	_, err = anonymous.ConnectToRpcServerTlsContext(ContextWithToken(context.Background(), "forged.token"), "WhoAmI.Get", nil)
+	require.ErrorIs(t, err, ErrInvalidToken)
+
+	alice, err := tokens.Issue("alice", time.Hour, map[string]string{"tenant": "acme"})
+	require.NoError(t, err)
+	client := newTestClient(t, pki, addr, WithBearerToken(alice))
+	reply, err := client.ConnectToRpcServerTls("WhoAmI.Get", nil)
+	require.NoError(t, err)
+	require.Equal(t, "alice@acme via CN=test-client", string(reply))
+
+	bob, err := tokens.Issue("bob", time.Hour, map[string]string{"tenant": "initech"})
+	require.NoError(t, err)
+	reply, err = client.ConnectToRpcServerTlsContext(ContextWithToken(context.Background(), bob), "WhoAmI.Get", nil)
+	require.NoError(t, err)
+	require.Equal(t, "bob@initech via CN=test-client", string(reply))
+
+	results, err := CallBatch(client, Batch{Calls: []BatchCall{{ServiceMethod: "WhoAmI.Get"}}})
+	require.NoError(t, err)
+	require.NoError(t, results[0].Err)
+	require.Equal(t, "alice@acme via CN=test-client", string(results[0].Reply))
+}
+
+func TestTokenValidatorSeesConnection(t *testing.T) {
+	pki := newTestPKI(t)
+	validator := TokenValidatorFunc(func(token string, conn ConnInfo) (*Principal, error) {
+		if conn.Identity() != "CN=test-client" {
+			return nil, errors.New("gateway not trusted")
+		}
+		return &Principal{Subject: token}, nil
+	})
+	s, addr := startTestServer(t, pki, WithTokenAuthentication(validator))
+	require.NoError(t, s.RegisterMethod("WhoAmI", new(WhoAmIService)))
+
+	client := newTestClient(t, pki, addr, WithBearerToken("carol"))
+	reply, err := client.ConnectToRpcServerTls("WhoAmI.Get", nil)
+	require.NoError(t, err)
+	require.Equal(t, "carol@ via CN=test-client", string(reply))
+
+	_, err = NewITlsRpcServer(pki.serverCert, pki.serverKey, pki.caCert, "0", WithTokenAuthentication(nil))
+	require.Error(t, err)
+}
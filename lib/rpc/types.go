@@ -1,14 +1,22 @@
 package swissknife
 
 import (
+	"context"
 	"crypto/tls"
 	"net"
+	"net/rpc"
+	"net/url"
+	"sync"
+	"sync/atomic"
 )
 
 type ITlsRpcServer interface {
+	Addr() net.Addr
 	CloseServer()
+	Connections() []ConnectionStats
 	RegisterMethod(serviceName string, service any) error
-	Serve()
+	Serve() error
+	ServeContext(ctx context.Context) error
 	SetLogger(logger Logger)
 }
 
@@ -16,18 +24,101 @@ type ITlsRpcClient interface {
 	CloseClient()
 	SetLogger(logger Logger)
 	ConnectToRpcServerTls(serviceMethod string, args []byte) ([]byte, error)
+	ConnectToRpcServerTlsContext(ctx context.Context, serviceMethod string, args []byte) ([]byte, error)
 }
 
 type tlsRpcClient struct {
-	conn   *tls.Conn
-	logger Logger
+	conn       net.Conn
+	rpc        *rpc.Client
+	name       string
+	network    string
+	dial       func(ctx context.Context, network, address string) (net.Conn, error)
+	proxy      func(address string) (*url.URL, error)
+	serverName string
+	timeouts   Timeouts
+	metrics    *clientMetrics
+	tlsPolicy  *TLSPolicy
+	pins       []string
+	revocation *RevocationConfig
+
+	// serverSPIFFE are the SPIFFE ID patterns the server must match.
+	serverSPIFFE []string
+
+	// services are registered with WithClientService for the server to
+	// call.
+	services []clientService
+
+	// token is the bearer token sent with calls by default.
+	token string
+
+	// webSocketPath is set by WithWebSocket.
+	webSocketPath string
+
+	// systemRoots adds the system CA pool to the CAs loaded from the CA path.
+	systemRoots bool
+
+	expiryConfig *ExpiryMonitorConfig
+
+	loggerMu sync.RWMutex
+	logger   Logger
+
+	closeOnce sync.Once
+	done      chan struct{}
 }
 
+// ClientOption configures optional behaviour of a TLS RPC client. Options are
+// applied by NewITlsRpcClient before it connects.
+type ClientOption func(*tlsRpcClient)
+
 type tlsRpcServer struct {
-	listener net.Listener
-	logger   Logger
+	listener   net.Listener
+	tlsConfig  *tls.Config
+	logger     Logger
+	rpcServer  *rpc.Server
+	limits     ServerLimits
+	timeouts   Timeouts
+	hooks      ConnHooks
+	metrics    *serverMetrics
+	tlsPolicy  *TLSPolicy
+	revocation *RevocationConfig
+	crls       *revocationChecker
+
+	expiryConfig *ExpiryMonitorConfig
+	expiry       *expiryMonitor
+
+	rateLimit        *rateLimiter
+	methodRateLimits map[string]*rateLimiter
+
+	mu      sync.Mutex
+	closed  bool
+	open    int
+	conns   map[*serverConn]struct{}
+	methods map[string]bool
+
+	// unauthenticated lists the methods clients without a certificate may
+	// call; when it is not empty client certificates become optional.
+	unauthenticated map[string]bool
+
+	spiffeRules []SPIFFERule
+	spiffe      *spiffeAuthorizer
+
+	bidirectional bool
+
+	// tokens validates bearer tokens when requireTokens is set.
+	tokens        TokenValidator
+	requireTokens bool
+
+	// idempotency remembers the outcome of calls sent with an idempotency
+	// key, when set by WithIdempotency.
+	idempotency *idempotencyCache
+
+	nextConnID atomic.Uint64
 }
 
+// ServerOption configures optional behaviour of a TLS RPC server. Options are
+// applied by NewITlsRpcServer before the listener is created.
+type ServerOption func(*tlsRpcServer)
+
 type EncryptedRPCStream struct {
 	EncryptedStream []byte
 	Nonce           []byte
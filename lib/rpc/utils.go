@@ -2,19 +2,142 @@ package swissknife
 
 import (
 	"crypto/x509"
+	"encoding/pem"
+	"errors"
 	"fmt"
 	"os"
+	"path/filepath"
+	"sort"
+	"strings"
 )
 
-func loadCertPool(certFile string) (*x509.CertPool, error) {
-	certData, err := os.ReadFile(certFile)
-	if err != nil {
-		return nil, fmt.Errorf("failed to read cert %s: %w", certFile, err)
+// WithSystemRoots makes the client trust the operating system's CA pool in
+// addition to the CAs at caCrtPath, which may then be left empty.
+func WithSystemRoots() ClientOption {
+	return func(c *tlsRpcClient) {
+		c.systemRoots = true
 	}
+}
 
+// loadCertPool builds a pool from the CA certificates at path, which may be
+// a PEM file or a directory of PEM files. Rejected blocks are logged as
+// warnings through logger, which may be nil. It fails when no certificate
+// could be loaded.
+func loadCertPool(path string, logger Logger) (*x509.CertPool, error) {
 	pool := x509.NewCertPool()
-	pool.AppendCertsFromPEM(certData)
+	if _, err := addCACertificates(pool, path, logger); err != nil {
+		return nil, err
+	}
 	return pool, nil
 }
 
+// addCACertificates adds the CA certificates at path to pool, as described
+// for loadCertPool, and returns them.
+func addCACertificates(pool *x509.CertPool, path string, logger Logger) ([]*x509.Certificate, error) {
+	certs, rejected, err := loadCACertificates(path)
+	if err != nil {
+		return nil, err
+	}
+	if logger != nil {
+		for _, reason := range rejected {
+			logger.Warnf("Ignoring CA data in %s", reason)
+		}
+	}
+	for _, cert := range certs {
+		pool.AddCert(cert)
+	}
+	return certs, nil
+}
+
+// loadCACertificates parses the PEM encoded certificates at path, which may
+// be a file or a directory whose regular, non-hidden files are read in name
+// order. Blocks that are not certificates or do not parse are skipped and
+// described in rejected. It fails when no certificate is found, listing the
+// rejected blocks in the error.
+func loadCACertificates(path string) (certs []*x509.Certificate, rejected []string, err error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read cert %s: %w", path, err)
+	}
+
+	files := []string{path}
+	if info.IsDir() {
+		if files, err = caFiles(path); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to read cert %s: %w", file, err)
+		}
+		fileCerts, fileRejected := parseCertificates(file, data)
+		certs = append(certs, fileCerts...)
+		rejected = append(rejected, fileRejected...)
+	}
+
+	if len(certs) == 0 {
+		msg := fmt.Sprintf("no CA certificates found in %s", path)
+		if len(rejected) > 0 {
+			msg += ": rejected " + strings.Join(rejected, "; ")
+		}
+		return nil, rejected, errors.New(msg)
+	}
+	return certs, rejected, nil
+}
+
+// caFiles lists the regular, non-hidden files in dir, sorted by name.
+func caFiles(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read cert directory %s: %w", dir, err)
+	}
+
+	var files []string
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		file := filepath.Join(dir, entry.Name())
+		// Follow symlinks, as created by c_rehash, but skip subdirectories.
+		if info, err := os.Stat(file); err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		files = append(files, file)
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// parseCertificates returns the certificates in the PEM data read from file
+// and a description of every block, or of the file, that was rejected.
+func parseCertificates(file string, data []byte) (certs []*x509.Certificate, rejected []string) {
+	index := 0
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		index++
+
+		if block.Type != "CERTIFICATE" {
+			rejected = append(rejected, fmt.Sprintf("%s block %d: unexpected PEM type %q", file, index, block.Type))
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			rejected = append(rejected, fmt.Sprintf("%s block %d: %v", file, index, err))
+			continue
+		}
+		certs = append(certs, cert)
+	}
+
+	if index == 0 {
+		rejected = append(rejected, fmt.Sprintf("%s: no PEM data", file))
+	}
+	return certs, rejected
+}
+
 // ====================================== logger ===============================
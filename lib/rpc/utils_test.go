@@ -0,0 +1,79 @@
+package swissknife
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadCertPoolRejectsEmptyFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "empty.crt")
+	require.NoError(t, os.WriteFile(path, nil, 0o600))
+
+	_, err := loadCertPool(path, nil)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "no CA certificates found")
+}
+
+func TestLoadCertPoolReportsRejectedBlocks(t *testing.T) {
+	pki := newTestPKI(t)
+	caPEM, err := os.ReadFile(pki.caCert)
+	require.NoError(t, err)
+
+	dir := t.TempDir()
+	bad := writePEM(t, dir, "bad.crt", "CERTIFICATE", []byte("not DER"))
+	_, err = loadCertPool(bad, nil)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "bad.crt block 1")
+
+	keyPEM, err := os.ReadFile(pki.clientKey)
+	require.NoError(t, err)
+	mixed := filepath.Join(dir, "mixed.crt")
+	require.NoError(t, os.WriteFile(mixed, append(keyPEM, caPEM...), 0o600))
+
+	var out, errOut bytes.Buffer
+	pool, err := loadCertPool(mixed, newTestLogger(&out, &errOut, LogLevelDebug))
+	require.NoError(t, err)
+	require.NotNil(t, pool)
+	require.Contains(t, errOut.String(), `mixed.crt block 1: unexpected PEM type "EC PRIVATE KEY"`)
+}
+
+func TestLoadCACertificatesFromDirectory(t *testing.T) {
+	first := newTestPKI(t)
+	second := newTestPKI(t)
+
+	dir := t.TempDir()
+	for name, src := range map[string]string{"a.crt": first.caCert, "b.pem": second.caCert} {
+		data, err := os.ReadFile(src)
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name), data, 0o600))
+	}
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "README"), []byte("CA bundle"), 0o600))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, ".hidden"), []byte("ignored"), 0o600))
+	require.NoError(t, os.Mkdir(filepath.Join(dir, "old"), 0o700))
+
+	certs, rejected, err := loadCACertificates(dir)
+	require.NoError(t, err)
+	require.Len(t, certs, 2)
+	require.Equal(t, []string{filepath.Join(dir, "README") + ": no PEM data"}, rejected)
+
+	// A server trusting the directory accepts clients of either CA.
+	server, err := NewITlsRpcServer(first.serverCert, first.serverKey, dir, "0")
+	require.NoError(t, err)
+	serve(t, server)
+	client, err := NewITlsRpcClient(first.caCert, second.clientCert, second.clientKey, server.Addr().String(), "second", WithServerName("localhost"))
+	require.NoError(t, err)
+	t.Cleanup(client.CloseClient)
+	require.Equal(t, 42, callAdd(t, client))
+}
+
+func TestClientMergesSystemRoots(t *testing.T) {
+	pki := newTestPKI(t)
+	_, addr := startTestServer(t, pki)
+
+	client := newTestClient(t, pki, addr, WithSystemRoots())
+	require.Equal(t, 42, callAdd(t, client))
+}
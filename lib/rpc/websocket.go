@@ -0,0 +1,466 @@
+package swissknife
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/rpc"
+	"strings"
+	"sync"
+	"time"
+)
+
+// webSocketProtocol is the WebSocket subprotocol carrying the RPC stream.
+// Bidirectional connections use bidiProtocol instead.
+const webSocketProtocol = "swissknife-rpc/1"
+
+// webSocketGUID is appended to the client's key to compute the
+// Sec-WebSocket-Accept header, as RFC 6455 requires.
+const webSocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// WebSocket frame opcodes.
+const (
+	wsContinuation = 0x0
+	wsBinary       = 0x2
+	wsClose        = 0x8
+	wsPing         = 0x9
+	wsPong         = 0xa
+)
+
+// wsMaxControlPayload is the largest payload allowed in a control frame.
+const wsMaxControlPayload = 125
+
+// wsCloseNormal is the payload of the close frame sent on Close: status
+// 1000, normal closure.
+var wsCloseNormal = []byte{0x03, 0xe8}
+
+var errWebSocketProtocol = errors.New("websocket: protocol error")
+
+// WithWebSocket makes the client reach the server through a WebSocket
+// upgrade of an HTTPS request for path, served by a WebSocketHandler, for
+// networks that only let HTTPS through. Calls behave as over a plain
+// connection.
+func WithWebSocket(path string) ClientOption {
+	return func(c *tlsRpcClient) {
+		c.webSocketPath = path
+	}
+}
+
+// WebSocketHandler is an http.Handler that accepts RPC connections upgraded
+// to WebSocket and serves them like connections accepted by the server's
+// listener, with the same limits, hooks and client certificate checks.
+type WebSocketHandler struct {
+	server *tlsRpcServer
+}
+
+// NewWebSocketHandler returns a WebSocket endpoint for server, which must
+// have been created by one of the NewITlsRpcServer functions.
+func NewWebSocketHandler(server ITlsRpcServer) (*WebSocketHandler, error) {
+	s, ok := server.(*tlsRpcServer)
+	if !ok {
+		return nil, fmt.Errorf("WebSocket handler needs a server created by NewITlsRpcServer, got %T", server)
+	}
+	return &WebSocketHandler{server: s}, nil
+}
+
+// TLSConfig returns a copy of the server's TLS configuration for the
+// http.Server serving the handler. It only offers HTTP/1.1, which WebSocket
+// upgrades require. The handler refuses upgrades without a verified client
+// certificate, unless the server has unauthenticated methods, so an
+// http.Server that does not verify client certificates serves nobody.
+func (h *WebSocketHandler) TLSConfig() *tls.Config {
+	config := h.server.tlsConfig.Clone()
+	config.NextProtos = []string{"http/1.1"}
+	return config
+}
+
+// ServeHTTP upgrades the request and serves RPC calls on the connection
+// until it closes.
+func (h *WebSocketHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s := h.server
+	if r.TLS == nil {
+		http.Error(w, "TLS required", http.StatusForbidden)
+		return
+	}
+	if err := h.checkClientCertificate(r.TLS); err != nil {
+		s.logger.Warnf("Rejecting WebSocket client %s: %v", r.RemoteAddr, err)
+		http.Error(w, ErrUnauthenticated.Error(), http.StatusForbidden)
+		return
+	}
+	if r.Method != http.MethodGet || !headerHasToken(r.Header, "Connection", "upgrade") || !headerHasToken(r.Header, "Upgrade", "websocket") {
+		http.Error(w, "expected a WebSocket upgrade", http.StatusBadRequest)
+		return
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "unsupported WebSocket version", http.StatusUpgradeRequired)
+		return
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if decoded, err := base64.StdEncoding.DecodeString(key); err != nil || len(decoded) != 16 {
+		http.Error(w, "invalid Sec-WebSocket-Key", http.StatusBadRequest)
+		return
+	}
+	protocol := h.selectProtocol(r)
+	if protocol == "" {
+		http.Error(w, "unsupported WebSocket subprotocol", http.StatusBadRequest)
+		return
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "connection cannot be upgraded", http.StatusInternalServerError)
+		return
+	}
+	if s.isClosed() {
+		http.Error(w, ErrServerClosed.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	if !s.admitConnection() {
+		s.logger.Warnf("Rejecting WebSocket client %s: %v (limit %d)", r.RemoteAddr, ErrTooManyConnections, s.limits.MaxConnections)
+		http.Error(w, ErrTooManyConnections.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		s.releaseConnection()
+		s.logger.Errorf("Failed to take over WebSocket connection from %s: %v", r.RemoteAddr, err)
+		return
+	}
+	conn.SetDeadline(time.Time{})
+	rw.Writer.WriteString("HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + webSocketAccept(key) + "\r\n" +
+		"Sec-WebSocket-Protocol: " + protocol + "\r\n\r\n")
+	if err := rw.Writer.Flush(); err != nil {
+		s.releaseConnection()
+		conn.Close()
+		s.logger.Errorf("Failed to upgrade WebSocket connection from %s: %v", r.RemoteAddr, err)
+		return
+	}
+
+	state := *r.TLS
+	state.NegotiatedProtocol = protocol
+	if len(state.VerifiedChains) == 0 {
+		state.PeerCertificates = nil
+	}
+	s.logger.Infof("New WebSocket client connected from %s", r.RemoteAddr)
+	s.handleConnection(newWebSocketConn(conn, rw.Reader, false, state))
+}
+
+// checkClientCertificate refuses connections whose client certificate was
+// not verified. A client certificate is required unless the server has
+// unauthenticated methods, and a certificate presented but not verified
+// means the http.Server does not use TLSConfig, which would otherwise make
+// every client anonymous without notice.
+func (h *WebSocketHandler) checkClientCertificate(state *tls.ConnectionState) error {
+	if len(state.VerifiedChains) > 0 {
+		return nil
+	}
+	if len(state.PeerCertificates) > 0 {
+		return errors.New("client certificate was not verified; serve the handler with its TLSConfig")
+	}
+	if len(h.server.unauthenticated) == 0 {
+		return errors.New("no verified client certificate; serve the handler with its TLSConfig")
+	}
+	return nil
+}
+
+// selectProtocol picks the subprotocol for r among those the client offered,
+// or returns an empty string when none is acceptable.
+func (h *WebSocketHandler) selectProtocol(r *http.Request) string {
+	offered := headerTokens(r.Header, "Sec-WebSocket-Protocol")
+	for _, protocol := range offered {
+		if protocol == bidiProtocol && h.server.bidirectional {
+			return protocol
+		}
+	}
+	for _, protocol := range offered {
+		if protocol == webSocketProtocol {
+			return protocol
+		}
+	}
+	return ""
+}
+
+// upgradeWebSocket asks the server to switch conn to WebSocket and returns
+// the resulting connection. Clients with services offer bidiProtocol, and
+// find out from the connection's negotiated protocol whether the server
+// accepted it.
+func (c *tlsRpcClient) upgradeWebSocket(conn *tls.Conn, address string, bidi bool) (*wsConn, error) {
+	conn.SetDeadline(deadline(c.timeouts.HandshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	key := base64.StdEncoding.EncodeToString(nonce)
+	protocols := webSocketProtocol
+	if bidi {
+		protocols = bidiProtocol + ", " + webSocketProtocol
+	}
+
+	req, err := http.NewRequest(http.MethodGet, "https://"+address+c.webSocketPath, nil)
+	if err != nil {
+		return nil, fmt.Errorf("invalid WebSocket URL: %w", err)
+	}
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	req.Header.Set("Sec-WebSocket-Key", key)
+	req.Header.Set("Sec-WebSocket-Protocol", protocols)
+	if err := req.Write(conn); err != nil {
+		return nil, fmt.Errorf("failed to send WebSocket upgrade: %w", err)
+	}
+
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read WebSocket upgrade response: %w", err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		resp.Body.Close()
+		return nil, fmt.Errorf("WebSocket upgrade refused with %s: %w", resp.Status, remoteError(rpc.ServerError(strings.TrimSpace(string(body)))))
+	}
+	if !headerHasToken(resp.Header, "Upgrade", "websocket") || resp.Header.Get("Sec-WebSocket-Accept") != webSocketAccept(key) {
+		return nil, errors.New("invalid WebSocket upgrade response")
+	}
+	protocol := resp.Header.Get("Sec-WebSocket-Protocol")
+	if protocol != webSocketProtocol && !(bidi && protocol == bidiProtocol) {
+		return nil, fmt.Errorf("server chose unexpected WebSocket subprotocol %q", protocol)
+	}
+
+	state := conn.ConnectionState()
+	state.NegotiatedProtocol = protocol
+	return newWebSocketConn(conn, reader, true, state), nil
+}
+
+// webSocketAccept returns the Sec-WebSocket-Accept value for key.
+func webSocketAccept(key string) string {
+	sum := sha1.Sum([]byte(key + webSocketGUID))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// headerTokens returns the comma separated values of the header name.
+func headerTokens(header http.Header, name string) []string {
+	var tokens []string
+	for _, value := range header.Values(name) {
+		for _, token := range strings.Split(value, ",") {
+			if token = strings.TrimSpace(token); token != "" {
+				tokens = append(tokens, token)
+			}
+		}
+	}
+	return tokens
+}
+
+// headerHasToken reports whether the header name lists token, ignoring case.
+func headerHasToken(header http.Header, name, token string) bool {
+	for _, t := range headerTokens(header, name) {
+		if strings.EqualFold(t, token) {
+			return true
+		}
+	}
+	return false
+}
+
+// wsConn carries a byte stream over a WebSocket connection: each Write is
+// sent as a binary frame, and Read returns the payloads of data frames in
+// order, regardless of message boundaries. Control frames are handled as
+// they arrive. Deadlines and addresses are those of the underlying
+// connection.
+type wsConn struct {
+	net.Conn
+	r *bufio.Reader
+
+	// client masks the frames sent, as RFC 6455 requires of clients, and
+	// expects unmasked frames in return.
+	client bool
+	state  tls.ConnectionState
+
+	// remaining is the unread payload of the current data frame, masked
+	// with mask from maskPos onwards when masked is set.
+	remaining int64
+	masked    bool
+	mask      [4]byte
+	maskPos   int
+
+	wmu       sync.Mutex
+	closeSent bool
+}
+
+func newWebSocketConn(conn net.Conn, r *bufio.Reader, client bool, state tls.ConnectionState) *wsConn {
+	return &wsConn{Conn: conn, r: r, client: client, state: state}
+}
+
+// ConnectionState returns the TLS state of the underlying connection, with
+// the negotiated WebSocket subprotocol as NegotiatedProtocol.
+func (c *wsConn) ConnectionState() tls.ConnectionState {
+	return c.state
+}
+
+func (c *wsConn) Read(p []byte) (int, error) {
+	for c.remaining == 0 {
+		if err := c.nextFrame(); err != nil {
+			return 0, err
+		}
+	}
+	if int64(len(p)) > c.remaining {
+		p = p[:c.remaining]
+	}
+	n, err := c.r.Read(p)
+	if c.masked {
+		for i := range p[:n] {
+			p[i] ^= c.mask[c.maskPos%4]
+			c.maskPos++
+		}
+	}
+	c.remaining -= int64(n)
+	return n, err
+}
+
+// nextFrame reads frame headers until a data frame starts, answering control
+// frames on the way. Headers are only consumed once complete, so a read
+// deadline expiring while waiting leaves the stream intact.
+func (c *wsConn) nextFrame() error {
+	head, err := c.r.Peek(2)
+	if err != nil {
+		return err
+	}
+	fin := head[0]&0x80 != 0
+	opcode := head[0] & 0x0f
+	masked := head[1]&0x80 != 0
+	size := 2
+	switch head[1] & 0x7f {
+	case 126:
+		size += 2
+	case 127:
+		size += 8
+	}
+	if masked {
+		size += 4
+	}
+	if head, err = c.r.Peek(size); err != nil {
+		return err
+	}
+
+	if head[0]&0x70 != 0 {
+		return fmt.Errorf("%w: reserved bits set", errWebSocketProtocol)
+	}
+	if masked == c.client {
+		return fmt.Errorf("%w: unexpected frame masking", errWebSocketProtocol)
+	}
+	length := int64(head[1] & 0x7f)
+	switch length {
+	case 126:
+		length = int64(binary.BigEndian.Uint16(head[2:4]))
+	case 127:
+		length = int64(binary.BigEndian.Uint64(head[2:10]))
+		if length < 0 {
+			return fmt.Errorf("%w: invalid frame length", errWebSocketProtocol)
+		}
+	}
+	var mask [4]byte
+	if masked {
+		copy(mask[:], head[size-4:size])
+	}
+	c.r.Discard(size)
+
+	switch opcode {
+	case wsBinary, wsContinuation:
+		c.remaining, c.masked, c.mask, c.maskPos = length, masked, mask, 0
+		return nil
+	case wsClose, wsPing, wsPong:
+		if !fin || length > wsMaxControlPayload {
+			return fmt.Errorf("%w: invalid control frame", errWebSocketProtocol)
+		}
+	default:
+		return fmt.Errorf("%w: unexpected opcode %d", errWebSocketProtocol, opcode)
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(c.r, payload); err != nil {
+		return err
+	}
+	if masked {
+		for i := range payload {
+			payload[i] ^= mask[i%4]
+		}
+	}
+	switch opcode {
+	case wsClose:
+		c.writeFrame(wsClose, wsCloseNormal)
+		return io.EOF
+	case wsPing:
+		return c.writeFrame(wsPong, payload)
+	}
+	return nil
+}
+
+func (c *wsConn) Write(p []byte) (int, error) {
+	if err := c.writeFrame(wsBinary, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// writeFrame sends a single final frame. Nothing can be sent after a close
+// frame.
+func (c *wsConn) writeFrame(opcode byte, payload []byte) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if c.closeSent {
+		return net.ErrClosed
+	}
+	if opcode == wsClose {
+		c.closeSent = true
+	}
+
+	frame := make([]byte, 2, 14+len(payload))
+	frame[0] = 0x80 | opcode
+	switch n := len(payload); {
+	case n <= wsMaxControlPayload:
+		frame[1] = byte(n)
+	case n <= 0xffff:
+		frame[1] = 126
+		frame = binary.BigEndian.AppendUint16(frame, uint16(n))
+	default:
+		frame[1] = 127
+		frame = binary.BigEndian.AppendUint64(frame, uint64(n))
+	}
+	if !c.client {
+		_, err := c.Conn.Write(append(frame, payload...))
+		return err
+	}
+
+	var mask [4]byte
+	if _, err := rand.Read(mask[:]); err != nil {
+		return err
+	}
+	frame[1] |= 0x80
+	frame = append(frame, mask[:]...)
+	for i, b := range payload {
+		frame = append(frame, b^mask[i%4])
+	}
+	_, err := c.Conn.Write(frame)
+	return err
+}
+
+// Close sends a close frame, unless one was already sent, and closes the
+// underlying connection.
+func (c *wsConn) Close() error {
+	c.Conn.SetWriteDeadline(time.Now().Add(time.Second))
+	c.writeFrame(wsClose, wsCloseNormal)
+	return c.Conn.Close()
+}
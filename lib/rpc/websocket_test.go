@@ -0,0 +1,144 @@
+package swissknife
+
+import (
+	"bytes"
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// startWebSocketServer serves a test server created with opts over
+// WebSocket at /rpc and returns it with the HTTPS server's address.
+func startWebSocketServer(t *testing.T, pki *testPKI, opts ...ServerOption) (*tlsRpcServer, string) {
+	t.Helper()
+
+	s, _ := startTestServer(t, pki, opts...)
+	handler, err := NewWebSocketHandler(s)
+	require.NoError(t, err)
+
+	mux := http.NewServeMux()
+	mux.Handle("/rpc", handler)
+	ts := httptest.NewUnstartedServer(mux)
+	ts.TLS = handler.TLSConfig()
+	ts.StartTLS()
+	t.Cleanup(ts.Close)
+	return s, ts.Listener.Addr().String()
+}
+
+func TestWebSocketTransport(t *testing.T) {
+	pki := newTestPKI(t)
+	infos := make(chan ConnInfo, 1)
+	s, addr := startWebSocketServer(t, pki, WithConnHooks(ConnHooks{
+		OnConnect: func(info ConnInfo) error {
+			infos <- info
+			return nil
+		},
+	}))
+	require.NoError(t, s.RegisterMethod("Slow", new(SlowService)))
+
+	client := newTestClient(t, pki, addr, WithWebSocket("/rpc"))
+	info := <-infos
+	require.Equal(t, "CN=test-client", info.Identity())
+	require.Equal(t, webSocketProtocol, info.NegotiatedProtocol)
+	for i := 0; i < 3; i++ {
+		require.Equal(t, 42, callAdd(t, client))
+	}
+
+	// Large payloads span several frames with 64-bit lengths.
+	large := bytes.Repeat([]byte("x"), 200<<10)
+	reply, err := client.ConnectToRpcServerTls("Slow.Wait", large)
+	require.NoError(t, err)
+	require.Equal(t, large, reply)
+
+	_, err = client.ConnectToRpcServerTls("Slow.Fail", nil)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "boom")
+	require.Len(t, s.Connections(), 1)
+}
+
+func TestWebSocketBidirectional(t *testing.T) {
+	pki := newTestPKI(t)
+	peers := make(chan *Peer, 1)
+	_, addr := startWebSocketServer(t, pki, WithBidirectional(), peerHooks(peers))
+
+	newTestClient(t, pki, addr, WithWebSocket("/rpc"), WithClientService("Worker", &WorkerService{}))
+	peer := <-peers
+	require.NotNil(t, peer)
+	reply, err := peer.Call("Worker.Run", []byte("job"))
+	require.NoError(t, err)
+	require.Equal(t, "done job", string(reply))
+
+	_, plainAddr := startWebSocketServer(t, pki)
+	_, err = NewITlsRpcClient(pki.caCert, pki.clientCert, pki.clientKey, plainAddr, "worker", WithWebSocket("/rpc"), WithClientService("Worker", &WorkerService{}))
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "does not accept bidirectional connections")
+}
+
+func TestWebSocketRejections(t *testing.T) {
+	pki := newTestPKI(t)
+	limits := DefaultServerLimits()
+	limits.MaxConnections = 1
+	_, addr := startWebSocketServer(t, pki, WithLimits(limits))
+
+	_, err := NewITlsRpcClient(pki.caCert, pki.clientCert, pki.clientKey, addr, "lost", WithWebSocket("/missing"))
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "404")
+
+	_, err = NewITlsRpcClient(pki.caCert, "", "", addr, "anonymous", WithWebSocket("/rpc"))
+	require.Error(t, err)
+
+	newTestClient(t, pki, addr, WithWebSocket("/rpc"))
+	_, err = NewITlsRpcClient(pki.caCert, pki.clientCert, pki.clientKey, addr, "second", WithWebSocket("/rpc"))
+	require.ErrorIs(t, err, ErrTooManyConnections)
+
+	resp, err := gatewayClient(t, pki, true).Get("https://" + addr + "/rpc")
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
+
+func TestWebSocketRequiresVerifiedClientCertificates(t *testing.T) {
+	pki := newTestPKI(t)
+	for _, tc := range []struct {
+		name       string
+		clientAuth tls.ClientAuthType
+		opts       []ServerOption
+		anonymous  bool
+	}{
+		{name: "no client certificates", clientAuth: tls.NoClientCert},
+		{name: "unverified client certificates", clientAuth: tls.RequestClientCert},
+		{name: "unverified with unauthenticated methods", clientAuth: tls.RequestClientCert, opts: []ServerOption{WithUnauthenticatedMethods("TestService.Add")}},
+		{name: "anonymous with unauthenticated methods", clientAuth: tls.NoClientCert, opts: []ServerOption{WithUnauthenticatedMethods("TestService.Add")}, anonymous: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s, _ := startTestServer(t, pki, tc.opts...)
+			handler, err := NewWebSocketHandler(s)
+			require.NoError(t, err)
+
+			// A TLS configuration that does not come from TLSConfig.
+			ts := httptest.NewUnstartedServer(handler)
+			ts.TLS = &tls.Config{
+				Certificates: s.tlsConfig.Certificates,
+				ClientAuth:   tc.clientAuth,
+				NextProtos:   []string{"http/1.1"},
+			}
+			ts.StartTLS()
+			t.Cleanup(ts.Close)
+			addr := ts.Listener.Addr().String()
+
+			client, err := NewITlsRpcClient(pki.caCert, pki.clientCert, pki.clientKey, addr, "test-client", WithWebSocket("/rpc"))
+			if tc.anonymous {
+				require.NoError(t, err)
+				defer client.CloseClient()
+				require.Equal(t, 42, callAdd(t, client))
+				return
+			}
+			require.ErrorIs(t, err, ErrUnauthenticated)
+			require.Contains(t, err.Error(), "403")
+			require.Empty(t, s.Connections())
+		})
+	}
+}